@@ -0,0 +1,271 @@
+package cachectl
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+	"webp_server_go/config"
+	"webp_server_go/helper"
+
+	"github.com/h2non/filetype"
+	log "github.com/sirupsen/logrus"
+)
+
+// fsck 发现的问题类型
+const (
+	ProblemEmpty            = "empty"
+	ProblemTruncated        = "truncated"
+	ProblemInvalid          = "invalid"
+	ProblemOrphan           = "orphan"
+	ProblemChecksumMismatch = "checksum_mismatch"
+	ProblemBadMetadata      = "bad_metadata"
+	ProblemStrayTmp         = "stray_tmp"
+	ProblemTrailingData     = "trailing_data"
+)
+
+// 比这更新的临时文件可能属于正在进行的转换，不视为残留
+var strayTmpAge = time.Hour
+
+type FsckIssue struct {
+	Tier     string `json:"tier"`
+	Path     string `json:"path"`
+	Problem  string `json:"problem"`
+	Detail   string `json:"detail,omitempty"`
+	Warning  bool   `json:"warning,omitempty"` // 只报告，修复时不删除
+	Repaired bool   `json:"repaired"`
+}
+
+type FsckReport struct {
+	DryRun  bool           `json:"dry_run"`
+	Scanned map[string]int `json:"scanned"`
+	Issues  []FsckIssue    `json:"issues"`
+}
+
+type fsck struct {
+	repair bool
+	report FsckReport
+}
+
+// 扫描 raw、exhaust、metadata 三个层级，报告（repair 为 true 时修复）不一致的缓存文件
+func Fsck(repair bool) FsckReport {
+	f := &fsck{
+		repair: repair,
+		report: FsckReport{DryRun: !repair, Scanned: map[string]int{}, Issues: []FsckIssue{}},
+	}
+
+	f.walk(helper.TierExhaust, f.checkExhaust)
+	f.walk(helper.TierMetadata, f.checkMetadata)
+	f.walk(helper.TierRaw, f.checkRaw)
+
+	log.Infof("缓存检查完成: 发现 %d 个问题, 修复=%t", len(f.report.Issues), repair)
+	return f.report
+}
+
+func (f *fsck) walk(tier string, check func(file string, info os.FileInfo)) {
+	_ = filepath.Walk(tierRoot(tier), func(file string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		f.report.Scanned[tier]++
+		if strings.HasSuffix(file, ".tmp") {
+			if time.Since(info.ModTime()) > strayTmpAge {
+				f.issue(tier, file, ProblemStrayTmp, "")
+			}
+			return nil
+		}
+		check(file, info)
+		return nil
+	})
+}
+
+func (f *fsck) checkExhaust(file string, info os.FileInfo) {
+	if helper.IsExhaustSidecar(file) {
+		// 分片布局的旁路文件与图像同名，只是扩展名不同
+		images, _ := filepath.Glob(strings.TrimSuffix(file, ".json") + ".*")
+		if len(images) <= 1 {
+			f.issue(helper.TierExhaust, file, ProblemOrphan, "旁路文件对应的图像不存在")
+		}
+		return
+	}
+	if info.Size() == 0 {
+		f.issue(helper.TierExhaust, file, ProblemEmpty, "")
+		return
+	}
+	if err := validateImage(file); errors.Is(err, errTrailingData) {
+		// 图像本身完整，末尾多出的数据不影响解码
+		f.warn(helper.TierExhaust, file, ProblemTrailingData, err.Error())
+	} else if err != nil {
+		problem := ProblemInvalid
+		if errors.Is(err, errTruncated) {
+			problem = ProblemTruncated
+		}
+		f.issue(helper.TierExhaust, file, problem, err.Error())
+		return
+	}
+
+	// 远程原图在下载后会被定时清理，只有本地源文件缺失时才视为孤儿
+	source := exhaustSource(helper.ExhaustKey(file))
+	if source != "" && !strings.HasPrefix(source, path.Clean(config.Config.RemoteRawPath)) && !helper.FileExists(source) {
+		f.issue(helper.TierExhaust, file, ProblemOrphan, "源文件不存在: "+source)
+	}
+}
+
+func (f *fsck) checkMetadata(file string, info os.FileInfo) {
+	buf, err := os.ReadFile(file)
+	if err != nil {
+		return
+	}
+	var metadata config.MetaFile
+	if err := json.Unmarshal(buf, &metadata); err != nil || metadata.Id == "" {
+		f.issue(helper.TierMetadata, file, ProblemBadMetadata, "无法解析元数据")
+		return
+	}
+	if strings.Contains(metadata.Path, "://") {
+		// 远程图片的校验和来自 ETag，无法离线校验
+		return
+	}
+
+	metaPath, _, _ := strings.Cut(metadata.Path, "?")
+	source := path.Join(config.Config.ImgPath, metaPath)
+	if !helper.FileExists(source) {
+		f.issue(helper.TierMetadata, file, ProblemOrphan, "源文件不存在: "+source)
+		return
+	}
+	if helper.HashFile(source) != metadata.Checksum {
+		f.issue(helper.TierMetadata, file, ProblemChecksumMismatch, "源文件已变化: "+source)
+	}
+}
+
+// 远程原图下载时不写元数据，按需重新下载，缺少元数据不算孤儿，只检查空文件
+func (f *fsck) checkRaw(file string, info os.FileInfo) {
+	if info.Size() == 0 {
+		f.issue(helper.TierRaw, file, ProblemEmpty, "")
+	}
+}
+
+// 只报告、不修复的问题
+func (f *fsck) warn(tier, file, problem, detail string) {
+	f.report.Issues = append(f.report.Issues, FsckIssue{Tier: tier, Path: file, Problem: problem, Detail: detail, Warning: true})
+}
+
+func (f *fsck) issue(tier, file, problem, detail string) {
+	issue := FsckIssue{Tier: tier, Path: file, Problem: problem, Detail: detail}
+	if f.repair {
+		if err := os.Remove(file); err != nil {
+			log.Warnf("修复失败: %s, 错误: %v", file, err)
+		} else {
+			issue.Repaired = true
+			if tier == helper.TierMetadata {
+				f.removeMetadataOutputs(file)
+			}
+			if tier == helper.TierExhaust && !helper.IsExhaustSidecar(file) {
+				helper.RemoveExhaustSidecar(file)
+			}
+		}
+	}
+	f.report.Issues = append(f.report.Issues, issue)
+}
+
+// 元数据失效时，一并删除预取按 id 生成的优化图像
+func (f *fsck) removeMetadataOutputs(metadataFile string) {
+	rel, _ := filepath.Rel(config.Config.MetadataPath, metadataFile)
+	stem := strings.TrimSuffix(filepath.Join(config.Config.ExhaustPath, rel), ".json")
+	for _, ext := range []string{".webp", ".avif", ".jxl"} {
+		_ = os.Remove(stem + ext)
+	}
+}
+
+var (
+	errTruncated    = errors.New("图像数据被截断")
+	errTrailingData = errors.New("图像结束标记之后还有数据")
+)
+
+// 通过文件头与结构校验图像，不进行完整解码
+func validateImage(file string) error {
+	buf, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case bytes.HasPrefix(buf, []byte{0xFF, 0x0A}):
+		// JPEG XL 裸码流，没有可校验的结构
+		return nil
+	case len(buf) > 12 && string(buf[4:12]) == "JXL \r\n\x87\n", len(buf) > 12 && string(buf[4:8]) == "ftyp":
+		return validateBoxes(buf)
+	}
+
+	kind, _ := filetype.Match(buf)
+	switch kind.Extension {
+	case "jpg":
+		if _, _, err := image.DecodeConfig(bytes.NewReader(buf)); err != nil {
+			return err
+		}
+		if !bytes.HasSuffix(bytes.TrimRight(buf, "\x00"), []byte{0xFF, 0xD9}) {
+			// EXIF 缩略图也有 EOI，只有最后一个 SOS 之后的 EOI 才是主图像的结束标记
+			if bytes.LastIndex(buf, []byte{0xFF, 0xD9}) < bytes.LastIndex(buf, []byte{0xFF, 0xDA}) {
+				return errTruncated
+			}
+			return errTrailingData
+		}
+	case "png":
+		if _, _, err := image.DecodeConfig(bytes.NewReader(buf)); err != nil {
+			return err
+		}
+		if !bytes.Contains(buf[len(buf)-min(len(buf), 12):], []byte("IEND")) {
+			return errTruncated
+		}
+	case "gif":
+		if _, _, err := image.DecodeConfig(bytes.NewReader(buf)); err != nil {
+			return err
+		}
+		if buf[len(buf)-1] != 0x3B {
+			return errTruncated
+		}
+	case "webp":
+		// RIFF 头中记录的长度不包含前 8 字节
+		if len(buf) < 12 || int(binary.LittleEndian.Uint32(buf[4:8]))+8 > len(buf) {
+			return errTruncated
+		}
+	case "":
+		return errors.New("无法识别的文件类型")
+	}
+	return nil
+}
+
+// 校验 ISOBMFF（AVIF/HEIF/JXL 容器）顶层 box 没有超出文件末尾
+func validateBoxes(buf []byte) error {
+	for offset := 0; offset < len(buf); {
+		if len(buf)-offset < 8 {
+			return errTruncated
+		}
+		size := uint64(binary.BigEndian.Uint32(buf[offset : offset+4]))
+		header := uint64(8)
+		switch size {
+		case 0:
+			// box 延伸到文件末尾
+			return nil
+		case 1:
+			if len(buf)-offset < 16 {
+				return errTruncated
+			}
+			size = binary.BigEndian.Uint64(buf[offset+8 : offset+16])
+			header = 16
+		}
+		if size < header || uint64(offset)+size > uint64(len(buf)) {
+			return errTruncated
+		}
+		offset += int(size)
+	}
+	return nil
+}
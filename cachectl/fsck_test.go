@@ -0,0 +1,153 @@
+package cachectl
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+	"webp_server_go/config"
+	"webp_server_go/helper"
+)
+
+func encodeTestImage(t *testing.T, encode func(*bytes.Buffer, image.Image) error) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := encode(&buf, image.NewRGBA(image.Rect(0, 0, 8, 8))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func testJPEG(t *testing.T) []byte {
+	return encodeTestImage(t, func(buf *bytes.Buffer, img image.Image) error { return jpeg.Encode(buf, img, nil) })
+}
+
+func TestValidateImage(t *testing.T) {
+	jpg := testJPEG(t)
+	pngFile := encodeTestImage(t, func(buf *bytes.Buffer, img image.Image) error { return png.Encode(buf, img) })
+	gifFile := encodeTestImage(t, func(buf *bytes.Buffer, img image.Image) error { return gif.Encode(buf, img, nil) })
+	webp := append([]byte("RIFF"), binary.LittleEndian.AppendUint32(nil, 12)...)
+	webp = append(webp, "WEBPVP8L"...)
+	webp = append(webp, 0, 0, 0, 0)
+	avif := binary.BigEndian.AppendUint32(nil, 16)
+	avif = append(avif, "ftypavif"...)
+	avif = append(avif, 0, 0, 0, 0)
+
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr error // nil: valid; errInvalid: any other error
+	}{
+		{"jpeg", jpg, nil},
+		{"jpeg zero padding", append(slices.Clone(jpg), 0, 0, 0), nil},
+		{"jpeg trailing data", append(slices.Clone(jpg), "trailing"...), errTrailingData},
+		{"jpeg missing eoi", jpg[:len(jpg)-2], errTruncated},
+		{"jpeg thumbnail eoi only", append(slices.Clone(jpg[:len(jpg)-2]), 0xff, 0xd9, 0xff, 0xda, 1, 2, 3), errTruncated},
+		{"png", pngFile, nil},
+		{"png missing iend", pngFile[:len(pngFile)-12], errTruncated},
+		{"gif", gifFile, nil},
+		{"gif missing trailer", gifFile[:len(gifFile)-1], errTruncated},
+		{"webp", webp, nil},
+		{"webp truncated", webp[:len(webp)-2], errTruncated},
+		{"avif", avif, nil},
+		{"avif truncated", avif[:len(avif)-2], errTruncated},
+		{"jpeg broken header", []byte{0xff, 0xd8, 0xff, 0xdb, 0, 0, 1, 2}, errInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "image")
+			writeCacheFile(t, file, tt.data)
+			err := validateImage(file)
+			switch {
+			case tt.wantErr == nil && err != nil:
+				t.Fatalf("validateImage() = %v, want nil", err)
+			case tt.wantErr == errInvalid && (err == nil || errors.Is(err, errTruncated) || errors.Is(err, errTrailingData)):
+				t.Fatalf("validateImage() = %v, want an invalid image error", err)
+			case tt.wantErr != nil && tt.wantErr != errInvalid && !errors.Is(err, tt.wantErr):
+				t.Fatalf("validateImage() = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// 表示除截断和尾部数据以外的任意错误
+var errInvalid = errors.New("invalid")
+
+func TestFsck(t *testing.T) {
+	withCacheDirs(t, nil)
+	jpg := testJPEG(t)
+	exhaust := func(name string) string { return filepath.Join(config.Config.ExhaustPath, name) }
+	raw := func(name string) string { return filepath.Join(config.Config.RemoteRawPath, name) }
+	metadata := func(name string) string { return filepath.Join(config.Config.MetadataPath, name) }
+
+	writeCacheFile(t, exhaust("ok.jpg"), jpg)
+	writeCacheFile(t, exhaust("empty.jpg"), nil)
+	writeCacheFile(t, exhaust("truncated.jpg"), jpg[:len(jpg)-2])
+	writeCacheFile(t, exhaust("trailing.jpg"), append(slices.Clone(jpg), "trailing"...))
+	writeCacheFile(t, exhaust("fresh.jpg.tmp"), nil)
+	writeCacheFile(t, exhaust("old.jpg.tmp"), nil)
+	old := time.Now().Add(-2 * strayTmpAge)
+	if err := os.Chtimes(exhaust("old.jpg.tmp"), old, old); err != nil {
+		t.Fatal(err)
+	}
+	// 远程原图下载时不写元数据
+	writeCacheFile(t, raw("host/1"), []byte("raw"))
+	writeCacheFile(t, raw("host/2"), nil)
+	writeCacheFile(t, metadata("bad.json"), []byte("{"))
+	writeMetadata(t, metadata("orphan.json"), "/missing.jpg", "x")
+
+	want := map[string]FsckIssue{
+		exhaust("empty.jpg"):     {Tier: helper.TierExhaust, Problem: ProblemEmpty},
+		exhaust("truncated.jpg"): {Tier: helper.TierExhaust, Problem: ProblemTruncated},
+		exhaust("trailing.jpg"):  {Tier: helper.TierExhaust, Problem: ProblemTrailingData, Warning: true},
+		exhaust("old.jpg.tmp"):   {Tier: helper.TierExhaust, Problem: ProblemStrayTmp},
+		raw("host/2"):            {Tier: helper.TierRaw, Problem: ProblemEmpty},
+		metadata("bad.json"):     {Tier: helper.TierMetadata, Problem: ProblemBadMetadata},
+		metadata("orphan.json"):  {Tier: helper.TierMetadata, Problem: ProblemOrphan},
+	}
+	check := func(report FsckReport, repair bool) {
+		t.Helper()
+		if report.DryRun == repair {
+			t.Fatalf("DryRun = %v with repair %v", report.DryRun, repair)
+		}
+		if len(report.Issues) != len(want) {
+			t.Fatalf("%d issues, want %d: %+v", len(report.Issues), len(want), report.Issues)
+		}
+		for _, issue := range report.Issues {
+			expected, ok := want[issue.Path]
+			if !ok || issue.Tier != expected.Tier || issue.Problem != expected.Problem || issue.Warning != expected.Warning {
+				t.Fatalf("unexpected issue %+v", issue)
+			}
+			if issue.Repaired != (repair && !issue.Warning) {
+				t.Fatalf("%s repaired = %v", issue.Path, issue.Repaired)
+			}
+		}
+	}
+
+	check(Fsck(false), false)
+	for file := range want {
+		if !helper.FileExists(file) {
+			t.Fatalf("dry run removed %s", file)
+		}
+	}
+
+	check(Fsck(true), true)
+	for file, issue := range want {
+		if helper.FileExists(file) == !issue.Warning {
+			t.Fatalf("%s exists = %v after repair", file, helper.FileExists(file))
+		}
+	}
+	for _, file := range []string{exhaust("ok.jpg"), exhaust("fresh.jpg.tmp"), raw("host/1")} {
+		if !helper.FileExists(file) {
+			t.Fatalf("repair removed %s", file)
+		}
+	}
+}
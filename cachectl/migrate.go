@@ -0,0 +1,74 @@
+package cachectl
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"webp_server_go/config"
+	"webp_server_go/helper"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type MigrateResult struct {
+	Migrated int `json:"migrated"`
+	Skipped  int `json:"skipped"`
+	Failed   int `json:"failed"`
+}
+
+// 将镜像布局的 EXHAUST_PATH 原地迁移为分片布局，只移动文件并写入旁路文件，不重新编码
+func MigrateExhaust() MigrateResult {
+	var result MigrateResult
+	if config.Config.ExhaustLayout != helper.ExhaustLayoutSharded {
+		log.Warn("EXHAUST_LAYOUT 不是 sharded，迁移后需要修改配置才能命中迁移后的缓存")
+	}
+
+	var files []string
+	helper.WalkExhaust(func(file string, info os.FileInfo, key string) {
+		files = append(files, file)
+	})
+
+	for _, file := range files {
+		key := helper.ExhaustKey(file)
+		dest := helper.ShardedExhaustFilename(key)
+		if dest == path.Clean(file) {
+			// 已经是分片布局
+			result.Skipped++
+			continue
+		}
+		if err := os.MkdirAll(path.Dir(dest), 0755); err != nil {
+			log.Warnf("创建目录失败: %s, 错误: %v", path.Dir(dest), err)
+			result.Failed++
+			continue
+		}
+		// 重命名保留修改时间，缓存清理和软清除状态不受影响
+		if err := os.Rename(file, dest); err != nil {
+			log.Warnf("迁移文件失败: %s, 错误: %v", file, err)
+			result.Failed++
+			continue
+		}
+		if err := helper.WriteExhaustSidecar(dest, key); err != nil {
+			log.Warnf("写入旁路文件失败: %s, 错误: %v", dest, err)
+		}
+		result.Migrated++
+	}
+
+	removeEmptyDirs(config.Config.ExhaustPath)
+	log.Infof("EXHAUST_PATH 迁移完成: 迁移=%d, 跳过=%d, 失败=%d", result.Migrated, result.Skipped, result.Failed)
+	return result
+}
+
+// 自底向上删除迁移后留下的空目录
+func removeEmptyDirs(root string) {
+	var dirs []string
+	_ = filepath.Walk(root, func(dir string, info os.FileInfo, err error) error {
+		if err == nil && info.IsDir() && dir != root {
+			dirs = append(dirs, dir)
+		}
+		return nil
+	})
+	for i := len(dirs) - 1; i >= 0; i-- {
+		// 非空目录删除会失败，直接忽略
+		_ = os.Remove(dirs[i])
+	}
+}
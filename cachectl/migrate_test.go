@@ -0,0 +1,54 @@
+package cachectl
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"webp_server_go/config"
+	"webp_server_go/helper"
+)
+
+func TestMigrateExhaust(t *testing.T) {
+	withCacheDirs(t, nil)
+	jpg := testJPEG(t)
+	keys := []string{"/img/a_w200_h0_mw0_mh0.jpg", "/img/sub/b.jpg"}
+	for _, key := range keys {
+		writeCacheFile(t, filepath.Join(config.Config.ExhaustPath, key), jpg)
+	}
+
+	config.Config.ExhaustLayout = helper.ExhaustLayoutSharded
+	if result := MigrateExhaust(); result != (MigrateResult{Migrated: 2}) {
+		t.Fatalf("MigrateExhaust() = %+v, want 2 migrated", result)
+	}
+	for _, key := range keys {
+		file := helper.ExhaustFilename(key)
+		if !helper.FileExists(file) {
+			t.Fatalf("%s was not moved to %s", key, file)
+		}
+		if got := helper.ExhaustKey(file); got != key {
+			t.Fatalf("ExhaustKey() = %q, want %q", got, key)
+		}
+		if sidecar, err := helper.ReadExhaustSidecar(file); err != nil || sidecar.ContentType != "image/jpeg" {
+			t.Fatalf("sidecar = %+v, %v, want content type image/jpeg", sidecar, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(config.Config.ExhaustPath, "img")); !os.IsNotExist(err) {
+		t.Fatal("empty mirror directories should be removed")
+	}
+
+	if result := MigrateExhaust(); result != (MigrateResult{Skipped: 2}) {
+		t.Fatalf("second MigrateExhaust() = %+v, want 2 skipped", result)
+	}
+
+	// 分片布局下按缓存键清除，旁路文件一并删除
+	if _, err := Purge(PurgeRequest{Path: "/img/a.jpg"}); err != nil {
+		t.Fatal(err)
+	}
+	purged := helper.ExhaustFilename(keys[0])
+	if helper.FileExists(purged) || helper.FileExists(purged[:len(purged)-len(".jpg")]+".json") {
+		t.Fatal("purged file or its sidecar still exists")
+	}
+	if !helper.FileExists(helper.ExhaustFilename(keys[1])) {
+		t.Fatal("purging one path removed another")
+	}
+}
@@ -0,0 +1,266 @@
+package cachectl
+
+import (
+	"encoding/json"
+	"errors"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"webp_server_go/config"
+	"webp_server_go/helper"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// buildExhaustFilename 在扩展名前追加的参数后缀，例如 a_w200_h0_mw0_mh0.jpg
+var variantSuffix = regexp.MustCompile(`_w-?\d+_h-?\d+_mw-?\d+_mh-?\d+[^/]*$`)
+
+type PurgeRequest struct {
+	Path   string `json:"path"`   // 清除某个源路径的所有变体
+	Prefix string `json:"prefix"` // 清除某个路径前缀下的所有内容
+	Tag    string `json:"tag"`    // 清除 CACHE_TAGS 中该标签对应的所有前缀
+	Tenant string `json:"tenant"` // 清除某个 IMG_MAP 前缀或远程源站 host 的所有内容
+	Soft   bool   `json:"soft"`   // 仅标记为过期，下次请求时重新生成
+}
+
+type PurgeResult struct {
+	Files int64 `json:"files"`
+	Bytes int64 `json:"bytes"`
+	Soft  bool  `json:"soft"`
+}
+
+type purger struct {
+	soft   bool
+	seen   map[string]bool
+	result PurgeResult
+}
+
+// 根据请求清除 EXHAUST_PATH、REMOTE_RAW_PATH 与 METADATA_PATH 中的缓存文件
+func Purge(req PurgeRequest) (PurgeResult, error) {
+	if req.Path == "" && req.Prefix == "" && req.Tag == "" && req.Tenant == "" {
+		return PurgeResult{}, errors.New("必须指定 path、prefix、tag 或 tenant 之一")
+	}
+
+	p := &purger{soft: req.Soft, seen: map[string]bool{}}
+	p.result.Soft = req.Soft
+
+	if req.Path != "" {
+		p.purgePath(path.Clean("/" + req.Path))
+	}
+	if req.Prefix != "" {
+		p.purgePrefix(req.Prefix)
+	}
+	if req.Tag != "" {
+		prefixes, ok := config.Config.CacheTags[req.Tag]
+		if !ok {
+			return p.result, errors.New("未知的缓存标签: " + req.Tag)
+		}
+		for _, prefix := range prefixes {
+			p.purgePrefix(prefix)
+		}
+	}
+	if req.Tenant != "" {
+		if !p.purgeTenant(req.Tenant) {
+			return p.result, errors.New("未知的租户: " + req.Tenant)
+		}
+	}
+
+	log.Infof("缓存清除完成: 文件=%d, 字节=%d, 软清除=%t", p.result.Files, p.result.Bytes, p.soft)
+	return p.result, nil
+}
+
+// 清除单个源路径生成的所有变体
+func (p *purger) purgePath(reqPath string) {
+	exhaustFile := path.Join(config.Config.ExhaustPath, reqPath)
+	entries, err := os.ReadDir(path.Dir(exhaustFile))
+	if err == nil {
+		for _, entry := range entries {
+			if !entry.IsDir() && sourceName(entry.Name()) == path.Base(exhaustFile) {
+				p.purgeFile(path.Join(path.Dir(exhaustFile), entry.Name()))
+			}
+		}
+	}
+	if config.Config.ExhaustLayout == helper.ExhaustLayoutSharded {
+		helper.WalkExhaust(func(file string, info os.FileInfo, key string) {
+			if sourceKey(key) == reqPath {
+				p.purgeExhaust(file)
+			}
+		})
+	}
+
+	for _, remoteAddr := range remoteAddrs(reqPath) {
+		u, _ := url.Parse(remoteAddr)
+		p.purgeFile(path.Join(config.Config.RemoteRawPath, u.Host, helper.HashString(remoteAddr)))
+	}
+
+	p.purgeMetadata(func(metaPath string) bool {
+		return metaPath == reqPath || slices.Contains(remoteAddrs(reqPath), metaPath)
+	})
+}
+
+// 清除路径前缀下的所有内容
+func (p *purger) purgePrefix(prefix string) {
+	if !strings.HasPrefix(prefix, "/") {
+		prefix = "/" + prefix
+	}
+	p.purgeTree(config.Config.ExhaustPath, prefix)
+	if config.Config.ExhaustLayout == helper.ExhaustLayoutSharded {
+		helper.WalkExhaust(func(file string, info os.FileInfo, key string) {
+			if hasPathPrefix(key, prefix) {
+				p.purgeExhaust(file)
+			}
+		})
+	}
+
+	// 远程原图以 URL 哈希命名，无法按路径筛选，只有整个 IMG_MAP 前缀被覆盖时才清除对应 host 的原图目录
+	for mapPrefix, target := range config.Config.ImageMap {
+		if hasPathPrefix(mapPrefix, prefix) {
+			if u, err := url.Parse(target); err == nil && u.Host != "" {
+				p.purgeTree(path.Join(config.Config.RemoteRawPath, u.Host), "")
+			}
+		}
+	}
+
+	remotePrefixes := remoteAddrs(prefix)
+	p.purgeMetadata(func(metaPath string) bool {
+		if hasPathPrefix(metaPath, prefix) {
+			return true
+		}
+		for _, remotePrefix := range remotePrefixes {
+			if hasPathPrefix(metaPath, remotePrefix) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// 租户可以是 IMG_MAP 中的前缀，也可以是远程源站的 host
+func (p *purger) purgeTenant(tenant string) bool {
+	found := false
+	for mapPrefix, target := range config.Config.ImageMap {
+		u, _ := url.Parse(target)
+		if mapPrefix != tenant && (u == nil || u.Host == "" || u.Host != tenant) {
+			continue
+		}
+		found = true
+		p.purgePrefix(mapPrefix)
+		if u != nil && u.Host != "" {
+			p.purgeTree(path.Join(config.Config.RemoteRawPath, u.Host), "")
+			p.purgeTree(path.Join(config.Config.MetadataPath, u.Host), "")
+		}
+	}
+	return found
+}
+
+// 遍历 base 目录，清除相对路径为 prefix 或位于 prefix 之下的文件
+func (p *purger) purgeTree(base, prefix string) {
+	start := path.Join(base, prefix)
+	root := start
+	if info, err := os.Stat(start); err != nil || !info.IsDir() {
+		root = path.Dir(start)
+	}
+	_ = filepath.Walk(root, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if !info.IsDir() && hasPathPrefix(file, start) {
+			p.purgeFile(file)
+		}
+		return nil
+	})
+}
+
+// 按路径段匹配前缀，/a 匹配 /a 和 /a/b，不匹配 /ab
+func hasPathPrefix(key, prefix string) bool {
+	prefix = strings.TrimSuffix(prefix, "/")
+	return key == prefix || strings.HasPrefix(key, prefix+"/")
+}
+
+// 清除 Path 字段（去掉查询参数后）满足 match 的元数据文件
+func (p *purger) purgeMetadata(match func(metaPath string) bool) {
+	_ = filepath.Walk(config.Config.MetadataPath, func(file string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || path.Ext(file) != ".json" {
+			return nil
+		}
+		buf, err := os.ReadFile(file)
+		if err != nil {
+			return nil
+		}
+		var metadata config.MetaFile
+		if json.Unmarshal(buf, &metadata) != nil {
+			return nil
+		}
+		metaPath, _, _ := strings.Cut(metadata.Path, "?")
+		if match(metaPath) {
+			p.purgeFile(file)
+		}
+		return nil
+	})
+}
+
+// 分片布局下同时删除旁路文件，软清除时保留旁路文件以便重新生成后沿用
+func (p *purger) purgeExhaust(file string) {
+	if p.seen[file] {
+		return
+	}
+	p.purgeFile(file)
+	if !p.soft {
+		p.result.Bytes += helper.RemoveExhaustSidecar(file)
+	}
+}
+
+func (p *purger) purgeFile(file string) {
+	if p.seen[file] {
+		return
+	}
+	p.seen[file] = true
+
+	info, err := os.Stat(file)
+	if err != nil || info.IsDir() {
+		return
+	}
+	if p.soft {
+		err = helper.MarkStale(file)
+	} else {
+		err = os.Remove(file)
+	}
+	if err != nil {
+		log.Warnf("清除缓存文件失败: %s, 错误: %v", file, err)
+		return
+	}
+	p.result.Files++
+	p.result.Bytes += info.Size()
+}
+
+// 去掉缓存键中的变体后缀，得到对应的请求路径
+func sourceKey(key string) string {
+	return path.Join(path.Dir(key), sourceName(path.Base(key)))
+}
+
+// 去掉变体后缀，得到对应的源文件名
+func sourceName(name string) string {
+	ext := path.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+	return variantSuffix.ReplaceAllString(stem, "") + ext
+}
+
+// 请求路径在远程 IMG_MAP 中对应的远程地址
+func remoteAddrs(reqPath string) []string {
+	var addrs []string
+	for mapPrefix, target := range config.Config.ImageMap {
+		if !strings.HasPrefix(reqPath, mapPrefix) {
+			continue
+		}
+		targetUrl, err := url.Parse(target)
+		if err != nil || targetUrl.Host == "" {
+			continue
+		}
+		addrs = append(addrs, helper.BuildRealRemoteAddr(targetUrl, mapPrefix, reqPath))
+	}
+	return addrs
+}
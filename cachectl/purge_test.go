@@ -0,0 +1,134 @@
+package cachectl
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"webp_server_go/config"
+)
+
+// 三个缓存目录指向临时目录，IMG_MAP 替换为 imageMap
+func withCacheDirs(t *testing.T, imageMap map[string]string) string {
+	t.Helper()
+	old := config.Config
+	cfg := *old
+	config.Config = &cfg
+	t.Cleanup(func() { config.Config = old })
+
+	root := t.TempDir()
+	config.Config.ExhaustPath = filepath.Join(root, "exhaust")
+	config.Config.RemoteRawPath = filepath.Join(root, "remote-raw")
+	config.Config.MetadataPath = filepath.Join(root, "metadata")
+	config.Config.ImageMap = imageMap
+	return root
+}
+
+func writeCacheFile(t *testing.T, file string, data []byte) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(file, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeMetadata(t *testing.T, file, metaPath, checksum string) {
+	t.Helper()
+	buf, err := json.Marshal(config.MetaFile{Id: filepath.Base(file), Path: metaPath, Checksum: checksum})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeCacheFile(t, file, buf)
+}
+
+func TestHasPathPrefix(t *testing.T) {
+	tests := []struct {
+		key    string
+		prefix string
+		want   bool
+	}{
+		{"/a", "/a", true},
+		{"/a/b.jpg", "/a", true},
+		{"/a/b.jpg", "/a/", true},
+		{"/ab/c.jpg", "/a", false},
+		{"/ab", "/a", false},
+		{"/a", "/a/b", false},
+		{"/a/b.jpg", "/", true},
+		{"https://example.com/img/a.jpg", "https://example.com/img", true},
+		{"https://example.com/images/a.jpg", "https://example.com/img", false},
+	}
+	for _, tt := range tests {
+		if got := hasPathPrefix(tt.key, tt.prefix); got != tt.want {
+			t.Errorf("hasPathPrefix(%q, %q) = %v, want %v", tt.key, tt.prefix, got, tt.want)
+		}
+	}
+}
+
+func TestSourceName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"a.jpg", "a.jpg"},
+		{"a_w200_h0_mw0_mh0.jpg", "a.jpg"},
+		{"a_w200_h100_mw0_mh0_fitcontain_q80.png", "a.png"},
+		{"a_w-1_h0_mw0_mh0.jpg", "a.jpg"},
+		{"a_w200.jpg", "a_w200.jpg"},
+	}
+	for _, tt := range tests {
+		if got := sourceName(tt.name); got != tt.want {
+			t.Errorf("sourceName(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPurgePrefix(t *testing.T) {
+	withCacheDirs(t, map[string]string{
+		"/a":  "https://a.example.com",
+		"/ab": "https://ab.example.com",
+	})
+	exhaust := func(name string) string { return filepath.Join(config.Config.ExhaustPath, name) }
+	raw := func(name string) string { return filepath.Join(config.Config.RemoteRawPath, name) }
+	metadata := func(name string) string { return filepath.Join(config.Config.MetadataPath, name) }
+
+	purged := []string{exhaust("a/x_w200_h0_mw0_mh0.jpg"), exhaust("a/sub/y.jpg"), raw("a.example.com/1"), metadata("a.example.com/1.json")}
+	kept := []string{exhaust("ab/x.jpg"), exhaust("ab.jpg"), raw("ab.example.com/2"), metadata("ab.example.com/2.json")}
+	for _, file := range append(purged, kept...) {
+		if filepath.Ext(file) == ".json" {
+			continue
+		}
+		writeCacheFile(t, file, []byte("x"))
+	}
+	writeMetadata(t, metadata("a.example.com/1.json"), "https://a.example.com/x.jpg", "x")
+	writeMetadata(t, metadata("ab.example.com/2.json"), "https://ab.example.com/x.jpg", "x")
+
+	result, err := Purge(PurgeRequest{Prefix: "/a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Files != int64(len(purged)) {
+		t.Errorf("purged %d files, want %d", result.Files, len(purged))
+	}
+	for _, file := range purged {
+		if _, err := os.Stat(file); !os.IsNotExist(err) {
+			t.Errorf("%s was not purged", file)
+		}
+	}
+	for _, file := range kept {
+		if _, err := os.Stat(file); err != nil {
+			t.Errorf("%s should be kept: %v", file, err)
+		}
+	}
+}
+
+func TestPurgeRequiresTarget(t *testing.T) {
+	withCacheDirs(t, nil)
+	if _, err := Purge(PurgeRequest{Soft: true}); err == nil {
+		t.Fatal("Purge() without path, prefix, tag or tenant should fail")
+	}
+	if _, err := Purge(PurgeRequest{Tag: "missing"}); err == nil {
+		t.Fatal("Purge() with an unknown tag should fail")
+	}
+}
@@ -0,0 +1,335 @@
+package cachectl
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+	"webp_server_go/config"
+	"webp_server_go/helper"
+
+	"github.com/klauspost/compress/zstd"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	manifestName = "manifest.json"
+
+	// 每个 tar 条目通过 PAX 记录携带校验信息，导入时无需先读取清单
+	paxChecksum       = "WEBPSERVER.checksum"
+	paxKey            = "WEBPSERVER.key"
+	paxSource         = "WEBPSERVER.source"
+	paxSourceChecksum = "WEBPSERVER.source_checksum"
+)
+
+type SnapshotEntry struct {
+	Tier           string    `json:"tier"`
+	Path           string    `json:"path"`          // 相对于层级根目录
+	Key            string    `json:"key,omitempty"` // exhaust 条目的缓存键
+	Size           int64     `json:"size"`
+	ModTime        time.Time `json:"mod_time"`
+	Checksum       string    `json:"checksum"`
+	Source         string    `json:"source,omitempty"`          // 生成该文件的源文件
+	SourceChecksum string    `json:"source_checksum,omitempty"` // 导出时源文件的哈希
+}
+
+type SnapshotManifest struct {
+	Version   string          `json:"version"`
+	CreatedAt time.Time       `json:"created_at"`
+	Entries   []SnapshotEntry `json:"entries"`
+}
+
+type ImportResult struct {
+	Imported      int `json:"imported"`
+	Unchanged     int `json:"unchanged"`
+	SourceChanged int `json:"source_changed"`
+	Corrupted     int `json:"corrupted"`
+}
+
+func tierRoot(tier string) string {
+	switch tier {
+	case helper.TierRaw:
+		return config.Config.RemoteRawPath
+	case helper.TierExhaust:
+		return config.Config.ExhaustPath
+	case helper.TierMetadata:
+		return config.Config.MetadataPath
+	}
+	return ""
+}
+
+// 将 EXHAUST_PATH、METADATA_PATH（以及可选的 REMOTE_RAW_PATH）导出为 tar.zst 快照
+// 每个文件先完整读入内存再写入，因此服务运行时也可以安全导出
+func ExportSnapshot(dest string, includeRaw bool) (SnapshotManifest, error) {
+	manifest := SnapshotManifest{Version: config.Version, CreatedAt: time.Now()}
+
+	tmp := dest + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return manifest, err
+	}
+	defer os.Remove(tmp)
+	defer out.Close()
+
+	zw, err := zstd.NewWriter(out)
+	if err != nil {
+		return manifest, err
+	}
+	tw := tar.NewWriter(zw)
+
+	// 原图在前，导入 exhaust 条目时可以用它校验远程源是否变化
+	tiers := []string{helper.TierMetadata, helper.TierExhaust}
+	if includeRaw {
+		tiers = append([]string{helper.TierRaw}, tiers...)
+	}
+
+	for _, tier := range tiers {
+		root := tierRoot(tier)
+		err := filepath.Walk(root, func(file string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() || strings.HasSuffix(file, ".tmp") {
+				return nil
+			}
+			rel, _ := filepath.Rel(root, file)
+			entry, err := writeSnapshotEntry(tw, tier, file, filepath.ToSlash(rel))
+			if err != nil {
+				if errors.Is(err, os.ErrNotExist) {
+					// 遍历期间被删除
+					return nil
+				}
+				return err
+			}
+			manifest.Entries = append(manifest.Entries, entry)
+			return nil
+		})
+		if err != nil {
+			return manifest, err
+		}
+	}
+
+	buf, _ := json.MarshalIndent(manifest, "", "  ")
+	if err := tw.WriteHeader(&tar.Header{Name: manifestName, Mode: 0644, Size: int64(len(buf)), ModTime: manifest.CreatedAt}); err != nil {
+		return manifest, err
+	}
+	if _, err := tw.Write(buf); err != nil {
+		return manifest, err
+	}
+	if err := tw.Close(); err != nil {
+		return manifest, err
+	}
+	if err := zw.Close(); err != nil {
+		return manifest, err
+	}
+	if err := out.Close(); err != nil {
+		return manifest, err
+	}
+
+	log.Infof("快照导出完成: %s, 共 %d 个文件", dest, len(manifest.Entries))
+	return manifest, os.Rename(tmp, dest)
+}
+
+func writeSnapshotEntry(tw *tar.Writer, tier, file, rel string) (SnapshotEntry, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return SnapshotEntry{}, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return SnapshotEntry{}, err
+	}
+	buf, err := io.ReadAll(f)
+	if err != nil {
+		return SnapshotEntry{}, err
+	}
+
+	entry := SnapshotEntry{
+		Tier:     tier,
+		Path:     rel,
+		Size:     int64(len(buf)),
+		ModTime:  info.ModTime(),
+		Checksum: helper.HashBytes(buf),
+	}
+	if tier == helper.TierExhaust && !helper.IsExhaustSidecar(file) {
+		entry.Key = helper.ExhaustKey(file)
+		if source := exhaustSource(entry.Key); source != "" && helper.FileExists(source) {
+			entry.Source = source
+			entry.SourceChecksum = helper.HashFile(source)
+		}
+	}
+
+	header := &tar.Header{
+		Name:    tier + "/" + rel,
+		Mode:    0644,
+		Size:    entry.Size,
+		ModTime: entry.ModTime,
+		Format:  tar.FormatPAX,
+		PAXRecords: map[string]string{
+			paxChecksum: entry.Checksum,
+		},
+	}
+	if entry.Key != "" {
+		header.PAXRecords[paxKey] = entry.Key
+	}
+	if entry.Source != "" {
+		header.PAXRecords[paxSource] = entry.Source
+		header.PAXRecords[paxSourceChecksum] = entry.SourceChecksum
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return entry, err
+	}
+	_, err = tw.Write(buf)
+	return entry, err
+}
+
+// 导入快照：校验每个文件的哈希，跳过源文件已变化的条目，原子性地写入对应层级
+func ImportSnapshot(src string) (ImportResult, error) {
+	var result ImportResult
+
+	in, err := os.Open(src)
+	if err != nil {
+		return result, err
+	}
+	defer in.Close()
+
+	zr, err := zstd.NewReader(in)
+	if err != nil {
+		return result, err
+	}
+	defer zr.Close()
+	tr := tar.NewReader(zr)
+
+	var manifest *SnapshotManifest
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return result, err
+		}
+
+		if header.Name == manifestName {
+			manifest = &SnapshotManifest{}
+			if err := json.NewDecoder(tr).Decode(manifest); err != nil {
+				return result, fmt.Errorf("快照清单损坏: %v", err)
+			}
+			continue
+		}
+
+		tier, rel, ok := strings.Cut(header.Name, "/")
+		root := tierRoot(tier)
+		if !ok || root == "" || !filepath.IsLocal(rel) {
+			log.Warnf("跳过未知的快照条目: %s", header.Name)
+			continue
+		}
+		dest := filepath.Join(root, filepath.FromSlash(rel))
+
+		buf, err := io.ReadAll(tr)
+		if err != nil {
+			return result, err
+		}
+		if helper.HashBytes(buf) != header.PAXRecords[paxChecksum] {
+			log.Warnf("快照条目校验和不匹配: %s", header.Name)
+			result.Corrupted++
+			continue
+		}
+
+		if sourceChanged(tier, header, buf) {
+			log.Infof("源文件已变化，跳过: %s", header.Name)
+			result.SourceChanged++
+			continue
+		}
+
+		if helper.FileExists(dest) && helper.HashFile(dest) == header.PAXRecords[paxChecksum] {
+			result.Unchanged++
+			continue
+		}
+
+		if err := writeSnapshotFile(dest, buf, header.ModTime); err != nil {
+			log.Warnf("导入快照条目失败: %s, 错误: %v", header.Name, err)
+			result.Corrupted++
+			continue
+		}
+		result.Imported++
+	}
+
+	if manifest == nil {
+		return result, errors.New("快照中缺少清单，文件可能被截断")
+	}
+	if total := result.Imported + result.Unchanged + result.SourceChanged + result.Corrupted; total != len(manifest.Entries) {
+		log.Warnf("快照条目数量与清单不一致: 读取 %d, 清单 %d", total, len(manifest.Entries))
+	}
+
+	log.Infof("快照导入完成: 导入=%d, 未变化=%d, 源已变化=%d, 损坏=%d",
+		result.Imported, result.Unchanged, result.SourceChanged, result.Corrupted)
+	return result, nil
+}
+
+func writeSnapshotFile(dest string, buf []byte, modTime time.Time) error {
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(dest), ".snapshot-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(buf); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	// 缓存清理按修改时间淘汰最旧的文件，恢复原始时间以保持淘汰顺序
+	_ = os.Chtimes(tmp.Name(), modTime, modTime)
+	return os.Rename(tmp.Name(), dest)
+}
+
+// 检查条目的源文件在本节点上是否与导出时不同，本节点没有源文件时视为未变化
+func sourceChanged(tier string, header *tar.Header, buf []byte) bool {
+	switch tier {
+	case helper.TierExhaust:
+		if header.PAXRecords[paxSource] == "" {
+			return false
+		}
+		source := exhaustSource(header.PAXRecords[paxKey])
+		return helper.FileExists(source) && helper.HashFile(source) != header.PAXRecords[paxSourceChecksum]
+	case helper.TierMetadata:
+		// 本地图片的元数据记录了源文件哈希，远程图片记录的是 ETag 哈希，无法在本地校验
+		var metadata config.MetaFile
+		if json.Unmarshal(buf, &metadata) != nil || strings.Contains(metadata.Path, "://") {
+			return false
+		}
+		metaPath, _, _ := strings.Cut(metadata.Path, "?")
+		source := path.Join(config.Config.ImgPath, metaPath)
+		return helper.FileExists(source) && helper.HashFile(source) != metadata.Checksum
+	}
+	return false
+}
+
+// 根据缓存键找到生成它的源文件：本地原图或远程原图的本地副本
+func exhaustSource(key string) string {
+	reqURI := sourceKey(key)
+	prefix, target := helper.FindMatchingPrefix(reqURI)
+	if prefix == "" {
+		return ""
+	}
+	if strings.HasPrefix(target, "./") || strings.HasPrefix(target, "/") {
+		return path.Join(target, reqURI)
+	}
+	targetUrl, err := url.Parse(target)
+	if err != nil {
+		return ""
+	}
+	return path.Join(config.Config.RemoteRawPath, targetUrl.Host, helper.HashString(helper.BuildRealRemoteAddr(targetUrl, prefix, reqURI)))
+}
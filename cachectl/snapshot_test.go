@@ -0,0 +1,99 @@
+package cachectl
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"webp_server_go/config"
+	"webp_server_go/helper"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	root := withCacheDirs(t, nil)
+	src := filepath.Join(root, "src")
+	config.Config.ImageMap = map[string]string{"/img": src}
+	config.Config.ImgPath = src
+
+	source := filepath.Join(src, "img", "a.jpg")
+	writeCacheFile(t, source, []byte("original"))
+	exhaustFile := filepath.Join(config.Config.ExhaustPath, "img", "a_w200_h0_mw0_mh0.jpg")
+	writeCacheFile(t, exhaustFile, []byte("optimized"))
+	modTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	if err := os.Chtimes(exhaustFile, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	metadataFile := filepath.Join(config.Config.MetadataPath, "a.json")
+	writeMetadata(t, metadataFile, "/img/a.jpg", helper.HashFile(source))
+	writeCacheFile(t, filepath.Join(config.Config.RemoteRawPath, "host", "raw"), []byte("raw"))
+
+	snapshot := filepath.Join(root, "cache.tar.zst")
+	manifest, err := ExportSnapshot(snapshot, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Entries) != 2 {
+		t.Fatalf("exported %d entries, want 2 without the raw tier", len(manifest.Entries))
+	}
+	for _, entry := range manifest.Entries {
+		if entry.Tier == helper.TierExhaust && entry.Source != source {
+			t.Fatalf("exhaust entry source = %q, want %q", entry.Source, source)
+		}
+	}
+
+	// 导入到空的缓存目录
+	for _, dir := range []string{config.Config.ExhaustPath, config.Config.MetadataPath} {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Fatal(err)
+		}
+	}
+	result, err := ImportSnapshot(snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != (ImportResult{Imported: 2}) {
+		t.Fatalf("ImportSnapshot() = %+v, want 2 imported", result)
+	}
+	info, err := os.Stat(exhaustFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.ModTime().Equal(modTime) {
+		t.Fatalf("mod time = %v, want %v", info.ModTime(), modTime)
+	}
+
+	if result, err := ImportSnapshot(snapshot); err != nil || result != (ImportResult{Unchanged: 2}) {
+		t.Fatalf("second ImportSnapshot() = %+v, %v, want 2 unchanged", result, err)
+	}
+
+	// 源文件变化后，exhaust 条目和元数据都不再导入
+	writeCacheFile(t, source, []byte("replaced"))
+	if err := os.RemoveAll(config.Config.ExhaustPath); err != nil {
+		t.Fatal(err)
+	}
+	result, err = ImportSnapshot(snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.SourceChanged != 2 || helper.FileExists(exhaustFile) {
+		t.Fatalf("ImportSnapshot() = %+v, want the changed source to be skipped", result)
+	}
+}
+
+func TestImportTruncatedSnapshot(t *testing.T) {
+	root := withCacheDirs(t, nil)
+	writeCacheFile(t, filepath.Join(config.Config.ExhaustPath, "a.jpg"), make([]byte, 4096))
+
+	snapshot := filepath.Join(root, "cache.tar.zst")
+	if _, err := ExportSnapshot(snapshot, false); err != nil {
+		t.Fatal(err)
+	}
+	buf, err := os.ReadFile(snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeCacheFile(t, snapshot, buf[:len(buf)/2])
+	if _, err := ImportSnapshot(snapshot); err == nil {
+		t.Fatal("ImportSnapshot() of a truncated snapshot should fail")
+	}
+}
@@ -0,0 +1,108 @@
+package cachectl
+
+import (
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+	"webp_server_go/config"
+	"webp_server_go/helper"
+)
+
+type TierStats struct {
+	Files      int64      `json:"files"`
+	Bytes      int64      `json:"bytes"`
+	StaleFiles int64      `json:"stale_files"`
+	Oldest     *time.Time `json:"oldest,omitempty"`
+	Newest     *time.Time `json:"newest,omitempty"`
+	helper.CacheCounters
+}
+
+type Stats struct {
+	Tiers       map[string]*TierStats            `json:"tiers"`
+	Prefixes    map[string]map[string]*TierStats `json:"prefixes"` // IMG_MAP 前缀 -> tier -> 统计
+	Conversions helper.ConversionStats           `json:"conversions"`
+	Rejections  map[string]int64                 `json:"rejections"` // 超出输入限制被拒绝的次数
+}
+
+// 扫描各缓存层级并合并运行期间的命中/未命中/过期/淘汰计数
+func CollectStats() Stats {
+	counters := helper.CacheCountersSnapshot()
+	stats := Stats{
+		Tiers: map[string]*TierStats{
+			helper.TierRaw:      scanDir(config.Config.RemoteRawPath),
+			helper.TierExhaust:  scanDir(config.Config.ExhaustPath),
+			helper.TierMetadata: scanDir(config.Config.MetadataPath),
+		},
+		Prefixes:    map[string]map[string]*TierStats{},
+		Conversions: helper.GetConversionStats(),
+		Rejections:  helper.GetInputRejections(),
+	}
+
+	for tier, byPrefix := range counters {
+		if _, ok := stats.Tiers[tier]; !ok {
+			continue
+		}
+		for _, c := range byPrefix {
+			stats.Tiers[tier].CacheCounters.Add(c)
+		}
+	}
+
+	for prefix, target := range config.Config.ImageMap {
+		prefixStats := map[string]*TierStats{
+			helper.TierExhaust: scanExhaustPrefix(prefix),
+		}
+		if u, err := url.Parse(target); err == nil && u.Host != "" {
+			prefixStats[helper.TierRaw] = scanDir(path.Join(config.Config.RemoteRawPath, u.Host))
+			prefixStats[helper.TierMetadata] = scanDir(path.Join(config.Config.MetadataPath, u.Host))
+		}
+		for tier, tierStats := range prefixStats {
+			tierStats.CacheCounters = counters[tier][prefix]
+		}
+		stats.Prefixes[prefix] = prefixStats
+	}
+
+	return stats
+}
+
+func scanDir(dir string) *TierStats {
+	stats := &TierStats{}
+	_ = filepath.Walk(dir, func(file string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		stats.add(info)
+		return nil
+	})
+	return stats
+}
+
+// 按缓存键统计前缀下的优化图像，兼容分片布局
+func scanExhaustPrefix(prefix string) *TierStats {
+	stats := &TierStats{}
+	helper.WalkExhaust(func(file string, info os.FileInfo, key string) {
+		if strings.HasPrefix(key, prefix) {
+			stats.add(info)
+		}
+	})
+	return stats
+}
+
+func (stats *TierStats) add(info os.FileInfo) {
+	stats.Files++
+	stats.Bytes += info.Size()
+
+	modTime := info.ModTime()
+	if modTime.Equal(helper.StaleModTime) {
+		stats.StaleFiles++
+		return
+	}
+	if stats.Oldest == nil || modTime.Before(*stats.Oldest) {
+		stats.Oldest = &modTime
+	}
+	if stats.Newest == nil || modTime.After(*stats.Newest) {
+		stats.Newest = &modTime
+	}
+}
@@ -3,6 +3,8 @@ package config
 import (
 	"encoding/json"
 	"flag"
+	"fmt"
+	"hash/crc32"
 	"os"
 	"regexp"
 	"runtime"
@@ -10,6 +12,8 @@ import (
 	"strconv"
 	"strings"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/patrickmn/go-cache"
 	log "github.com/sirupsen/logrus"
@@ -50,6 +54,14 @@ var (
 	ShowVersion    bool
 	ProxyMode      bool
 	Prefetch       bool
+	ExportSnapshot string
+	ImportSnapshot string
+	SnapshotRaw    bool
+	Fsck           bool
+	FsckRepair     bool
+	MigrateExhaust bool
+	SignURL        string
+	SignTTL        time.Duration
 	Config         = NewWebPConfig()
 	Version        = "0.12.0"
 	WriteLock      = cache.New(5*time.Minute, 10*time.Minute)
@@ -65,16 +77,19 @@ type MetaFile struct {
 }
 
 type WebpConfig struct {
-	Host          string            `json:"HOST"`
-	Port          string            `json:"PORT"`
-	ImgPath       string            `json:"IMG_PATH"`
-	Quality       int               `json:"QUALITY,string"`
-	AllowedTypes  []string          `json:"ALLOWED_TYPES"`
-	ConvertTypes  []string          `json:"CONVERT_TYPES"`
-	ImageMap      map[string]string `json:"IMG_MAP"`
-	ExhaustPath   string            `json:"EXHAUST_PATH"`
-	MetadataPath  string            `json:"METADATA_PATH"`
-	RemoteRawPath string            `json:"REMOTE_RAW_PATH"`
+	Host          string                   `json:"HOST"`
+	Port          string                   `json:"PORT"`
+	ImgPath       string                   `json:"IMG_PATH"`
+	Quality       int                      `json:"QUALITY,string"`
+	AllowedTypes  []string                 `json:"ALLOWED_TYPES"`
+	ConvertTypes  []string                 `json:"CONVERT_TYPES"`
+	ImageMap      map[string]string        `json:"IMG_MAP"`
+	ImageMapOpts  map[string]PrefixOptions `json:"IMG_MAP_OPTIONS"` // IMG_MAP prefix -> per-prefix limits
+	ExhaustPath   string                   `json:"EXHAUST_PATH"`
+	ExhaustLayout string                   `json:"EXHAUST_LAYOUT"` // mirror or sharded
+	MetadataPath  string                   `json:"METADATA_PATH"`
+	RemoteRawPath string                   `json:"REMOTE_RAW_PATH"`
+	TempPath      string                   `json:"TEMP_PATH"` // intermediate files such as RAW previews, each process uses its own webp-* subdirectory
 
 	EnableWebP bool `json:"ENABLE_WEBP"`
 	EnableAVIF bool `json:"ENABLE_AVIF"`
@@ -83,13 +98,51 @@ type WebpConfig struct {
 	EnableExtraParams          bool   `json:"ENABLE_EXTRA_PARAMS"`
 	ExtraParamsCropInteresting string `json:"EXTRA_PARAMS_CROP_INTERESTING"`
 
-	StripMetadata    bool `json:"STRIP_METADATA"`
-	ReadBufferSize   int  `json:"READ_BUFFER_SIZE"`
-	Concurrency      int  `json:"CONCURRENCY"`
-	DisableKeepalive bool `json:"DISABLE_KEEPALIVE"`
-	CacheTTL         int  `json:"CACHE_TTL"` // In minutes
+	Background        string `json:"BACKGROUND"`          // default colour for padding, rotation and flattening alpha into formats without it
+	AutoLosslessAlpha bool   `json:"AUTO_LOSSLESS_ALPHA"` // encode WebP losslessly when the image has transparent pixels
+
+	ColorManagement string `json:"COLOR_MANAGEMENT"` // srgb, wide (honour gamut=p3) or off
+	ICCProfile      string `json:"ICC_PROFILE"`      // embed: keep the compact sRGB profile even when stripping metadata, strip: never embed
+
+	StripMetadata    bool   `json:"STRIP_METADATA"`
+	MetadataPolicy   string `json:"METADATA_POLICY"` // one of AvailableMetadataPolicies, empty follows STRIP_METADATA
+	ReadBufferSize   int    `json:"READ_BUFFER_SIZE"`
+	Concurrency      int    `json:"CONCURRENCY"`
+	DisableKeepalive bool   `json:"DISABLE_KEEPALIVE"`
+	CacheTTL         int    `json:"CACHE_TTL"` // In minutes
 
 	MaxCacheSize int `json:"MAX_CACHE_SIZE"` // In MB, for max cached exhausted/metadata files(plus remote-raw if applicable), 0 means no limit
+
+	MaxInputPixels int              `json:"MAX_INPUT_PIXELS"` // checked from the file header before decoding, 0 means no limit
+	MaxInputFrames int              `json:"MAX_INPUT_FRAMES"`
+	MaxInputBytes  map[string]int64 `json:"MAX_INPUT_BYTES"` // format (jpg, png, gif, webp, ... or * for the rest) -> bytes
+
+	RawDecode string `json:"RAW_DECODE"` // preview: embedded JPEG first, full: demosaic with libvips first
+
+	MaxAnimationFrames int     `json:"MAX_ANIMATION_FRAMES"` // only the first frames of longer animations are processed, 0 means no limit
+	AnimatedFallback   string  `json:"ANIMATED_FALLBACK"`    // gif or apng for WebP originals requested by clients without WebP support, empty disables
+	GifDither          float64 `json:"GIF_DITHER"`           // error diffusion amount in (0, 1], 0 uses the libvips default
+	GifEffort          int     `json:"GIF_EFFORT"`           // palette quantisation effort 1-10
+	GifBitdepth        int     `json:"GIF_BITDEPTH"`         // palette size as bits per pixel 1-8
+
+	EnableClientHints bool    `json:"ENABLE_CLIENT_HINTS"` // honour Sec-CH-DPR/Sec-CH-Width/Sec-CH-Viewport-Width/Save-Data
+	WidthBuckets      []int   `json:"WIDTH_BUCKETS"`       // computed widths snap up to these values
+	MaxDPR            float64 `json:"MAX_DPR"`
+	SaveDataQuality   int     `json:"SAVE_DATA_QUALITY"` // quality used when client sends Save-Data: on
+
+	ParamsPathMarker string `json:"PARAMS_PATH_MARKER"` // /<marker>/w_400,h_300/path.jpg, empty disables path params
+
+	TextFont      string `json:"TEXT_FONT"`       // Pango font family for text overlays, e.g. "sans bold"
+	TextFontFile  string `json:"TEXT_FONT_FILE"`  // optional .ttf/.otf loaded for text overlays
+	TextMaxLength int    `json:"TEXT_MAX_LENGTH"` // maximum characters of overlay text
+
+	Presets     map[string]Preset `json:"PRESETS"`      // name -> transformation, used by ?preset= and /_p/<name>/
+	PresetsOnly bool              `json:"PRESETS_ONLY"` // reject raw extra params, only presets are allowed
+
+	SignatureKeys []string `json:"SIGNATURE_KEYS"` // HMAC secrets, the first one signs, all of them verify; empty means signing disabled
+
+	AdminToken string              `json:"ADMIN_TOKEN"` // Bearer token for /admin API, empty means admin API disabled
+	CacheTags  map[string][]string `json:"CACHE_TAGS"`  // tag -> request path prefixes, used by cache purge
 }
 
 func NewWebPConfig() *WebpConfig {
@@ -98,12 +151,15 @@ func NewWebPConfig() *WebpConfig {
 		Port:          "3333",
 		ImgPath:       "./pics",
 		Quality:       80,
-		AllowedTypes:  []string{"jpg", "png", "jpeg", "bmp", "gif", "svg", "nef", "heic", "webp"},
+		AllowedTypes:  []string{"jpg", "png", "jpeg", "bmp", "gif", "svg", "nef", "cr2", "cr3", "arw", "dng", "raf", "orf", "heic", "webp"},
 		ConvertTypes:  []string{"webp"},
 		ImageMap:      map[string]string{},
+		ImageMapOpts:  map[string]PrefixOptions{},
 		ExhaustPath:   "./exhaust",
+		ExhaustLayout: "mirror",
 		MetadataPath:  "./metadata",
 		RemoteRawPath: "./remote-raw",
+		TempPath:      "./tmp",
 
 		EnableWebP: false,
 		EnableAVIF: false,
@@ -111,13 +167,49 @@ func NewWebPConfig() *WebpConfig {
 
 		EnableExtraParams:          false,
 		ExtraParamsCropInteresting: "InterestingAttention",
+		Background:                 "ffffff",
+		AutoLosslessAlpha:          false,
+		ColorManagement:            ColorManagementSRGB,
+		ICCProfile:                 ICCProfileEmbed,
 		StripMetadata:              true,
+		MetadataPolicy:             "",
 		ReadBufferSize:             4096,
 		Concurrency:                262144,
 		DisableKeepalive:           false,
 		CacheTTL:                   259200,
 
 		MaxCacheSize: 0,
+
+		MaxInputPixels: 100000000,
+		MaxInputFrames: 1000,
+		MaxInputBytes:  map[string]int64{},
+
+		RawDecode: RawDecodePreview,
+
+		MaxAnimationFrames: 300,
+		AnimatedFallback:   FormatGif,
+		GifDither:          1,
+		GifEffort:          7,
+		GifBitdepth:        8,
+
+		EnableClientHints: false,
+		WidthBuckets:      []int{320, 480, 640, 768, 1024, 1280, 1536, 1920, 2560, 3840},
+		MaxDPR:            3,
+		SaveDataQuality:   50,
+
+		ParamsPathMarker: "_",
+
+		TextFont:      "sans",
+		TextFontFile:  "",
+		TextMaxLength: 100,
+
+		Presets:     map[string]Preset{},
+		PresetsOnly: false,
+
+		SignatureKeys: []string{},
+
+		AdminToken: "",
+		CacheTags:  map[string][]string{},
 	}
 }
 
@@ -127,6 +219,14 @@ func init() {
 	flag.IntVar(&Jobs, "jobs", runtime.NumCPU(), "Prefetch thread, default is all.")
 	flag.BoolVar(&DumpConfig, "dump-config", false, "Print sample config.json.")
 	flag.BoolVar(&ShowVersion, "V", false, "Show version information.")
+	flag.StringVar(&ExportSnapshot, "export-snapshot", "", "Export EXHAUST_PATH and METADATA_PATH to /path/to/snapshot.tar.zst and exit.")
+	flag.StringVar(&ImportSnapshot, "import-snapshot", "", "Import /path/to/snapshot.tar.zst into cache directories and exit.")
+	flag.BoolVar(&SnapshotRaw, "snapshot-raw", false, "Include REMOTE_RAW_PATH when exporting snapshot.")
+	flag.BoolVar(&Fsck, "fsck", false, "Check cache directories and print a JSON report (dry-run) and exit.")
+	flag.BoolVar(&FsckRepair, "fsck-repair", false, "Check cache directories, remove broken files and exit.")
+	flag.StringVar(&SignURL, "sign-url", "", "Print /path?params signed with the first SIGNATURE_KEYS entry and exit.")
+	flag.DurationVar(&SignTTL, "sign-ttl", 0, "Expiry of the URL signed by -sign-url, e.g. 24h. (Default: never)")
+	flag.BoolVar(&MigrateExhaust, "migrate-exhaust", false, "Move mirrored EXHAUST_PATH files into the sharded layout and exit.")
 }
 
 func LoadConfig() {
@@ -139,6 +239,36 @@ func LoadConfig() {
 	_ = jsonObject.Close()
 
 	Config.ImageMap = parseImgMap(Config.ImageMap)
+	for prefix, opts := range Config.ImageMapOpts {
+		opts.AllowedFormats = slices.DeleteFunc(opts.AllowedFormats, func(format string) bool {
+			if !slices.Contains(AvailableFormats, format) {
+				log.Warnf("IMG_MAP_OPTIONS 中前缀 '%s' 的格式 '%s' 无效 -已跳过", prefix, format)
+				return true
+			}
+			return false
+		})
+		if opts.OnLimitExceeded != "" && !slices.Contains(AvailableLimitActions, opts.OnLimitExceeded) {
+			log.Warnf("IMG_MAP_OPTIONS 中前缀 '%s' 的 ON_LIMIT_EXCEEDED '%s' 无效，使用 clamp", prefix, opts.OnLimitExceeded)
+			opts.OnLimitExceeded = LimitClamp
+		}
+		if opts.Watermark != nil {
+			if _, err := os.Stat(opts.Watermark.Image); err != nil {
+				// 不能跳过水印，否则会返回未加水印的图像，处理时会失败并返回 500
+				log.Errorf("IMG_MAP_OPTIONS 中前缀 '%s' 的水印图像 '%s' 不存在", prefix, opts.Watermark.Image)
+			}
+			if opts.Watermark.Gravity != "" && !slices.Contains(AvailableGravities, opts.Watermark.Gravity) {
+				log.Warnf("IMG_MAP_OPTIONS 中前缀 '%s' 的水印位置 '%s' 无效，使用 south-east", prefix, opts.Watermark.Gravity)
+				opts.Watermark.Gravity = "south-east"
+			}
+		}
+		if opts.Metadata != "" && !slices.Contains(AvailableMetadataPolicies, opts.Metadata) {
+			log.Warnf("IMG_MAP_OPTIONS 中前缀 '%s' 的 METADATA '%s' 无效 -已跳过", prefix, opts.Metadata)
+			opts.Metadata = ""
+		}
+		slices.Sort(opts.AllowedWidths)
+		slices.Sort(opts.AllowedHeights)
+		Config.ImageMapOpts[prefix] = opts
+	}
 
 	if slices.Contains(Config.ConvertTypes, "webp") {
 		Config.EnableWebP = true
@@ -163,6 +293,16 @@ func LoadConfig() {
 	if os.Getenv("WEBP_EXHAUST_PATH") != "" {
 		Config.ExhaustPath = os.Getenv("WEBP_EXHAUST_PATH")
 	}
+	if os.Getenv("WEBP_TEMP_PATH") != "" {
+		Config.TempPath = os.Getenv("WEBP_TEMP_PATH")
+	}
+	if os.Getenv("WEBP_EXHAUST_LAYOUT") != "" {
+		Config.ExhaustLayout = os.Getenv("WEBP_EXHAUST_LAYOUT")
+	}
+	if Config.ExhaustLayout != "mirror" && Config.ExhaustLayout != "sharded" {
+		log.Warnf("EXHAUST_LAYOUT '%s' 无效，使用 mirror", Config.ExhaustLayout)
+		Config.ExhaustLayout = "mirror"
+	}
 	if os.Getenv("WEBP_QUALITY") != "" {
 		quality, err := strconv.Atoi(os.Getenv("WEBP_QUALITY"))
 		if err != nil {
@@ -203,14 +343,46 @@ func LoadConfig() {
 		}
 	}
 	if os.Getenv("WEBP_EXTRA_PARAMS_CROP_INTERESTING") != "" {
-		availableInteresting := []string{"InterestingNone", "InterestingEntropy", "InterestingCentre", "InterestingAttention", "InterestringLow", "InterestingHigh", "InterestingAll"}
-		if slices.Contains(availableInteresting, os.Getenv("WEBP_EXTRA_PARAMS_CROP_INTERESTING")) {
+		if slices.Contains(AvailableInteresting, os.Getenv("WEBP_EXTRA_PARAMS_CROP_INTERESTING")) {
 			Config.ExtraParamsCropInteresting = os.Getenv("WEBP_EXTRA_PARAMS_CROP_INTERESTING")
 		} else {
 			log.Warnf("WEBP_EXTRA_PARAMS_CROP_INTERESTING 不是有效的兴趣，使用 config.json 中的值 %s", Config.ExtraParamsCropInteresting)
 		}
 	}
 
+	if os.Getenv("WEBP_BACKGROUND") != "" {
+		Config.Background = os.Getenv("WEBP_BACKGROUND")
+	}
+	if !hexColorRegexp.MatchString(Config.Background) {
+		log.Warnf("BACKGROUND '%s' 不是有效的颜色，使用 ffffff", Config.Background)
+		Config.Background = "ffffff"
+	}
+	if os.Getenv("WEBP_AUTO_LOSSLESS_ALPHA") != "" {
+		autoLosslessAlpha := os.Getenv("WEBP_AUTO_LOSSLESS_ALPHA")
+		if autoLosslessAlpha == "true" {
+			Config.AutoLosslessAlpha = true
+		} else if autoLosslessAlpha == "false" {
+			Config.AutoLosslessAlpha = false
+		} else {
+			log.Warnf("WEBP_AUTO_LOSSLESS_ALPHA 不是有效的布尔值，使用 config.json 中的值 %t", Config.AutoLosslessAlpha)
+		}
+	}
+
+	if os.Getenv("WEBP_COLOR_MANAGEMENT") != "" {
+		Config.ColorManagement = os.Getenv("WEBP_COLOR_MANAGEMENT")
+	}
+	if !slices.Contains(AvailableColorManagements, Config.ColorManagement) {
+		log.Warnf("COLOR_MANAGEMENT '%s' 无效，使用 %s", Config.ColorManagement, ColorManagementSRGB)
+		Config.ColorManagement = ColorManagementSRGB
+	}
+	if os.Getenv("WEBP_ICC_PROFILE") != "" {
+		Config.ICCProfile = os.Getenv("WEBP_ICC_PROFILE")
+	}
+	if !slices.Contains(AvailableICCProfilePolicies, Config.ICCProfile) {
+		log.Warnf("ICC_PROFILE '%s' 无效，使用 %s", Config.ICCProfile, ICCProfileEmbed)
+		Config.ICCProfile = ICCProfileEmbed
+	}
+
 	if os.Getenv("WEBP_STRIP_METADATA") != "" {
 		stripMetadata := os.Getenv("WEBP_STRIP_METADATA")
 		if stripMetadata == "true" {
@@ -221,6 +393,19 @@ func LoadConfig() {
 			log.Warnf("WEBP_STRIP_METADATA 不是有效的布尔值，使用 config.json 中的值 %t", Config.StripMetadata)
 		}
 	}
+	if os.Getenv("WEBP_METADATA_POLICY") != "" {
+		Config.MetadataPolicy = os.Getenv("WEBP_METADATA_POLICY")
+	}
+	if Config.MetadataPolicy != "" && !slices.Contains(AvailableMetadataPolicies, Config.MetadataPolicy) {
+		log.Warnf("METADATA_POLICY '%s' 无效，使用 STRIP_METADATA", Config.MetadataPolicy)
+		Config.MetadataPolicy = ""
+	}
+	if Config.MetadataPolicy == "" {
+		Config.MetadataPolicy = MetadataKeep
+		if Config.StripMetadata {
+			Config.MetadataPolicy = MetadataStrip
+		}
+	}
 	if os.Getenv("WEBP_IMG_MAP") != "" {
 		// TODO
 	}
@@ -274,6 +459,103 @@ func LoadConfig() {
 		}
 	}
 
+	if os.Getenv("WEBP_RAW_DECODE") != "" {
+		Config.RawDecode = os.Getenv("WEBP_RAW_DECODE")
+	}
+	if Config.RawDecode != RawDecodePreview && Config.RawDecode != RawDecodeFull {
+		log.Warnf("RAW_DECODE '%s' 无效，使用 %s", Config.RawDecode, RawDecodePreview)
+		Config.RawDecode = RawDecodePreview
+	}
+
+	if os.Getenv("WEBP_MAX_ANIMATION_FRAMES") != "" {
+		maxAnimationFrames, err := strconv.Atoi(os.Getenv("WEBP_MAX_ANIMATION_FRAMES"))
+		if err != nil {
+			log.Warnf("WEBP_MAX_ANIMATION_FRAMES is not a valid integer, using value in config.json %d", Config.MaxAnimationFrames)
+		} else {
+			Config.MaxAnimationFrames = maxAnimationFrames
+		}
+	}
+	if os.Getenv("WEBP_ANIMATED_FALLBACK") != "" {
+		Config.AnimatedFallback = os.Getenv("WEBP_ANIMATED_FALLBACK")
+	}
+	if Config.AnimatedFallback != "" && Config.AnimatedFallback != FormatGif && Config.AnimatedFallback != FormatApng {
+		log.Warnf("ANIMATED_FALLBACK '%s' 无效，使用 %s", Config.AnimatedFallback, FormatGif)
+		Config.AnimatedFallback = FormatGif
+	}
+	if os.Getenv("WEBP_GIF_DITHER") != "" {
+		gifDither, err := strconv.ParseFloat(os.Getenv("WEBP_GIF_DITHER"), 64)
+		if err != nil {
+			log.Warnf("WEBP_GIF_DITHER 不是有效的数字，使用 config.json 中的值 %g", Config.GifDither)
+		} else {
+			Config.GifDither = gifDither
+		}
+	}
+	if Config.GifDither < 0 || Config.GifDither > 1 {
+		log.Warnf("GIF_DITHER %g 应在 0-1 之间，使用 1", Config.GifDither)
+		Config.GifDither = 1
+	}
+	if os.Getenv("WEBP_GIF_EFFORT") != "" {
+		gifEffort, err := strconv.Atoi(os.Getenv("WEBP_GIF_EFFORT"))
+		if err != nil {
+			log.Warnf("WEBP_GIF_EFFORT 不是有效的整数，使用 config.json 中的值 %d", Config.GifEffort)
+		} else {
+			Config.GifEffort = gifEffort
+		}
+	}
+	if Config.GifEffort < 1 || Config.GifEffort > 10 {
+		log.Warnf("GIF_EFFORT %d 应在 1-10 之间，使用 7", Config.GifEffort)
+		Config.GifEffort = 7
+	}
+	if os.Getenv("WEBP_GIF_BITDEPTH") != "" {
+		gifBitdepth, err := strconv.Atoi(os.Getenv("WEBP_GIF_BITDEPTH"))
+		if err != nil {
+			log.Warnf("WEBP_GIF_BITDEPTH 不是有效的整数，使用 config.json 中的值 %d", Config.GifBitdepth)
+		} else {
+			Config.GifBitdepth = gifBitdepth
+		}
+	}
+	if Config.GifBitdepth < 1 || Config.GifBitdepth > 8 {
+		log.Warnf("GIF_BITDEPTH %d 应在 1-8 之间，使用 8", Config.GifBitdepth)
+		Config.GifBitdepth = 8
+	}
+
+	if os.Getenv("WEBP_ENABLE_CLIENT_HINTS") != "" {
+		enableClientHints := os.Getenv("WEBP_ENABLE_CLIENT_HINTS")
+		if enableClientHints == "true" {
+			Config.EnableClientHints = true
+		} else if enableClientHints == "false" {
+			Config.EnableClientHints = false
+		} else {
+			log.Warnf("WEBP_ENABLE_CLIENT_HINTS is not a valid boolean, using value in config.json %t", Config.EnableClientHints)
+		}
+	}
+	slices.Sort(Config.WidthBuckets)
+
+	for name, preset := range Config.Presets {
+		if err := preset.validate(); err != nil {
+			log.Warnf("PRESETS 中的预设 '%s' 无效: %v -已跳过", name, err)
+			delete(Config.Presets, name)
+		}
+	}
+	if os.Getenv("WEBP_PRESETS_ONLY") != "" {
+		presetsOnly := os.Getenv("WEBP_PRESETS_ONLY")
+		if presetsOnly == "true" {
+			Config.PresetsOnly = true
+		} else if presetsOnly == "false" {
+			Config.PresetsOnly = false
+		} else {
+			log.Warnf("WEBP_PRESETS_ONLY is not a valid boolean, using value in config.json %t", Config.PresetsOnly)
+		}
+	}
+
+	if os.Getenv("WEBP_SIGNATURE_KEYS") != "" {
+		Config.SignatureKeys = strings.Split(os.Getenv("WEBP_SIGNATURE_KEYS"), ",")
+	}
+
+	if os.Getenv("WEBP_ADMIN_TOKEN") != "" {
+		Config.AdminToken = os.Getenv("WEBP_ADMIN_TOKEN")
+	}
+
 	log.Debugln("Config init complete")
 	log.Debugln("Config", Config)
 }
@@ -293,9 +575,431 @@ func parseImgMap(imgMap map[string]string) map[string]string {
 	return parsedImgMap
 }
 
+// 同时指定 Width 和 Height 时的缩放方式
+const (
+	FitCover   = "cover"   // 填满目标尺寸，裁剪多余部分（默认）
+	FitContain = "contain" // 完整放入目标尺寸，用 Background 填充空白
+	FitFill    = "fill"    // 拉伸到目标尺寸，不保持比例
+	FitInside  = "inside"  // 完整放入目标尺寸，不填充
+	FitOutside = "outside" // 覆盖目标尺寸，不裁剪
+)
+
+var AvailableFits = []string{FitCover, FitContain, FitFill, FitInside, FitOutside}
+
+// EXTRA_PARAMS_CROP_INTERESTING 以及请求参数 interesting 可用的裁剪策略
+var AvailableInteresting = []string{"InterestingNone", "InterestingEntropy", "InterestingCentre", "InterestingAttention", "InterestingLow", "InterestingHigh", "InterestingAll"}
+
+// 请求参数 format 可用的输出格式，original 表示保持原图格式
+// libvips 不能编码 AVIF 动图，动图请求 avif 时返回 WebP 动图，Content-Type 为 image/webp
+const (
+	FormatWebp     = "webp"
+	FormatAvif     = "avif"
+	FormatJxl      = "jxl"
+	FormatJpeg     = "jpeg"
+	FormatPng      = "png"
+	FormatGif      = "gif"
+	FormatApng     = "apng"
+	FormatOriginal = "original"
+)
+
+var AvailableFormats = []string{FormatWebp, FormatAvif, FormatJxl, FormatJpeg, FormatPng, FormatGif, FormatApng, FormatOriginal}
+
+// RAW 图像的解码方式，两种方式都不可用时使用另一种
+const (
+	RawDecodePreview = "preview" // 提取相机内嵌的 JPEG 预览，速度快
+	RawDecodeFull    = "full"    // 由 libvips（libraw）完整解马赛克，需要 libvips 支持
+)
+
+// 元数据保留策略，优先级为预设 > 前缀 > 全局 METADATA_POLICY（未设置时由 STRIP_METADATA 决定）
+const (
+	MetadataStrip     = "strip"     // 删除全部元数据，只保留方向
+	MetadataKeep      = "keep"      // 保留全部元数据
+	MetadataCopyright = "copyright" // 只保留版权、作者和方向
+	MetadataNoGPS     = "nogps"     // 只删除 GPS 位置信息（以及可能包含位置的 XMP）
+)
+
+var AvailableMetadataPolicies = []string{MetadataStrip, MetadataKeep, MetadataCopyright, MetadataNoGPS}
+
+// 色彩管理方式
+const (
+	ColorManagementSRGB = "srgb" // 按嵌入的 ICC 配置文件（或 CMYK）转换到 sRGB
+	ColorManagementWide = "wide" // 同 srgb，但请求 gamut=p3 时保留 RGB 图像的广色域配置文件
+	ColorManagementOff  = "off"  // 不做色彩转换
+)
+
+var AvailableColorManagements = []string{ColorManagementSRGB, ColorManagementWide, ColorManagementOff}
+
+// 输出中是否嵌入 ICC 配置文件，与元数据策略相互独立
+const (
+	ICCProfileEmbed = "embed"
+	ICCProfileStrip = "strip"
+)
+
+var AvailableICCProfilePolicies = []string{ICCProfileEmbed, ICCProfileStrip}
+
+// 请求参数 gamut 可用的色域
+const (
+	GamutSRGB = "srgb"
+	GamutP3   = "p3"
+)
+
+// PRESETS 中的命名变换，字段含义与 ExtraParams 相同
+type Preset struct {
+	Width              int    `json:"WIDTH"`
+	Height             int    `json:"HEIGHT"`
+	MaxWidth           int    `json:"MAX_WIDTH"`
+	MaxHeight          int    `json:"MAX_HEIGHT"`
+	Fit                string `json:"FIT"`
+	Background         string `json:"BACKGROUND"`
+	WithoutEnlargement bool   `json:"WITHOUT_ENLARGEMENT"`
+	Interesting        string `json:"INTERESTING"`
+	Quality            int    `json:"QUALITY"`
+	Format             string `json:"FORMAT"`
+	Filters
+	Metadata string       `json:"METADATA"`
+	Text     *TextOverlay `json:"TEXT"`
+}
+
+var hexColorRegexp = regexp.MustCompile(`^#?([0-9a-fA-F]{3,4}|[0-9a-fA-F]{6}|[0-9a-fA-F]{8})$`)
+
+func (p Preset) validate() error {
+	switch {
+	case p.Width < 0 || p.Height < 0 || p.MaxWidth < 0 || p.MaxHeight < 0:
+		return fmt.Errorf("尺寸不能为负数")
+	case p.Fit != "" && !slices.Contains(AvailableFits, p.Fit):
+		return fmt.Errorf("不支持的 FIT: %s", p.Fit)
+	case p.Background != "" && !hexColorRegexp.MatchString(p.Background):
+		return fmt.Errorf("不支持的 BACKGROUND: %s", p.Background)
+	case p.Interesting != "" && !slices.Contains(AvailableInteresting, p.Interesting):
+		return fmt.Errorf("不支持的 INTERESTING: %s", p.Interesting)
+	case p.Quality < 0 || p.Quality > 100:
+		return fmt.Errorf("QUALITY 应为 1-100: %d", p.Quality)
+	case p.Format != "" && !slices.Contains(AvailableFormats, p.Format):
+		return fmt.Errorf("不支持的 FORMAT: %s", p.Format)
+	case p.Metadata != "" && !slices.Contains(AvailableMetadataPolicies, p.Metadata):
+		return fmt.Errorf("不支持的 METADATA: %s", p.Metadata)
+	case p.Tint != "" && !hexColorRegexp.MatchString(p.Tint):
+		return fmt.Errorf("不支持的 TINT: %s", p.Tint)
+	}
+	if p.Text != nil {
+		if err := p.Text.Validate(); err != nil {
+			return err
+		}
+	}
+	return p.Filters.Validate()
+}
+
+// 文字叠加，颜色为不带 '#' 的十六进制
+type TextOverlay struct {
+	Text        string `json:"TEXT"`
+	Size        int    `json:"SIZE"`  // font size in px, 6-200, 0 means 24
+	Color       string `json:"COLOR"` // empty means ffffff
+	StrokeWidth int    `json:"STROKE_WIDTH"`
+	StrokeColor string `json:"STROKE_COLOR"` // empty means 000000
+	Gravity     string `json:"GRAVITY"`      // one of AvailableGravities, empty means south-east
+	Padding     int    `json:"PADDING"`      // distance from the edge in px
+}
+
+func (t *TextOverlay) Validate() error {
+	length := utf8.RuneCountInString(t.Text)
+	switch {
+	case length == 0:
+		return fmt.Errorf("text 不能为空")
+	case length > Config.TextMaxLength:
+		return fmt.Errorf("text 不能超过 %d 个字符", Config.TextMaxLength)
+	case strings.IndexFunc(t.Text, unicode.IsControl) >= 0:
+		return fmt.Errorf("text 不能包含控制字符")
+	case t.Size != 0 && (t.Size < 6 || t.Size > 200):
+		return fmt.Errorf("text_size 应为 6-200: %d", t.Size)
+	case t.StrokeWidth < 0 || t.StrokeWidth > 20:
+		return fmt.Errorf("text_stroke 应为 0-20: %d", t.StrokeWidth)
+	case t.Padding < 0 || t.Padding > 1000:
+		return fmt.Errorf("text_padding 应为 0-1000: %d", t.Padding)
+	case t.Color != "" && !hexColorRegexp.MatchString(t.Color):
+		return fmt.Errorf("不支持的 text_color: %s", t.Color)
+	case t.StrokeColor != "" && !hexColorRegexp.MatchString(t.StrokeColor):
+		return fmt.Errorf("不支持的 text_stroke_color: %s", t.StrokeColor)
+	case t.Gravity != "" && !slices.Contains(AvailableGravities, t.Gravity):
+		return fmt.Errorf("不支持的 text_gravity: %s", t.Gravity)
+	}
+	return nil
+}
+
+// 缩放之后、编码之前依次应用的滤镜，零值表示不启用
+type Filters struct {
+	Blur       float64 `json:"BLUR"`       // gaussian blur sigma, 0.3-100
+	Sharpen    float64 `json:"SHARPEN"`    // unsharp-mask sigma, 0.3-10
+	Brightness float64 `json:"BRIGHTNESS"` // -100 to 100, percent change
+	Saturation float64 `json:"SATURATION"` // -100 to 100, percent change
+	Contrast   float64 `json:"CONTRAST"`   // -100 to 100, percent change
+	Gamma      float64 `json:"GAMMA"`      // 0.1-10
+	Grayscale  bool    `json:"GRAYSCALE"`
+	Tint       string  `json:"TINT"` // hex colour without '#', applied to the grayscale luminance
+	Negate     bool    `json:"NEGATE"`
+}
+
+func (f Filters) Validate() error {
+	switch {
+	case f.Blur != 0 && (f.Blur < 0.3 || f.Blur > 100):
+		return fmt.Errorf("blur 应为 0.3-100: %g", f.Blur)
+	case f.Sharpen != 0 && (f.Sharpen < 0.3 || f.Sharpen > 10):
+		return fmt.Errorf("sharpen 应为 0.3-10: %g", f.Sharpen)
+	case f.Brightness < -100 || f.Brightness > 100:
+		return fmt.Errorf("brightness 应为 -100-100: %g", f.Brightness)
+	case f.Saturation < -100 || f.Saturation > 100:
+		return fmt.Errorf("saturation 应为 -100-100: %g", f.Saturation)
+	case f.Contrast < -100 || f.Contrast > 100:
+		return fmt.Errorf("contrast 应为 -100-100: %g", f.Contrast)
+	case f.Gamma != 0 && (f.Gamma < 0.1 || f.Gamma > 10):
+		return fmt.Errorf("gamma 应为 0.1-10: %g", f.Gamma)
+	}
+	return nil
+}
+
+// 缓存键中的滤镜部分
+func (f Filters) variant() []string {
+	var extras []string
+	if f.Sharpen > 0 {
+		extras = append(extras, fmt.Sprintf("sh%g", f.Sharpen))
+	}
+	if f.Blur > 0 {
+		extras = append(extras, fmt.Sprintf("bl%g", f.Blur))
+	}
+	if f.Brightness != 0 {
+		extras = append(extras, fmt.Sprintf("br%g", f.Brightness))
+	}
+	if f.Saturation != 0 {
+		extras = append(extras, fmt.Sprintf("sat%g", f.Saturation))
+	}
+	if f.Contrast != 0 {
+		extras = append(extras, fmt.Sprintf("ct%g", f.Contrast))
+	}
+	if f.Gamma != 0 {
+		extras = append(extras, fmt.Sprintf("gm%g", f.Gamma))
+	}
+	if f.Grayscale {
+		extras = append(extras, "gray")
+	}
+	if f.Tint != "" {
+		extras = append(extras, "tint"+f.Tint)
+	}
+	if f.Negate {
+		extras = append(extras, "neg")
+	}
+	return extras
+}
+
+// IMG_MAP_OPTIONS 中某个前缀的限制，零值表示不限制
+type PrefixOptions struct {
+	MinQuality     int      `json:"MIN_QUALITY"`
+	MaxQuality     int      `json:"MAX_QUALITY"`
+	AllowedFormats []string `json:"ALLOWED_FORMATS"` // the first one is used when a disallowed format is requested
+
+	Watermark *Watermark `json:"WATERMARK"` // overlaid on every image served under this prefix
+
+	// The output limits apply to the requested sizes before processing. Rotation, fit=outside and trim
+	// change the output size afterwards and are not checked against them.
+	MaxOutputWidth  int    `json:"MAX_OUTPUT_WIDTH"`
+	MaxOutputHeight int    `json:"MAX_OUTPUT_HEIGHT"`
+	MaxOutputPixels int    `json:"MAX_OUTPUT_PIXELS"`
+	AllowedWidths   []int  `json:"ALLOWED_WIDTHS"`    // requested widths snap up to these values
+	AllowedHeights  []int  `json:"ALLOWED_HEIGHTS"`   // requested heights snap up to these values
+	OnLimitExceeded string `json:"ON_LIMIT_EXCEEDED"` // one of AvailableLimitActions, empty means clamp
+
+	Metadata string `json:"METADATA"` // one of AvailableMetadataPolicies, overrides METADATA_POLICY, presets take precedence
+}
+
+// 水印位置
+var AvailableGravities = []string{"centre", "north", "south", "east", "west", "north-east", "north-west", "south-east", "south-west"}
+
+// IMG_MAP_OPTIONS 中的水印配置
+type Watermark struct {
+	Image     string  `json:"IMAGE"`      // path to the logo, PNG with alpha recommended
+	Gravity   string  `json:"GRAVITY"`    // one of AvailableGravities, empty means south-east
+	OffsetX   int     `json:"OFFSET_X"`   // distance from the edge, or horizontal gap between tiles
+	OffsetY   int     `json:"OFFSET_Y"`   // distance from the edge, or vertical gap between tiles
+	Opacity   float64 `json:"OPACITY"`    // 0-1, 0 means fully opaque
+	Scale     float64 `json:"SCALE"`      // logo width relative to the output width, 0 keeps the logo size
+	Tile      bool    `json:"TILE"`       // repeat the logo across the whole image
+	MinWidth  int     `json:"MIN_WIDTH"`  // outputs narrower than this are not watermarked
+	MinHeight int     `json:"MIN_HEIGHT"` // outputs shorter than this are not watermarked
+}
+
+// 水印配置的短哈希，写入缓存键，配置变化后不会命中旧的缓存
+func (w *Watermark) ID() string {
+	return fmt.Sprintf("%08x", crc32.ChecksumIEEE([]byte(fmt.Sprintf("%+v", *w))))
+}
+
+// 请求尺寸超出 IMG_MAP_OPTIONS 限制时的处理方式
+const (
+	LimitClamp  = "clamp"  // 缩小到限制以内
+	LimitReject = "reject" // 返回 400
+)
+
+var AvailableLimitActions = []string{LimitClamp, LimitReject}
+
+// IMG_MAP_OPTIONS 中作用于未单独配置的前缀的默认项
+const DefaultPrefixOptions = "*"
+
+// 返回 IMG_MAP 前缀对应的限制，未配置时使用 "*"，都没有时返回零值
+func (c *WebpConfig) PrefixOptions(prefix string) PrefixOptions {
+	if opts, ok := c.ImageMapOpts[prefix]; ok {
+		return opts
+	}
+	return c.ImageMapOpts[DefaultPrefixOptions]
+}
+
+// 缩放前裁剪的矩形区域，Percent 为 true 时各值为相对原图的百分比
+type CropRect struct {
+	X, Y, Width, Height float64
+	Percent             bool
+}
+
+// 去除均匀边框的参数
+type TrimParams struct {
+	Threshold  float64 // 0-255 difference from the background
+	Background string  // hex without '#', empty means the top-left pixel
+	Animated   bool    // also trim animated images, all frames use the box found in the first one
+}
+
+// cover 裁剪时的焦点，取值 0-1，相对于（裁剪后的）原图
+type FocalPoint struct {
+	X, Y float64
+}
+
 type ExtraParams struct {
 	Width     int // in px
 	Height    int // in px
 	MaxWidth  int // in px
 	MaxHeight int // in px
+
+	Fit                string // one of AvailableFits, empty means cover
+	Background         string // padding colour in hex without '#', e.g. ffffff or ffffff00
+	WithoutEnlargement bool   // don't upscale images smaller than requested size
+
+	Rotate       float64 // degrees clockwise in [0, 360), applied after auto-rotation; non-right angles fill with Background
+	Flip         bool    // mirror vertically
+	Flop         bool    // mirror horizontally
+	NoAutoRotate bool    // ignore EXIF orientation
+
+	Frame       *int        // extract this frame (0-based) of an animation as a static image
+	Trim        *TrimParams // remove uniform borders before cropping and resizing
+	Crop        *CropRect   // explicit crop applied before resizing
+	Focal       *FocalPoint // focal point for cover crops, overrides Interesting
+	Interesting string      // per-request override of EXTRA_PARAMS_CROP_INTERESTING
+
+	Quality  int    // overrides QUALITY when > 0
+	Format   string // one of AvailableFormats, empty means webp
+	Fallback string // FormatGif or FormatApng when a WebP original is requested by a client without WebP support
+
+	Filters         // applied after resizing
+	Metadata string // one of AvailableMetadataPolicies from the preset or prefix, empty means METADATA_POLICY
+	Gamut    string // GamutP3 keeps wide-gamut profiles when COLOR_MANAGEMENT is wide, empty means sRGB
+
+	Preset string // name of the preset this request was expanded from, not part of the cache key
+
+	Watermark *Watermark   // from IMG_MAP_OPTIONS of the matched prefix, never from the request
+	Text      *TextOverlay // composited after the watermark
+}
+
+// 处理失败或结果更大时能否返回原图：除了宽高以外没有任何变换、格式和质量参数时才可以，
+// 裁剪、旋转、滤镜、水印等请求不能用原图代替，客户端不支持 WebP 时也不能返回 WebP 原图。
+// 元数据策略在复制原图时同样生效，不影响判断
+func (e ExtraParams) CanServeOriginal() bool {
+	plain := ExtraParams{Width: e.Width, Height: e.Height, MaxWidth: e.MaxWidth, MaxHeight: e.MaxHeight, Metadata: e.Metadata}
+	return e.Variant() == plain.Variant()
+}
+
+// 实际使用的元数据策略
+func (e ExtraParams) MetadataPolicy() string {
+	if e.Metadata != "" {
+		return e.Metadata
+	}
+	return Config.MetadataPolicy
+}
+
+// 缓存键中的变体后缀，未设置任何参数时为空
+func (e ExtraParams) Variant() string {
+	var extras []string
+	if e.Fit != "" && e.Fit != FitCover {
+		extras = append(extras, "fit"+e.Fit)
+	}
+	if e.Background != "" {
+		extras = append(extras, "bg"+e.Background)
+	}
+	if e.WithoutEnlargement {
+		extras = append(extras, "noup")
+	}
+	if e.Rotate != 0 {
+		extras = append(extras, fmt.Sprintf("r%g", e.Rotate))
+	}
+	if e.Flip {
+		extras = append(extras, "flip")
+	}
+	if e.Flop {
+		extras = append(extras, "flop")
+	}
+	if e.NoAutoRotate {
+		extras = append(extras, "noar")
+	}
+	if e.Frame != nil {
+		extras = append(extras, fmt.Sprintf("fr%d", *e.Frame))
+	}
+	if e.Trim != nil {
+		trim := fmt.Sprintf("trim%g", e.Trim.Threshold)
+		if e.Trim.Background != "" {
+			trim += "-" + e.Trim.Background
+		}
+		if e.Trim.Animated {
+			trim += "-anim"
+		}
+		extras = append(extras, trim)
+	}
+	if e.Crop != nil {
+		unit := ""
+		if e.Crop.Percent {
+			unit = "p"
+		}
+		extras = append(extras, fmt.Sprintf("c%g%s-%g%s-%g%s-%g%s", e.Crop.X, unit, e.Crop.Y, unit, e.Crop.Width, unit, e.Crop.Height, unit))
+	}
+	// 焦点和裁剪策略只在同时指定宽高并按 cover 缩放时生效，其余情况不拆分缓存键
+	if e.Width > 0 && e.Height > 0 && (e.Fit == "" || e.Fit == FitCover) {
+		if e.Focal != nil {
+			extras = append(extras, fmt.Sprintf("fp%g-%g", e.Focal.X, e.Focal.Y))
+		}
+		if e.Interesting != "" {
+			extras = append(extras, "i"+strings.TrimPrefix(e.Interesting, "Interesting"))
+		}
+	}
+	if e.Quality > 0 {
+		extras = append(extras, fmt.Sprintf("q%d", e.Quality))
+	}
+	if e.Format != "" {
+		extras = append(extras, "f"+e.Format)
+	}
+	if e.Fallback != "" {
+		extras = append(extras, "fb"+e.Fallback)
+	}
+	extras = append(extras, e.Filters.variant()...)
+	if e.Metadata != "" {
+		extras = append(extras, "m"+e.Metadata)
+	}
+	if e.Gamut != "" {
+		extras = append(extras, "g"+e.Gamut)
+	}
+	if e.Watermark != nil {
+		extras = append(extras, "wm"+e.Watermark.ID())
+	}
+	if e.Text != nil {
+		extras = append(extras, fmt.Sprintf("txt%08x", crc32.ChecksumIEEE([]byte(fmt.Sprintf("%+v", *e.Text)))))
+	}
+
+	if len(extras) == 0 && e.Width <= 0 && e.Height <= 0 && e.MaxWidth <= 0 && e.MaxHeight <= 0 {
+		return ""
+	}
+	variant := fmt.Sprintf("_w%d_h%d_mw%d_mh%d", e.Width, e.Height, e.MaxWidth, e.MaxHeight)
+	for _, extra := range extras {
+		variant += "_" + extra
+	}
+	return variant
 }
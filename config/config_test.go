@@ -0,0 +1,322 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVariant(t *testing.T) {
+	tests := []struct {
+		name   string
+		params ExtraParams
+		want   string
+	}{
+		{"none", ExtraParams{}, ""},
+		{"sizes", ExtraParams{Width: 200, MaxHeight: 300}, "_w200_h0_mw0_mh300"},
+		{"default fit", ExtraParams{Width: 200, Height: 100, Fit: FitCover}, "_w200_h100_mw0_mh0"},
+		{"fit", ExtraParams{Width: 200, Height: 100, Fit: FitContain, Background: "ffffff"}, "_w200_h100_mw0_mh0_fitcontain_bgffffff"},
+		{"without enlargement", ExtraParams{Width: 200, WithoutEnlargement: true}, "_w200_h0_mw0_mh0_noup"},
+		{"params without sizes", ExtraParams{Fit: FitFill}, "_w0_h0_mw0_mh0_fitfill"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.params.Variant(); got != tt.want {
+				t.Fatalf("Variant() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVariantCrop(t *testing.T) {
+	focal := &FocalPoint{X: 0.25, Y: 0.5}
+	tests := []struct {
+		name   string
+		params ExtraParams
+		want   string
+	}{
+		{"pixels", ExtraParams{Crop: &CropRect{X: 10, Y: 20, Width: 300, Height: 200}}, "_w0_h0_mw0_mh0_c10-20-300-200"},
+		{"percent", ExtraParams{Crop: &CropRect{Width: 50, Height: 50, Percent: true}}, "_w0_h0_mw0_mh0_c0p-0p-50p-50p"},
+		{"focal cover", ExtraParams{Width: 200, Height: 100, Focal: focal}, "_w200_h100_mw0_mh0_fp0.25-0.5"},
+		{"interesting cover", ExtraParams{Width: 200, Height: 100, Interesting: "InterestingAttention"}, "_w200_h100_mw0_mh0_iAttention"},
+		// 焦点和裁剪策略只影响 cover 缩放
+		{"focal single dimension", ExtraParams{Width: 200, Focal: focal}, "_w200_h0_mw0_mh0"},
+		{"focal contain", ExtraParams{Width: 200, Height: 100, Fit: FitContain, Focal: focal}, "_w200_h100_mw0_mh0_fitcontain"},
+		{"interesting without sizes", ExtraParams{Interesting: "InterestingEntropy"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.params.Variant(); got != tt.want {
+				t.Fatalf("Variant() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVariantQualityFormat(t *testing.T) {
+	tests := []struct {
+		params ExtraParams
+		want   string
+	}{
+		{ExtraParams{Quality: 75}, "_w0_h0_mw0_mh0_q75"},
+		{ExtraParams{Format: FormatAvif}, "_w0_h0_mw0_mh0_favif"},
+		{ExtraParams{Width: 200, Quality: 60, Format: FormatJpeg}, "_w200_h0_mw0_mh0_q60_fjpeg"},
+	}
+	for _, tt := range tests {
+		if got := tt.params.Variant(); got != tt.want {
+			t.Errorf("Variant(%+v) = %q, want %q", tt.params, got, tt.want)
+		}
+	}
+}
+
+func TestPresetValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		preset  Preset
+		wantErr bool
+	}{
+		{"empty", Preset{}, false},
+		{"full", Preset{Width: 400, Height: 300, Fit: FitContain, Background: "#fff", Interesting: "InterestingAttention", Quality: 80, Format: FormatWebp}, false},
+		{"negative size", Preset{Width: -1}, true},
+		{"bad fit", Preset{Fit: "stretch"}, true},
+		{"bad background", Preset{Background: "white"}, true},
+		{"bad interesting", Preset{Interesting: "Attention"}, true},
+		{"bad quality", Preset{Quality: 101}, true},
+		{"bad format", Preset{Format: "bmp"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.preset.validate(); (err != nil) != tt.wantErr {
+				t.Fatalf("validate() = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVariantOrientation(t *testing.T) {
+	tests := []struct {
+		params ExtraParams
+		want   string
+	}{
+		{ExtraParams{Rotate: 90}, "_w0_h0_mw0_mh0_r90"},
+		{ExtraParams{Rotate: 22.5, Flip: true, Flop: true}, "_w0_h0_mw0_mh0_r22.5_flip_flop"},
+		{ExtraParams{Width: 100, NoAutoRotate: true}, "_w100_h0_mw0_mh0_noar"},
+	}
+	for _, tt := range tests {
+		if got := tt.params.Variant(); got != tt.want {
+			t.Errorf("Variant(%+v) = %q, want %q", tt.params, got, tt.want)
+		}
+	}
+}
+
+func TestFiltersValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		filters Filters
+		wantErr bool
+	}{
+		{"none", Filters{}, false},
+		{"in range", Filters{Blur: 0.3, Sharpen: 10, Brightness: -100, Saturation: 100, Contrast: 50, Gamma: 0.1}, false},
+		{"blur too small", Filters{Blur: 0.2}, true},
+		{"blur too large", Filters{Blur: 101}, true},
+		{"negative sharpen", Filters{Sharpen: -1}, true},
+		{"brightness", Filters{Brightness: 101}, true},
+		{"saturation", Filters{Saturation: -101}, true},
+		{"contrast", Filters{Contrast: 200}, true},
+		{"gamma", Filters{Gamma: 11}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.filters.Validate(); (err != nil) != tt.wantErr {
+				t.Fatalf("Validate() = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVariantFilters(t *testing.T) {
+	tests := []struct {
+		filters Filters
+		want    string
+	}{
+		{Filters{Blur: 2, Sharpen: 1}, "_w0_h0_mw0_mh0_sh1_bl2"},
+		{Filters{Brightness: 10, Saturation: -20, Contrast: 5, Gamma: 2.2}, "_w0_h0_mw0_mh0_br10_sat-20_ct5_gm2.2"},
+		{Filters{Grayscale: true, Tint: "ff0000", Negate: true}, "_w0_h0_mw0_mh0_gray_tintff0000_neg"},
+	}
+	for _, tt := range tests {
+		if got := (ExtraParams{Filters: tt.filters}).Variant(); got != tt.want {
+			t.Errorf("Variant(%+v) = %q, want %q", tt.filters, got, tt.want)
+		}
+	}
+}
+
+func TestCanServeOriginal(t *testing.T) {
+	tests := []struct {
+		name   string
+		params ExtraParams
+		want   bool
+	}{
+		{"none", ExtraParams{}, true},
+		{"sizes", ExtraParams{Width: 200, Height: 100, MaxWidth: 400, MaxHeight: 300}, true},
+		{"default fit", ExtraParams{Width: 200, Height: 100, Fit: FitCover}, true},
+		{"fit", ExtraParams{Width: 200, Height: 100, Fit: FitContain}, false},
+		{"rotate", ExtraParams{Rotate: 90}, false},
+		{"crop", ExtraParams{Crop: &CropRect{Width: 10, Height: 10}}, false},
+		{"filters", ExtraParams{Filters: Filters{Grayscale: true}}, false},
+		{"quality", ExtraParams{Quality: 80}, false},
+		{"format", ExtraParams{Format: FormatJpeg}, false},
+		{"watermark", ExtraParams{Watermark: &Watermark{Image: "logo.png"}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.params.CanServeOriginal(); got != tt.want {
+				t.Fatalf("CanServeOriginal() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWatermarkID(t *testing.T) {
+	a := &Watermark{Image: "logo.png", Gravity: "south-east", Opacity: 0.5}
+	b := &Watermark{Image: "logo.png", Gravity: "south-east", Opacity: 0.5}
+	if a.ID() != b.ID() {
+		t.Fatal("equal watermarks should have the same ID")
+	}
+	b.Opacity = 0.6
+	if a.ID() == b.ID() {
+		t.Fatal("changing the watermark should change its ID")
+	}
+	if got, want := (ExtraParams{Watermark: a}).Variant(), "_w0_h0_mw0_mh0_wm"+a.ID(); got != want {
+		t.Fatalf("Variant() = %q, want %q", got, want)
+	}
+}
+
+func TestTextOverlayValidate(t *testing.T) {
+	old := Config
+	cfg := *old
+	cfg.TextMaxLength = 10
+	Config = &cfg
+	t.Cleanup(func() { Config = old })
+
+	tests := []struct {
+		name    string
+		overlay TextOverlay
+		wantErr bool
+	}{
+		{"text", TextOverlay{Text: "hello"}, false},
+		{"full", TextOverlay{Text: "©2026 水印", Size: 32, Color: "ffffff", StrokeWidth: 2, StrokeColor: "000000", Gravity: "north", Padding: 10}, false},
+		{"empty", TextOverlay{}, true},
+		{"too long", TextOverlay{Text: "hello world"}, true},
+		{"control character", TextOverlay{Text: "a\nb"}, true},
+		{"size", TextOverlay{Text: "a", Size: 5}, true},
+		{"stroke", TextOverlay{Text: "a", StrokeWidth: 21}, true},
+		{"padding", TextOverlay{Text: "a", Padding: -1}, true},
+		{"color", TextOverlay{Text: "a", Color: "white"}, true},
+		{"gravity", TextOverlay{Text: "a", Gravity: "top"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.overlay.Validate(); (err != nil) != tt.wantErr {
+				t.Fatalf("Validate() = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVariantTrim(t *testing.T) {
+	tests := []struct {
+		trim *TrimParams
+		want string
+	}{
+		{&TrimParams{Threshold: 10}, "_w0_h0_mw0_mh0_trim10"},
+		{&TrimParams{Threshold: 0, Background: "ffffff", Animated: true}, "_w0_h0_mw0_mh0_trim0-ffffff-anim"},
+	}
+	for _, tt := range tests {
+		if got := (ExtraParams{Trim: tt.trim}).Variant(); got != tt.want {
+			t.Errorf("Variant(%+v) = %q, want %q", *tt.trim, got, tt.want)
+		}
+	}
+}
+
+// 用 configJSON 和当前环境变量从默认配置加载，测试结束后恢复 Config
+func loadTestConfig(t *testing.T, configJSON string) {
+	t.Helper()
+	oldConfig, oldPath := Config, ConfigPath
+	t.Cleanup(func() { Config, ConfigPath = oldConfig, oldPath })
+
+	ConfigPath = filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(ConfigPath, []byte(configJSON), 0644); err != nil {
+		t.Fatal(err)
+	}
+	Config = NewWebPConfig()
+	LoadConfig()
+}
+
+func TestLoadConfigBackground(t *testing.T) {
+	tests := []struct {
+		name       string
+		configJSON string
+		env        map[string]string
+		want       string
+		wantAlpha  bool
+	}{
+		{"default", `{}`, nil, "ffffff", false},
+		{"config", `{"BACKGROUND": "#000", "AUTO_LOSSLESS_ALPHA": true}`, nil, "#000", true},
+		{"invalid", `{"BACKGROUND": "white"}`, nil, "ffffff", false},
+		{"env", `{"BACKGROUND": "000000"}`, map[string]string{"WEBP_BACKGROUND": "ff000080", "WEBP_AUTO_LOSSLESS_ALPHA": "true"}, "ff000080", true},
+		{"invalid env boolean", `{"AUTO_LOSSLESS_ALPHA": true}`, map[string]string{"WEBP_AUTO_LOSSLESS_ALPHA": "yes"}, "ffffff", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+			loadTestConfig(t, tt.configJSON)
+			if Config.Background != tt.want || Config.AutoLosslessAlpha != tt.wantAlpha {
+				t.Fatalf("BACKGROUND = %q, AUTO_LOSSLESS_ALPHA = %v, want %q, %v", Config.Background, Config.AutoLosslessAlpha, tt.want, tt.wantAlpha)
+			}
+		})
+	}
+}
+
+func TestLoadConfigColour(t *testing.T) {
+	tests := []struct {
+		name       string
+		configJSON string
+		env        map[string]string
+		wantColour string
+		wantICC    string
+	}{
+		{"default", `{}`, nil, ColorManagementSRGB, ICCProfileEmbed},
+		{"config", `{"COLOR_MANAGEMENT": "wide", "ICC_PROFILE": "strip"}`, nil, ColorManagementWide, ICCProfileStrip},
+		{"invalid", `{"COLOR_MANAGEMENT": "p3", "ICC_PROFILE": "keep"}`, nil, ColorManagementSRGB, ICCProfileEmbed},
+		{"env", `{"COLOR_MANAGEMENT": "wide"}`, map[string]string{"WEBP_COLOR_MANAGEMENT": "off", "WEBP_ICC_PROFILE": "strip"}, ColorManagementOff, ICCProfileStrip},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+			loadTestConfig(t, tt.configJSON)
+			if Config.ColorManagement != tt.wantColour || Config.ICCProfile != tt.wantICC {
+				t.Fatalf("COLOR_MANAGEMENT = %q, ICC_PROFILE = %q, want %q, %q", Config.ColorManagement, Config.ICCProfile, tt.wantColour, tt.wantICC)
+			}
+		})
+	}
+}
+
+func TestVariantFrame(t *testing.T) {
+	first, third := 0, 2
+	tests := []struct {
+		params ExtraParams
+		want   string
+	}{
+		{ExtraParams{Frame: &first}, "_w0_h0_mw0_mh0_fr0"},
+		{ExtraParams{Width: 100, Frame: &third}, "_w100_h0_mw0_mh0_fr2"},
+	}
+	for _, tt := range tests {
+		if got := tt.params.Variant(); got != tt.want {
+			t.Errorf("Variant(frame %d) = %q, want %q", *tt.params.Frame, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package encoder
+
+import (
+	"webp_server_go/config"
+
+	"github.com/davidbyttow/govips/v2/vips"
+	log "github.com/sirupsen/logrus"
+)
+
+// 把带有 ICC 配置文件或 CMYK 的图像转换到 sRGB 并嵌入精简的 sRGB 配置文件，
+// COLOR_MANAGEMENT 为 wide 且请求 gamut=p3 时保留 RGB 图像原有的配置文件
+func manageColour(img *vips.ImageRef, imageType string, extraParams config.ExtraParams) error {
+	if config.Config.ColorManagement == config.ColorManagementOff {
+		return nil
+	}
+
+	cmyk := img.Interpretation() == vips.InterpretationCMYK
+	if extraParams.Gamut == config.GamutP3 && !cmyk && img.HasICCProfile() && supportsICC(imageType) {
+		// 广色域图像离开配置文件就无法正确显示，此时忽略 ICC_PROFILE=strip
+		log.Debug("保留原图的广色域配置文件")
+		return nil
+	}
+
+	if img.HasICCProfile() || cmyk {
+		// 没有嵌入配置文件的 CMYK 使用 libvips 内置的 cmyk 配置文件
+		fallback := vips.SRGBIEC6196621ICCProfilePath
+		if cmyk {
+			fallback = "cmyk"
+		}
+		// 灰度图保持单通道，使用灰度配置文件
+		target := vips.SRGBV2MicroICCProfilePath
+		if img.Bands() <= 2 {
+			target = vips.SGrayV2MicroICCProfilePath
+		}
+		if err := img.TransformICCProfileWithFallback(target, fallback); err != nil {
+			return err
+		}
+		log.Debug("已转换到 sRGB")
+	}
+
+	// 没有配置文件的图像按 sRGB 显示，转换后可以安全去掉
+	if config.Config.ICCProfile == config.ICCProfileStrip && img.HasICCProfile() {
+		return img.RemoveICCProfile()
+	}
+	return nil
+}
+
+// 输出格式能否嵌入 ICC 配置文件
+func supportsICC(imageType string) bool {
+	switch imageType {
+	case config.FormatWebp, config.FormatAvif, config.FormatJxl, config.FormatJpeg, config.FormatPng:
+		return true
+	}
+	return false
+}
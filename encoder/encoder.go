@@ -20,8 +20,8 @@ var (
 	// Source image encoder ignore list for WebP and AVIF
 	// We shouldn't convert Unknown and AVIF to WebP
 	webpIgnore = []vips.ImageType{vips.ImageTypeUnknown, vips.ImageTypeAVIF}
-	// We shouldn't convert Unknown,AVIF and GIF to AVIF
-	avifIgnore = append(webpIgnore, vips.ImageTypeGIF)
+	// Animated GIF is encoded as animated WebP when AVIF is requested, see avifEncoder
+	avifIgnore = webpIgnore
 )
 
 func init() {
@@ -31,6 +31,17 @@ func init() {
 	})
 	boolFalse.Set(false)
 	intMinusOne.Set(-1)
+	helper.HeaderProber = probeHeader
+}
+
+// 输入限制检查使用的文件头读取，libvips 加载时只解析文件头，访问像素前不会解码
+func probeHeader(filename string) (int, int, int, error) {
+	img, err := vips.LoadImageFromFile(filename, &vips.ImportParams{FailOnError: boolFalse})
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	defer img.Close()
+	return img.Width(), img.Height(), max(img.Pages(), 1), nil
 }
 
 func ConvertFilter(rawPath, jxlPath, avifPath, webpPath string, extraParams config.ExtraParams, supportedFormats map[string]bool, c chan int) {
@@ -105,25 +116,22 @@ func convertImage(rawPath, optimizedPath, imageType string, extraParams config.E
 		return err
 	}
 
-	// 如果原始图像是 NEF 格式，先转换为 JPG
-	if strings.HasSuffix(strings.ToLower(rawPath), ".nef") {
-		convertedRaw, converted := ConvertRawToJPG(rawPath, optimizedPath)
-		if converted {
-			rawPath = convertedRaw
-			defer func() {
-				log.Infoln("移除中间转换文件:", convertedRaw)
-				if err := os.Remove(convertedRaw); err != nil {
-					log.Warnln("删除转换文件失败", err)
-				}
-			}()
-		}
+	// 相机 RAW 先转换为中间文件
+	rawPath, cleanup, err := prepareRaw(rawPath)
+	if err != nil {
+		log.Warn(err)
+		return err
+	}
+	defer cleanup()
+
+	// 预取时同样在解码前检查输入限制
+	if err := helper.CheckInputLimits(rawPath); err != nil {
+		log.Warnf("跳过图像 %s: %v", rawPath, err)
+		return err
 	}
 
 	// 打开图像
-	img, err := vips.LoadImageFromFile(rawPath, &vips.ImportParams{
-		FailOnError: boolFalse,
-		NumPages:    intMinusOne,
-	})
+	img, err := vips.LoadImageFromFile(rawPath, importParams(rawPath, extraParams))
 	if err != nil {
 		log.Warnf("无法打开源图像: %v", err)
 		return err
@@ -136,7 +144,7 @@ func convertImage(rawPath, optimizedPath, imageType string, extraParams config.E
 		log.Warnf("无法预处理源图像: %v", err)
 		if shouldCopyOriginal {
 			log.Infof("由于预处理错误，将复制原图")
-			return helper.CopyFile(rawPath, optimizedPath)
+			return CopyOriginal(rawPath, optimizedPath, extraParams)
 		}
 		return err
 	}
@@ -145,17 +153,17 @@ func convertImage(rawPath, optimizedPath, imageType string, extraParams config.E
 	var encoderErr error
 	switch imageType {
 	case "webp":
-		encoderErr = webpEncoder(img, rawPath, optimizedPath)
+		encoderErr = webpEncoder(img, rawPath, optimizedPath, extraParams)
 	case "avif":
-		encoderErr = avifEncoder(img, rawPath, optimizedPath)
+		encoderErr = avifEncoder(img, rawPath, optimizedPath, extraParams)
 	case "jxl":
-		encoderErr = jxlEncoder(img, rawPath, optimizedPath)
+		encoderErr = jxlEncoder(img, rawPath, optimizedPath, extraParams)
 	}
 
 	if encoderErr != nil {
 		log.Warnf("图像编码失败: %v", encoderErr)
 		// 如果编码失败，我们也复制原图
-		return helper.CopyFile(rawPath, optimizedPath)
+		return CopyOriginal(rawPath, optimizedPath, extraParams)
 	}
 
 	// 比较转换后的文件大小
@@ -177,20 +185,33 @@ func convertImage(rawPath, optimizedPath, imageType string, extraParams config.E
 			log.Warnf("删除大的转换文件失败: %v", err)
 		}
 		// 将原图复制到目标路径
-		return helper.CopyFile(rawPath, optimizedPath)
+		return CopyOriginal(rawPath, optimizedPath, extraParams)
 	}
 
 	// log.Infof("图像处理成功: 目标文件=%s", optimizedPath)
 	return nil
 }
 
-func jxlEncoder(img *vips.ImageRef, rawPath string, optimizedPath string) error {
+// 请求参数中的质量优先于全局 QUALITY
+func encodeQuality(extraParams config.ExtraParams) int {
+	if extraParams.Quality > 0 {
+		return extraParams.Quality
+	}
+	return config.Config.Quality
+}
+
+func jxlEncoder(img *vips.ImageRef, rawPath string, optimizedPath string, extraParams config.ExtraParams) error {
 	var (
 		buf     []byte
-		quality = config.Config.Quality
+		quality = encodeQuality(extraParams)
 		err     error
 	)
 
+	// JXL 导出参数没有 strip，元数据只能提前删除
+	if applyMetadataPolicy(img, extraParams) {
+		img.RemoveMetadata(animationFields...)
+	}
+
 	// If quality >= 100, we use lossless mode
 	if quality >= 100 {
 		buf, _, err = img.ExportJxl(&vips.JxlExportParams{
@@ -223,10 +244,17 @@ func jxlEncoder(img *vips.ImageRef, rawPath string, optimizedPath string) error
 	return nil
 }
 
-func avifEncoder(img *vips.ImageRef, rawPath string, optimizedPath string) error {
+func avifEncoder(img *vips.ImageRef, rawPath string, optimizedPath string, extraParams config.ExtraParams) error {
+	// 已知限制：libvips 不能编码 AVIF 动图，动图请求 AVIF 时输出 WebP 动图而不是只保留第一帧
+	// 缓存文件仍使用 .avif 扩展名，响应的 Content-Type 按文件内容判断为 image/webp（见 helper.ExhaustContentType）
+	if frameCount(img) > 1 {
+		log.Debug("AVIF 不支持动图，输出 WebP 动图")
+		return webpEncoder(img, rawPath, optimizedPath, extraParams)
+	}
+
 	var (
 		buf     []byte
-		quality = config.Config.Quality
+		quality = encodeQuality(extraParams)
 		err     error
 	)
 
@@ -234,13 +262,13 @@ func avifEncoder(img *vips.ImageRef, rawPath string, optimizedPath string) error
 	if quality >= 100 {
 		buf, _, err = img.ExportAvif(&vips.AvifExportParams{
 			Lossless:      true,
-			StripMetadata: config.Config.StripMetadata,
+			StripMetadata: applyMetadataPolicy(img, extraParams),
 		})
 	} else {
 		buf, _, err = img.ExportAvif(&vips.AvifExportParams{
 			Quality:       quality,
 			Lossless:      false,
-			StripMetadata: config.Config.StripMetadata,
+			StripMetadata: applyMetadataPolicy(img, extraParams),
 		})
 	}
 
@@ -258,21 +286,32 @@ func avifEncoder(img *vips.ImageRef, rawPath string, optimizedPath string) error
 	return nil
 }
 
-func webpEncoder(img *vips.ImageRef, rawPath string, optimizedPath string) error {
+func webpEncoder(img *vips.ImageRef, rawPath string, optimizedPath string, extraParams config.ExtraParams) error {
 	var (
 		buf     []byte
-		quality = config.Config.Quality
+		quality = encodeQuality(extraParams)
 		err     error
 	)
 
+	// 开启 AUTO_LOSSLESS_ALPHA 时，有透明像素的图像使用无损模式，避免透明边缘出现杂色
+	lossless := quality >= 100
+	if !lossless && config.Config.AutoLosslessAlpha {
+		if hasAlpha, err := hasMeaningfulAlpha(img); err != nil {
+			log.Warnf("检测透明通道失败: %v", err)
+		} else if hasAlpha {
+			log.Debug("图像含有透明像素，使用无损 WebP")
+			lossless = true
+		}
+	}
+
 	// If quality >= 100, we use lossless mode
-	if quality >= 100 {
+	if lossless {
 		// Lossless mode will not encounter problems as below, because in libvips as code below
 		// 	config.method = ExUtilGetInt(argv[++c], 0, &parse_error);
 		//   use_lossless_preset = 0;   // disable -z option
 		buf, _, err = img.ExportWebp(&vips.WebpExportParams{
 			Lossless:      true,
-			StripMetadata: config.Config.StripMetadata,
+			StripMetadata: applyMetadataPolicy(img, extraParams),
 		})
 	} else {
 		// If some special images cannot encode with default ReductionEffort(0), then retry from 0 to 6
@@ -280,7 +319,7 @@ func webpEncoder(img *vips.ImageRef, rawPath string, optimizedPath string) error
 		ep := vips.WebpExportParams{
 			Quality:       quality,
 			Lossless:      false,
-			StripMetadata: config.Config.StripMetadata,
+			StripMetadata: applyMetadataPolicy(img, extraParams),
 		}
 		for i := range 7 {
 			ep.ReductionEffort = i
@@ -310,6 +349,160 @@ func webpEncoder(img *vips.ImageRef, rawPath string, optimizedPath string) error
 	return nil
 }
 
+func jpegEncoder(img *vips.ImageRef, rawPath string, optimizedPath string, extraParams config.ExtraParams) error {
+	buf, _, err := img.ExportJpeg(&vips.JpegExportParams{
+		Quality:       encodeQuality(extraParams),
+		Interlace:     true,
+		StripMetadata: applyMetadataPolicy(img, extraParams),
+	})
+	if err != nil {
+		log.Warnf("无法将源图像：%v 编码为 JPEG", err)
+		return err
+	}
+
+	if err := os.WriteFile(optimizedPath, buf, 0600); err != nil {
+		log.Error(err)
+		return err
+	}
+	return nil
+}
+
+func pngEncoder(img *vips.ImageRef, rawPath string, optimizedPath string, extraParams config.ExtraParams) error {
+	ep := vips.NewPngExportParams()
+	ep.StripMetadata = applyMetadataPolicy(img, extraParams)
+	// PNG 是无损格式，质量低于 100 时使用调色板量化
+	if quality := encodeQuality(extraParams); quality < 100 {
+		ep.Palette = true
+		ep.Quality = quality
+	}
+	buf, _, err := img.ExportPng(ep)
+	if err != nil {
+		log.Warnf("无法将源图像：%v 编码为 PNG", err)
+		return err
+	}
+
+	if err := os.WriteFile(optimizedPath, buf, 0600); err != nil {
+		log.Error(err)
+		return err
+	}
+	return nil
+}
+
+// 其他格式（heif 等）按原格式使用 libvips 默认参数导出
+func nativeEncoder(img *vips.ImageRef, rawPath string, optimizedPath string, extraParams config.ExtraParams) error {
+	// 原格式导出使用默认参数，元数据只能提前删除
+	if applyMetadataPolicy(img, extraParams) {
+		img.RemoveMetadata(animationFields...)
+	}
+	buf, _, err := img.ExportNative()
+	if err != nil {
+		log.Warnf("无法将源图像：%v 按原格式导出", err)
+		return err
+	}
+
+	if err := os.WriteFile(optimizedPath, buf, 0600); err != nil {
+		log.Error(err)
+		return err
+	}
+	return nil
+}
+
+// 调色板量化和抖动参数来自 GIF_EFFORT、GIF_BITDEPTH 和 GIF_DITHER
+func gifEncoder(img *vips.ImageRef, rawPath string, optimizedPath string, extraParams config.ExtraParams) error {
+	ep := vips.NewGifExportParams()
+	ep.StripMetadata = applyMetadataPolicy(img, extraParams)
+	ep.Effort = config.Config.GifEffort
+	ep.Bitdepth = config.Config.GifBitdepth
+	ep.Dither = config.Config.GifDither
+	buf, _, err := img.ExportGIF(ep)
+	if err != nil {
+		log.Warnf("无法将源图像：%v 编码为 GIF", err)
+		return err
+	}
+
+	if err := os.WriteFile(optimizedPath, buf, 0600); err != nil {
+		log.Error(err)
+		return err
+	}
+	return nil
+}
+
+// libvips 不能保存 APNG，逐帧编码为 PNG 后再合成
+// 所有帧必须使用相同的 IHDR，因此统一为 8 位 sRGB 加 alpha，不使用调色板，也不写入元数据
+func apngEncoder(img *vips.ImageRef, rawPath string, optimizedPath string, extraParams config.ExtraParams) error {
+	frames := frameCount(img)
+	if frames <= 1 {
+		return pngEncoder(img, rawPath, optimizedPath, extraParams)
+	}
+	pageHeight := img.PageHeight()
+	delay, _ := img.PageDelay()
+	loop := img.GetInt("loop")
+
+	if img.Interpretation() != vips.InterpretationSRGB {
+		if err := img.ToColorSpace(vips.InterpretationSRGB); err != nil {
+			return err
+		}
+	}
+	if !img.HasAlpha() {
+		if err := img.AddAlpha(); err != nil {
+			return err
+		}
+	}
+
+	pngs := make([][]byte, 0, frames)
+	for i := range frames {
+		frame, err := img.Copy()
+		if err != nil {
+			return err
+		}
+		if err := extractFrame(frame, i, pageHeight); err != nil {
+			frame.Close()
+			return err
+		}
+		ep := vips.NewPngExportParams()
+		ep.StripMetadata = true
+		ep.Bitdepth = 8
+		buf, _, err := frame.ExportPng(ep)
+		frame.Close()
+		if err != nil {
+			log.Warnf("无法将第 %d 帧编码为 PNG: %v", i, err)
+			return err
+		}
+		pngs = append(pngs, buf)
+	}
+
+	buf, err := helper.AssembleAPNG(pngs, delay, loop)
+	if err != nil {
+		log.Warnf("无法合成 APNG: %v", err)
+		return err
+	}
+
+	if err := os.WriteFile(optimizedPath, buf, 0600); err != nil {
+		log.Error(err)
+		return err
+	}
+	return nil
+}
+
+// format=original 时按源图像格式选择编码器
+func originalFormat(img *vips.ImageRef) string {
+	switch img.Format() {
+	case vips.ImageTypeJPEG:
+		return config.FormatJpeg
+	case vips.ImageTypePNG:
+		return config.FormatPng
+	case vips.ImageTypeWEBP:
+		return config.FormatWebp
+	case vips.ImageTypeAVIF:
+		return config.FormatAvif
+	case vips.ImageTypeJXL:
+		return config.FormatJxl
+	case vips.ImageTypeGIF:
+		return config.FormatGif
+	}
+	return config.FormatOriginal
+}
+
 // func convertLog(itype, rawPath string, optimizedPath string, quality int) {
 // 	oldf, err := os.Stat(rawPath)
 // 	if err != nil {
@@ -0,0 +1,96 @@
+package encoder
+
+import (
+	"webp_server_go/config"
+	"webp_server_go/helper"
+
+	"github.com/davidbyttow/govips/v2/vips"
+	log "github.com/sirupsen/logrus"
+)
+
+// 按固定顺序应用滤镜：模糊 -> 锐化 -> 亮度/饱和度 -> 对比度 -> gamma -> 灰度 -> 着色 -> 反色
+func applyFilters(img *vips.ImageRef, filters config.Filters) error {
+	if filters == (config.Filters{}) {
+		return nil
+	}
+	log.Debugf("应用滤镜: %+v", filters)
+
+	if filters.Blur > 0 {
+		if err := img.GaussianBlur(filters.Blur); err != nil {
+			return err
+		}
+	}
+	if filters.Sharpen > 0 {
+		if err := img.Sharpen(filters.Sharpen, 2, 10); err != nil {
+			return err
+		}
+	}
+	if filters.Brightness != 0 || filters.Saturation != 0 {
+		if err := img.Modulate(1+filters.Brightness/100, 1+filters.Saturation/100, 0); err != nil {
+			return err
+		}
+	}
+	if filters.Contrast != 0 {
+		// 以中灰为中心拉伸
+		a := 1 + filters.Contrast/100
+		if err := linearColorBands(img, a, 128*(1-a)); err != nil {
+			return err
+		}
+	}
+	if filters.Gamma != 0 {
+		if err := img.Gamma(filters.Gamma); err != nil {
+			return err
+		}
+	}
+	if filters.Grayscale || filters.Tint != "" {
+		if err := img.ToColorSpace(vips.InterpretationBW); err != nil {
+			return err
+		}
+	}
+	if filters.Tint != "" {
+		if err := tintImage(img, filters.Tint); err != nil {
+			return err
+		}
+	}
+	if filters.Negate {
+		if err := linearColorBands(img, -1, 255); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 对颜色通道做 out = in * a + b，保持 alpha 通道不变，结果转回 8 位
+func linearColorBands(img *vips.ImageRef, a, b float64) error {
+	bands := img.Bands()
+	multipliers := make([]float64, bands)
+	addends := make([]float64, bands)
+	for i := range bands {
+		multipliers[i], addends[i] = a, b
+	}
+	if img.HasAlpha() {
+		multipliers[bands-1], addends[bands-1] = 1, 0
+	}
+	if err := img.Linear(multipliers, addends); err != nil {
+		return err
+	}
+	return img.Cast(vips.BandFormatUchar)
+}
+
+// 用颜色乘以灰度亮度，暗部保持黑色，亮部接近着色颜色
+func tintImage(img *vips.ImageRef, tint string) error {
+	r, g, b, _ := helper.ParseHexColor(tint)
+	if err := img.ToColorSpace(vips.InterpretationSRGB); err != nil {
+		return err
+	}
+	multipliers := []float64{float64(r) / 255, float64(g) / 255, float64(b) / 255}
+	addends := []float64{0, 0, 0}
+	if img.HasAlpha() {
+		multipliers = append(multipliers, 1)
+		addends = append(addends, 0)
+	}
+	if err := img.Linear(multipliers, addends); err != nil {
+		return err
+	}
+	return img.Cast(vips.BandFormatUchar)
+}
@@ -0,0 +1,156 @@
+package encoder
+
+import (
+	"fmt"
+	"webp_server_go/config"
+	"webp_server_go/helper"
+
+	"github.com/davidbyttow/govips/v2/vips"
+	log "github.com/sirupsen/logrus"
+)
+
+// 逐帧处理时需要在帧之间共享的状态，保证所有帧的输出尺寸一致
+type frameState struct {
+	animated     bool
+	trimDetected bool
+	trimBox      *trimBox       // detected on the first frame, nil when there is nothing to trim
+	watermark    *vips.ImageRef // scaled (and tiled) on the first frame, reused by the other frames
+}
+
+// 释放在帧之间共享的图像
+func (state *frameState) close() {
+	if state.watermark != nil {
+		state.watermark.Close()
+		state.watermark = nil
+	}
+}
+
+// 加载参数：frame 只加载指定的一帧，动图最多加载 MAX_ANIMATION_FRAMES 帧
+// n-pages 是文件中的总帧数，帧数不足时 libvips 会报错，所以先从文件头读取帧数
+func importParams(rawPath string, extraParams config.ExtraParams) *vips.ImportParams {
+	params := &vips.ImportParams{FailOnError: boolFalse, NumPages: intMinusOne}
+	frames := 0
+	if probe, err := helper.ProbeImage(rawPath); err == nil {
+		frames = probe.Frames
+	}
+
+	if extraParams.Frame != nil {
+		page := *extraParams.Frame
+		if frames > 0 {
+			page = min(page, frames-1)
+		}
+		params.Page.Set(page)
+		params.NumPages.Set(1)
+		return params
+	}
+	if limit := config.Config.MaxAnimationFrames; limit > 0 && frames > limit {
+		log.Infof("动图共 %d 帧，只处理前 %d 帧", frames, limit)
+		params.NumPages.Set(limit)
+	}
+	return params
+}
+
+// 实际加载的帧数，n-pages 可能大于加载的帧数，以 page-height 为准
+func frameCount(img *vips.ImageRef) int {
+	pageHeight := img.PageHeight()
+	if pageHeight <= 0 || pageHeight >= img.Height() || img.Height()%pageHeight != 0 {
+		return 1
+	}
+	return img.Height() / pageHeight
+}
+
+// 输出格式能否保存动图，不能时只输出第一帧
+// AVIF 动图会改为输出 WebP 动图（见 avifEncoder），原格式输出时由 libvips 按原格式保存
+func supportsAnimation(imageType string) bool {
+	switch imageType {
+	case config.FormatWebp, config.FormatAvif, config.FormatGif, config.FormatApng, config.FormatOriginal:
+		return true
+	}
+	return false
+}
+
+// 只保留第一帧，作为静态图处理
+func firstFrame(img *vips.ImageRef) error {
+	pageHeight := img.PageHeight()
+	if err := img.SetPageHeight(img.Height()); err != nil {
+		return err
+	}
+	if err := img.ExtractArea(0, 0, img.Width(), pageHeight); err != nil {
+		return err
+	}
+	return img.SetPages(1)
+}
+
+// 动图逐帧调用 fn 后重新拼接，保留帧延迟和循环次数；静态图直接调用 fn
+// fn 按帧顺序调用，处理后所有帧的尺寸必须一致
+func mapFrames(img *vips.ImageRef, fn func(frame *vips.ImageRef) error) error {
+	frames := frameCount(img)
+	if frames <= 1 {
+		return fn(img)
+	}
+	pageHeight := img.PageHeight()
+	delay, _ := img.PageDelay()
+	loop := img.GetInt("loop")
+
+	// 先从原图取出其余各帧，再把 img 本身裁剪为第一帧
+	rest := make([]*vips.ImageRef, 0, frames-1)
+	defer func() {
+		for _, frame := range rest {
+			frame.Close()
+		}
+	}()
+	for i := 1; i < frames; i++ {
+		frame, err := img.Copy()
+		if err != nil {
+			return err
+		}
+		rest = append(rest, frame)
+		if err := extractFrame(frame, i, pageHeight); err != nil {
+			return err
+		}
+	}
+	if err := extractFrame(img, 0, pageHeight); err != nil {
+		return err
+	}
+
+	if err := fn(img); err != nil {
+		return err
+	}
+	for i, frame := range rest {
+		if err := fn(frame); err != nil {
+			return err
+		}
+		if frame.Width() != img.Width() || frame.Height() != img.Height() {
+			return fmt.Errorf("第 %d 帧处理后尺寸 %dx%d 与第一帧 %dx%d 不一致", i+1, frame.Width(), frame.Height(), img.Width(), img.Height())
+		}
+	}
+
+	newPageHeight := img.Height()
+	if err := img.ArrayJoin(rest, 1); err != nil {
+		return err
+	}
+	if err := img.SetPageHeight(newPageHeight); err != nil {
+		return err
+	}
+	if err := img.SetPages(frames); err != nil {
+		return err
+	}
+	if len(delay) > 0 {
+		if err := img.SetPageDelay(delay[:min(len(delay), frames)]); err != nil {
+			return err
+		}
+	}
+	img.SetInt("loop", loop)
+	return nil
+}
+
+// 把多页图像裁剪为第 index 帧，并标记为单页，避免后续操作按动图处理
+func extractFrame(img *vips.ImageRef, index, pageHeight int) error {
+	if err := img.SetPageHeight(img.Height()); err != nil {
+		return err
+	}
+	if err := img.ExtractArea(0, index*pageHeight, img.Width(), pageHeight); err != nil {
+		return err
+	}
+	return img.SetPages(1)
+}
@@ -0,0 +1,82 @@
+package encoder
+
+import (
+	"slices"
+	"strings"
+	"webp_server_go/config"
+	"webp_server_go/helper"
+
+	"github.com/davidbyttow/govips/v2/vips"
+	log "github.com/sirupsen/logrus"
+)
+
+// copyright 策略下保留的 libvips 元数据字段
+var copyrightFields = []string{"exif-ifd0-Copyright", "exif-ifd0-Artist", "exif-ifd0-Orientation"}
+
+// 动图的帧延迟、循环次数和 GIF 调色板不属于元数据，任何策略都保留
+var animationFields = []string{"delay", "loop", "gif-palette"}
+
+// 按元数据策略删除 libvips 中的元数据字段，返回导出时是否还需要编码器 strip
+// 编码器的 strip 会连同 ICC 配置文件一起删除，需要保留配置文件时改为自行删除其余元数据
+func applyMetadataPolicy(img *vips.ImageRef, extraParams config.ExtraParams) bool {
+	policy := extraParams.MetadataPolicy()
+	switch policy {
+	case config.MetadataKeep:
+		return false
+	case config.MetadataStrip:
+		if config.Config.ColorManagement == config.ColorManagementOff || !img.HasICCProfile() {
+			return true
+		}
+		if err := img.RemoveMetadata(animationFields...); err != nil {
+			log.Warnf("移除元数据失败: %v", err)
+			return true
+		}
+		return false
+	}
+
+	// 保存时 libvips 会用 exif-* 字段更新 exif-data，两者都要按策略处理
+	keep := slices.Clone(animationFields)
+	if exif := img.GetBlob("exif-data"); len(exif) > 0 {
+		filtered, err := helper.FilterExif(exif, policy)
+		if err != nil {
+			log.Warnf("处理 EXIF 失败，删除整个 EXIF: %v", err)
+		} else if filtered != nil {
+			img.SetBlob("exif-data", filtered)
+			keep = append(keep, "exif-data")
+		}
+	}
+	for _, field := range img.GetFields() {
+		switch policy {
+		case config.MetadataCopyright:
+			if slices.Contains(copyrightFields, field) {
+				keep = append(keep, field)
+			}
+		case config.MetadataNoGPS:
+			// exif-ifd3 为 GPS IFD，XMP 中也可能包含位置信息
+			if !strings.HasPrefix(field, "exif-ifd3-") && field != "xmp-data" && field != "exif-data" {
+				keep = append(keep, field)
+			}
+		}
+	}
+	if err := img.RemoveMetadata(keep...); err != nil {
+		log.Warnf("移除元数据失败: %v", err)
+		return true
+	}
+	return false
+}
+
+// 复制原图时同样遵守元数据策略
+// 无法直接处理原图中的元数据（格式不支持或结构异常）时，用 libvips 按原格式重新编码并删除元数据，不会原样复制
+func CopyOriginal(rawPath, optimizedPath string, extraParams config.ExtraParams) error {
+	err := helper.CopyOriginal(rawPath, optimizedPath, extraParams.MetadataPolicy())
+	if err == nil {
+		return nil
+	}
+	log.Warnf("无法直接处理原图的元数据，重新编码: %s, %v", rawPath, err)
+	img, err := vips.LoadImageFromFile(rawPath, importParams(rawPath, extraParams))
+	if err != nil {
+		return err
+	}
+	defer img.Close()
+	return nativeEncoder(img, rawPath, optimizedPath, extraParams)
+}
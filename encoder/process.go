@@ -2,6 +2,7 @@ package encoder
 
 import (
 	"errors"
+	"math"
 	"os"
 	"path"
 	"slices"
@@ -69,10 +70,15 @@ func resizeImage(img *vips.ImageRef, extraParams config.ExtraParams) error {
 		}
 	}
 
+	// without_enlargement 时只允许缩小
+	size := vips.SizeBoth
+	if extraParams.WithoutEnlargement {
+		size = vips.SizeDown
+	}
+
 	if extraParams.Width > 0 && extraParams.Height > 0 {
-		log.Infof("使用指定的Width和Height调整大小: %dx%d", extraParams.Width, extraParams.Height)
-		cropInteresting := getCropInteresting()
-		err := img.Thumbnail(extraParams.Width, extraParams.Height, cropInteresting)
+		log.Infof("使用指定的Width和Height调整大小: %dx%d, fit=%s", extraParams.Width, extraParams.Height, extraParams.Fit)
+		err := resizeWithFit(img, extraParams, size)
 		if err != nil {
 			log.Errorf("调整大小失败: %v", err)
 			return err
@@ -82,7 +88,7 @@ func resizeImage(img *vips.ImageRef, extraParams config.ExtraParams) error {
 	if extraParams.Width > 0 && extraParams.Height == 0 {
 		newHeight := int(float32(extraParams.Width) * imgHeightWidthRatio)
 		log.Infof("仅使用Width调整大小: %dx%d", extraParams.Width, newHeight)
-		err := img.Thumbnail(extraParams.Width, newHeight, 0)
+		err := img.ThumbnailWithSize(extraParams.Width, newHeight, 0, size)
 		if err != nil {
 			log.Errorf("调整大小失败: %v", err)
 			return err
@@ -92,7 +98,7 @@ func resizeImage(img *vips.ImageRef, extraParams config.ExtraParams) error {
 	if extraParams.Height > 0 && extraParams.Width == 0 {
 		newWidth := int(float32(extraParams.Height) / imgHeightWidthRatio)
 		log.Infof("仅使用Height调整大小: %dx%d", newWidth, extraParams.Height)
-		err := img.Thumbnail(newWidth, extraParams.Height, 0)
+		err := img.ThumbnailWithSize(newWidth, extraParams.Height, 0, size)
 		if err != nil {
 			log.Errorf("调整大小失败: %v", err)
 			return err
@@ -103,9 +109,206 @@ func resizeImage(img *vips.ImageRef, extraParams config.ExtraParams) error {
 	return nil
 }
 
-func getCropInteresting() vips.Interesting {
+// 同时指定宽高时按 fit 调整大小
+func resizeWithFit(img *vips.ImageRef, extraParams config.ExtraParams, size vips.Size) error {
+	width, height := extraParams.Width, extraParams.Height
+
+	switch extraParams.Fit {
+	case config.FitContain:
+		if err := img.ThumbnailWithSize(width, height, vips.InterestingNone, size); err != nil {
+			return err
+		}
+		if img.Width() == width && img.Height() == height {
+			return nil
+		}
+		// 不放大时原图可能比目标尺寸小，此时不填充到目标尺寸
+		if extraParams.WithoutEnlargement && img.Width() < width && img.Height() < height {
+			return nil
+		}
+		return embedWithBackground(img, width, height, extraParams.Background)
+	case config.FitFill:
+		if extraParams.WithoutEnlargement && img.Width() <= width && img.Height() <= height {
+			return nil
+		}
+		return img.ThumbnailWithSize(width, height, vips.InterestingNone, vips.SizeForce)
+	case config.FitInside:
+		return img.ThumbnailWithSize(width, height, vips.InterestingNone, size)
+	case config.FitOutside:
+		scale := max(float64(width)/float64(img.Width()), float64(height)/float64(img.Height()))
+		newWidth := int(math.Round(float64(img.Width()) * scale))
+		newHeight := int(math.Round(float64(img.Height()) * scale))
+		return img.ThumbnailWithSize(newWidth, newHeight, vips.InterestingNone, size)
+	default:
+		if extraParams.Focal != nil {
+			return coverWithFocalPoint(img, width, height, extraParams.Focal, size)
+		}
+		return img.ThumbnailWithSize(width, height, getCropInteresting(extraParams), size)
+	}
+}
+
+// 先缩放到刚好覆盖目标尺寸，再以焦点为中心裁剪
+func coverWithFocalPoint(img *vips.ImageRef, width, height int, focal *config.FocalPoint, size vips.Size) error {
+	scale := max(float64(width)/float64(img.Width()), float64(height)/float64(img.Height()))
+	if scale > 1 && size == vips.SizeDown {
+		scale = 1
+	}
+	newWidth := int(math.Ceil(float64(img.Width()) * scale))
+	newHeight := int(math.Ceil(float64(img.Height()) * scale))
+	if err := img.ThumbnailWithSize(newWidth, newHeight, vips.InterestingNone, vips.SizeForce); err != nil {
+		return err
+	}
+
+	width, height = min(width, img.Width()), min(height, img.Height())
+	left := clamp(int(focal.X*float64(img.Width()))-width/2, 0, img.Width()-width)
+	top := clamp(int(focal.Y*float64(img.Height()))-height/2, 0, img.Height()-height)
+	log.Infof("按焦点裁剪: 焦点=(%.2f, %.2f), 区域=%dx%d+%d+%d", focal.X, focal.Y, width, height, left, top)
+	return img.ExtractArea(left, top, width, height)
+}
+
+// 缩放前按 crop 参数裁剪，超出图像的部分会被截掉
+func cropImage(img *vips.ImageRef, crop *config.CropRect) error {
+	x, y, w, h := crop.X, crop.Y, crop.Width, crop.Height
+	if crop.Percent {
+		x = x * float64(img.Width()) / 100
+		w = w * float64(img.Width()) / 100
+		y = y * float64(img.Height()) / 100
+		h = h * float64(img.Height()) / 100
+	}
+
+	left := clamp(int(math.Round(x)), 0, img.Width()-1)
+	top := clamp(int(math.Round(y)), 0, img.Height()-1)
+	width := clamp(int(math.Round(w)), 1, img.Width()-left)
+	height := clamp(int(math.Round(h)), 1, img.Height()-top)
+	log.Infof("裁剪图像: %dx%d+%d+%d", width, height, left, top)
+	return img.ExtractArea(left, top, width, height)
+}
+
+func clamp(value, lower, upper int) int {
+	return max(lower, min(value, upper))
+}
+
+// 将图像居中放入 width x height 的画布，空白部分用背景色填充
+func embedWithBackground(img *vips.ImageRef, width, height int, background string) error {
+	color, err := prepareBackground(img, background)
+	if err != nil {
+		return err
+	}
+	left := (width - img.Width()) / 2
+	top := (height - img.Height()) / 2
+	return img.EmbedBackgroundRGBA(left, top, width, height, color)
+}
+
+// 请求未指定背景色时使用配置中的 BACKGROUND
+func resolveBackground(background string) string {
+	if background != "" {
+		return background
+	}
+	background, _ = helper.NormalizeHexColor(config.Config.Background)
+	return background
+}
+
+// 解析背景色（默认使用 BACKGROUND），并让图像的通道数能够容纳该颜色
+func prepareBackground(img *vips.ImageRef, background string) (*vips.ColorRGBA, error) {
+	r, g, b, a := helper.ParseHexColor(resolveBackground(background))
+	// 灰度图只有 1-2 个通道，先转换到 sRGB 才能使用彩色背景
+	if img.Bands() < 3 {
+		if err := img.ToColorSpace(vips.InterpretationSRGB); err != nil {
+			return nil, err
+		}
+	}
+	if a < 255 && !img.HasAlpha() {
+		if err := img.AddAlpha(); err != nil {
+			return nil, err
+		}
+	}
+	return &vips.ColorRGBA{R: r, G: g, B: b, A: a}, nil
+}
+
+// 输出格式是否能保存透明通道
+func supportsAlpha(imageType string) bool {
+	return imageType != config.FormatJpeg
+}
+
+// 去掉透明通道，透明部分显示为背景色（忽略背景色自身的透明度）
+func flattenAlpha(img *vips.ImageRef, background string) error {
+	r, g, b, _ := helper.ParseHexColor(resolveBackground(background))
+	return img.Flatten(&vips.Color{R: r, G: g, B: b})
+}
+
+// 图像是否含有非完全不透明的像素，只有 alpha 通道但全部不透明时不算
+func hasMeaningfulAlpha(img *vips.ImageRef) (bool, error) {
+	if !img.HasAlpha() {
+		return false, nil
+	}
+	alpha, err := img.Copy()
+	if err != nil {
+		return false, err
+	}
+	defer alpha.Close()
+	if err := alpha.ExtractBand(img.Bands()-1, 1); err != nil {
+		return false, err
+	}
+	// 平均值低于最大值说明至少有一个像素不是完全不透明
+	average, err := alpha.Average()
+	if err != nil {
+		return false, err
+	}
+	opaque := 255.0
+	if img.BandFormat() == vips.BandFormatUshort {
+		opaque = 65535
+	}
+	return average < opaque, nil
+}
+
+// 按 rotate、flip、flop 的顺序调整方向
+func orientImage(img *vips.ImageRef, extraParams config.ExtraParams) error {
+	switch extraParams.Rotate {
+	case 0:
+	case 90:
+		if err := img.Rotate(vips.Angle90); err != nil {
+			return err
+		}
+	case 180:
+		if err := img.Rotate(vips.Angle180); err != nil {
+			return err
+		}
+	case 270:
+		if err := img.Rotate(vips.Angle270); err != nil {
+			return err
+		}
+	default:
+		// 任意角度旋转后画布变大，四角用背景色填充
+		color, err := prepareBackground(img, extraParams.Background)
+		if err != nil {
+			return err
+		}
+		if err := img.Similarity(1, extraParams.Rotate, color, 0, 0, 0, 0); err != nil {
+			return err
+		}
+	}
+
+	if extraParams.Flip {
+		if err := img.Flip(vips.DirectionVertical); err != nil {
+			return err
+		}
+	}
+	if extraParams.Flop {
+		if err := img.Flip(vips.DirectionHorizontal); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 请求参数 interesting 优先于全局配置 EXTRA_PARAMS_CROP_INTERESTING
+func getCropInteresting(extraParams config.ExtraParams) vips.Interesting {
+	interesting := config.Config.ExtraParamsCropInteresting
+	if extraParams.Interesting != "" {
+		interesting = extraParams.Interesting
+	}
+
 	cropInteresting := vips.InterestingAttention
-	switch config.Config.ExtraParamsCropInteresting {
+	switch interesting {
 	case "InterestingNone":
 		cropInteresting = vips.InterestingNone
 	case "InterestingCentre":
@@ -121,7 +324,7 @@ func getCropInteresting() vips.Interesting {
 	case "InterestingAll":
 		cropInteresting = vips.InterestingAll
 	}
-	log.Infof("使用裁剪策略: %s", config.Config.ExtraParamsCropInteresting)
+	log.Infof("使用裁剪策略: %s", interesting)
 	return cropInteresting
 }
 
@@ -150,10 +353,10 @@ func ResizeItself(raw, dest string, extraParams config.ExtraParams) {
 		return
 	}
 
-	// 移除元数据（如果配置要求）
-	if config.Config.StripMetadata {
+	// 按元数据策略移除元数据，原格式导出时不会 strip
+	if applyMetadataPolicy(img, extraParams) {
 		log.Debug("正在移除图像元数据")
-		img.RemoveMetadata()
+		img.RemoveMetadata(animationFields...)
 	}
 
 	// 导出图像
@@ -183,7 +386,7 @@ func preProcessImage(img *vips.ImageRef, imageType string, extraParams config.Ex
 	// 检查宽度/高度并忽略特定图像格式
 	switch imageType {
 	case "webp":
-		if img.Metadata().Width > config.WebpMax || img.Metadata().Height > config.WebpMax {
+		if img.Metadata().Width > config.WebpMax || img.PageHeight() > config.WebpMax {
 			log.Warnf("WebP图像尺寸超限: 宽度=%d, 高度=%d, 最大限制=%d", img.Metadata().Width, img.Metadata().Height, config.WebpMax)
 			shouldCopyOriginal = true
 			return shouldCopyOriginal, errors.New("WebP：图像太大")
@@ -194,7 +397,7 @@ func preProcessImage(img *vips.ImageRef, imageType string, extraParams config.Ex
 			return shouldCopyOriginal, errors.New("WebP 编码器：忽略图像类型")
 		}
 	case "avif":
-		if img.Metadata().Width > config.AvifMax || img.Metadata().Height > config.AvifMax {
+		if img.Metadata().Width > config.AvifMax || img.PageHeight() > config.AvifMax {
 			log.Warnf("AVIF图像尺寸超限: 宽度=%d, 高度=%d, 最大限制=%d", img.Metadata().Width, img.Metadata().Height, config.AvifMax)
 			shouldCopyOriginal = true
 			return shouldCopyOriginal, errors.New("AVIF：图像太大")
@@ -206,32 +409,122 @@ func preProcessImage(img *vips.ImageRef, imageType string, extraParams config.Ex
 		}
 	}
 
-	// 自动旋转
-	if err := img.AutoRotate(); err != nil {
-		log.Errorf("图像自动旋转失败: %v", err)
-		shouldCopyOriginal = true
+	// 色彩转换在所有像素操作之前进行，背景色、水印等都按 sRGB 合成
+	if err := manageColour(img, imageType, extraParams); err != nil {
+		log.Errorf("色彩转换失败: %v", err)
+		return shouldCopyOriginal, err
+	}
+
+	// 预设不受 ENABLE_EXTRA_PARAMS 限制
+	extraParamsEnabled := config.Config.EnableExtraParams || extraParams.Preset != ""
+
+	// 不能保存动图的格式只输出第一帧
+	state := &frameState{animated: frameCount(img) > 1}
+	defer state.close()
+	if state.animated && !supportsAnimation(imageType) {
+		log.Debugf("%s 不支持动图，只输出第一帧", imageType)
+		if err := firstFrame(img); err != nil {
+			log.Errorf("提取第一帧失败: %v", err)
+			return shouldCopyOriginal, err
+		}
+		state.animated = false
+	}
+	// 智能裁剪在每一帧上得到的区域不同，动图改为居中裁剪
+	if state.animated && extraParams.Focal == nil {
+		extraParams.Interesting = "InterestingCentre"
+	}
+
+	// 动图逐帧处理，缩放、裁剪和叠加都作用在单帧上，而不是所有帧纵向拼接成的整张图上
+	err := mapFrames(img, func(frame *vips.ImageRef) error {
+		copyOriginal, err := processFrame(frame, extraParams, extraParamsEnabled, state)
+		shouldCopyOriginal = shouldCopyOriginal || copyOriginal
+		return err
+	})
+	if err != nil {
 		return shouldCopyOriginal, err
 	}
-	log.Debug("图像自动旋转完成")
 
-	// 额外参数处理
-	if config.Config.EnableExtraParams {
+	// JPEG 等不支持透明的格式，将透明部分合成到背景色上，避免编码器自行填充黑色
+	if img.HasAlpha() && !supportsAlpha(imageType) {
+		if err := flattenAlpha(img, extraParams.Background); err != nil {
+			log.Errorf("合成透明背景失败: %v", err)
+			return shouldCopyOriginal, err
+		}
+	}
+
+	// log.Debug("图像预处理完成")
+	return shouldCopyOriginal, nil
+}
+
+// 处理单帧（静态图即整张图）：自动旋转、方向、去边、裁剪、缩放、滤镜、水印和文字
+func processFrame(img *vips.ImageRef, extraParams config.ExtraParams, extraParamsEnabled bool, state *frameState) (bool, error) {
+	// 自动旋转
+	if !extraParamsEnabled || !extraParams.NoAutoRotate {
+		if err := img.AutoRotate(); err != nil {
+			log.Errorf("图像自动旋转失败: %v", err)
+			return true, err
+		}
+		log.Debug("图像自动旋转完成")
+	}
+
+	// 额外参数处理，顺序为：旋转 -> 翻转 -> 去边 -> 裁剪 -> 缩放 -> 锐化
+	if extraParamsEnabled {
+		if err := orientImage(img, extraParams); err != nil {
+			log.Errorf("调整图像方向失败: %v", err)
+			return false, err
+		}
+
+		if extraParams.Trim != nil {
+			if err := trimImage(img, extraParams.Trim, state); err != nil {
+				log.Errorf("去除边框失败: %v", err)
+				return false, err
+			}
+		}
+
+		// 裁剪在缩放之前进行，坐标基于旋转和翻转后的图像
+		if extraParams.Crop != nil {
+			if err := cropImage(img, extraParams.Crop); err != nil {
+				log.Errorf("裁剪图像失败: %v", err)
+				return false, err
+			}
+		}
+
 		// 检查是否需要进行尺寸调整
 		if extraParams.MaxWidth != 0 || extraParams.MaxHeight != 0 || extraParams.Width != 0 || extraParams.Height != 0 {
 			log.Debug("开始应用额外图像处理参数")
 			if err := resizeImage(img, extraParams); err != nil {
 				log.Errorf("应用额外图像处理参数失败: %v", err)
 				// 这里不设置 shouldCopyOriginal 为 true，因为我们不想在这种情况下复制原图
-				return shouldCopyOriginal, err
+				return false, err
 			}
 			log.Debug("额外图像处理参数应用完成")
 		} else {
 			log.Debug("未设置任何尺寸参数，跳过图像尺寸调整")
 		}
+
+		// 滤镜在缩放之后进行，锐化可以弥补缩略图的模糊
+		if err := applyFilters(img, extraParams.Filters); err != nil {
+			log.Errorf("应用滤镜失败: %v", err)
+			return false, err
+		}
 	}
 
-	// log.Debug("图像预处理完成")
-	return shouldCopyOriginal, nil
+	// 水印由前缀配置决定，不受 ENABLE_EXTRA_PARAMS 限制，叠加在缩放和滤镜之后的图像上
+	if extraParams.Watermark != nil {
+		if err := applyWatermark(img, extraParams.Watermark, state); err != nil {
+			log.Errorf("添加水印失败: %v", err)
+			return false, err
+		}
+	}
+
+	// 文字叠加在水印之上
+	if extraParamsEnabled && extraParams.Text != nil {
+		if err := applyText(img, extraParams.Text); err != nil {
+			log.Errorf("添加文字失败: %v", err)
+			return false, err
+		}
+	}
+	return false, nil
 }
 
 func ProcessAndSaveImage(rawImageAbs, exhaustFilename string, extraParams config.ExtraParams) error {
@@ -251,34 +544,43 @@ func ProcessAndSaveImage(rawImageAbs, exhaustFilename string, extraParams config
 	}
 	originalSize := originalInfo.Size()
 
-	// 如果原始图像是 NEF 格式，先转换为 JPG
-	if strings.HasSuffix(strings.ToLower(rawImageAbs), ".nef") {
-		tempJPG, converted := ConvertRawToJPG(rawImageAbs, exhaustFilename)
-		if converted {
-			defer func() {
-				log.Infoln("移除中间转换文件:", tempJPG)
-				if err := os.Remove(tempJPG); err != nil {
-					log.Warnln("删除转换文件失败", err)
-				}
-			}()
-			rawImageAbs = tempJPG
+	// 相机 RAW 先转换为中间文件
+	decodedPath, cleanup, err := prepareRaw(rawImageAbs)
+	if err != nil {
+		log.Warn(err)
+		return err
+	}
+	defer cleanup()
+	// RAW 在请求时只检查了字节数，像素数在转换出的中间文件上检查
+	if decodedPath != rawImageAbs {
+		if err := helper.CheckInputLimits(decodedPath); err != nil {
+			log.Warnf("拒绝处理图像 %s: %v", rawImageAbs, err)
+			return err
 		}
+		rawImageAbs = decodedPath
 	}
 
 	// 加载图像
-	img, err := vips.LoadImageFromFile(rawImageAbs, &vips.ImportParams{
-		FailOnError: boolFalse,
-		NumPages:    intMinusOne,
-	})
+	img, err := vips.LoadImageFromFile(rawImageAbs, importParams(rawImageAbs, extraParams))
 	if err != nil {
 		log.Warnf("无法打开源图像: %v", err)
 		return err
 	}
 	defer img.Close()
 
-	// 确定输出格式
+	// 确定输出格式，请求参数 format 优先
 	var imageType string
 	switch {
+	case extraParams.Format == config.FormatOriginal:
+		imageType = originalFormat(img)
+	case extraParams.Format != "":
+		imageType = extraParams.Format
+	case extraParams.Fallback != "":
+		// 客户端不支持 WebP：动图使用回退格式，静态图使用 PNG
+		imageType = config.FormatPng
+		if frameCount(img) > 1 {
+			imageType = extraParams.Fallback
+		}
 	case strings.HasSuffix(exhaustFilename, ".avif"):
 		imageType = "avif"
 	case strings.HasSuffix(exhaustFilename, ".jxl"):
@@ -291,9 +593,9 @@ func ProcessAndSaveImage(rawImageAbs, exhaustFilename string, extraParams config
 	shouldCopyOriginal, err := preProcessImage(img, imageType, extraParams)
 	if err != nil {
 		log.Warnf("预处理源图像时出错: %v", err)
-		if shouldCopyOriginal {
+		if shouldCopyOriginal && extraParams.CanServeOriginal() {
 			log.Infof("由于预处理错误，将复制原图")
-			return helper.CopyFile(rawImageAbs, exhaustFilename)
+			return CopyOriginal(rawImageAbs, exhaustFilename, extraParams)
 		}
 		// 如果不应该复制原图，就返回错误
 		return err
@@ -303,16 +605,34 @@ func ProcessAndSaveImage(rawImageAbs, exhaustFilename string, extraParams config
 	var encoderErr error
 	switch imageType {
 	case "webp":
-		encoderErr = webpEncoder(img, rawImageAbs, exhaustFilename)
+		encoderErr = webpEncoder(img, rawImageAbs, exhaustFilename, extraParams)
 	case "avif":
-		encoderErr = avifEncoder(img, rawImageAbs, exhaustFilename)
+		encoderErr = avifEncoder(img, rawImageAbs, exhaustFilename, extraParams)
 	case "jxl":
-		encoderErr = jxlEncoder(img, rawImageAbs, exhaustFilename)
+		encoderErr = jxlEncoder(img, rawImageAbs, exhaustFilename, extraParams)
+	case config.FormatJpeg:
+		encoderErr = jpegEncoder(img, rawImageAbs, exhaustFilename, extraParams)
+	case config.FormatPng:
+		encoderErr = pngEncoder(img, rawImageAbs, exhaustFilename, extraParams)
+	case config.FormatGif:
+		encoderErr = gifEncoder(img, rawImageAbs, exhaustFilename, extraParams)
+	case config.FormatApng:
+		encoderErr = apngEncoder(img, rawImageAbs, exhaustFilename, extraParams)
+	default:
+		encoderErr = nativeEncoder(img, rawImageAbs, exhaustFilename, extraParams)
 	}
 
 	if encoderErr != nil {
 		log.Errorf("图像编码失败: %v", encoderErr)
-		return helper.CopyFile(rawImageAbs, exhaustFilename) // 这里可以考虑复制原图
+		if !extraParams.CanServeOriginal() {
+			return encoderErr
+		}
+		return CopyOriginal(rawImageAbs, exhaustFilename, extraParams) // 这里可以考虑复制原图
+	}
+
+	// 请求了变换、格式或水印，或客户端不支持原图格式时，即使转换后更大也不回退到原图
+	if !extraParams.CanServeOriginal() {
+		return nil
 	}
 
 	// 比较转换后的文件大小
@@ -329,7 +649,7 @@ func ProcessAndSaveImage(rawImageAbs, exhaustFilename string, extraParams config
 			log.Warnf("删除大的转换文件失败: %v", err)
 		}
 		// 将原图复制到 EXHAUST_PATH
-		if err := helper.CopyFile(rawImageAbs, exhaustFilename); err != nil {
+		if err := CopyOriginal(rawImageAbs, exhaustFilename, extraParams); err != nil {
 			log.Errorf("复制原图到 EXHAUST_PATH 失败: %v", err)
 			return err
 		}
@@ -1,27 +1,76 @@
 package encoder
 
 import (
-	"path/filepath"
+	"errors"
+	"fmt"
+	"os"
+	"webp_server_go/config"
+	"webp_server_go/helper"
 
-	"github.com/jeremytorres/rawparser"
+	"github.com/davidbyttow/govips/v2/vips"
+	log "github.com/sirupsen/logrus"
 )
 
-// ConvertRawToJPG 将原始图像文件转换为JPEG格式，并保存到优化路径。
-// rawPath: 原始图像文件的路径。
-// optimizedPath: 转换后的JPEG文件保存路径。
-// 返回值: 成功时返回转换后的JPEG文件路径和true；失败时返回原始路径和false。
+// 完整解码时 vips_thumbnail 的目标尺寸，只缩小不放大，相当于不缩放
+const rawFullSize = 1 << 20
 
-func ConvertRawToJPG(rawPath, optimizedPath string) (string, bool) {
-	parser, _ := rawparser.NewNefParser(true)
-	info := &rawparser.RawFileInfo{
-		File:    rawPath,
-		Quality: 100,
-		DestDir: optimizedPath,
-	}
-	_, err := parser.ProcessFile(info)
-	if err == nil {
-		_, file := filepath.Split(rawPath)
-		return optimizedPath + file + "_extracted.jpg", true
-	}
-	return rawPath, false
+// 把 RAW 文件转换为 libvips 可以直接加载的中间文件，保存在 TEMP_PATH 中
+// 返回实际要加载的文件和清理函数；不是 RAW 文件时原样返回
+// RAW_DECODE 决定先尝试内嵌预览还是完整解码，失败时再尝试另一种
+func prepareRaw(rawPath string) (string, func(), error) {
+	decoder := helper.DetectRaw(rawPath)
+	if decoder == nil {
+		return rawPath, func() {}, nil
+	}
+
+	decoders := []func(string, *helper.RawDecoder) (string, error){extractRawPreview, demosaicRaw}
+	if config.Config.RawDecode == config.RawDecodeFull {
+		decoders = []func(string, *helper.RawDecoder) (string, error){demosaicRaw, extractRawPreview}
+	}
+	for _, decode := range decoders {
+		decoded, err := decode(rawPath, decoder)
+		if err != nil {
+			log.Debugf("%s: %v", rawPath, err)
+			continue
+		}
+		return decoded, func() {
+			if err := os.Remove(decoded); err != nil {
+				log.Warnln("删除转换文件失败", err)
+			}
+		}, nil
+	}
+	return "", nil, fmt.Errorf("无法解码 %s 图像: %s", decoder.Name, rawPath)
+}
+
+// 提取相机内嵌的 JPEG 预览
+func extractRawPreview(rawPath string, decoder *helper.RawDecoder) (string, error) {
+	data, err := os.ReadFile(rawPath)
+	if err != nil {
+		return "", err
+	}
+	preview := helper.ExtractRawPreview(decoder, data)
+	if preview == nil {
+		return "", fmt.Errorf("%s 中没有可用的内嵌预览", decoder.Name)
+	}
+	log.Debugf("使用 %s 内嵌预览: %s", decoder.Name, rawPath)
+	return helper.WriteTempFile("raw-*.jpg", preview)
+}
+
+// 由 libvips 按文件内容选择加载器完整解码，需要 libvips 编译了 libraw（或 ImageMagick）支持
+// 没有这些支持时 TIFF 类 RAW 会被当作普通 TIFF 只读到缩略图，这种结果不使用
+func demosaicRaw(rawPath string, decoder *helper.RawDecoder) (string, error) {
+	img, err := vips.LoadThumbnailFromFile(rawPath, rawFullSize, rawFullSize, vips.InterestingNone, vips.SizeDown, nil)
+	if err != nil {
+		return "", err
+	}
+	defer img.Close()
+	if img.Format() == vips.ImageTypeTIFF {
+		return "", errors.New("libvips 不支持完整解码 " + decoder.Name)
+	}
+	buf, _, err := img.ExportTiff(vips.NewTiffExportParams())
+	if err != nil {
+		return "", err
+	}
+	log.Debugf("使用 libvips 完整解码 %s: %s", decoder.Name, rawPath)
+	return helper.WriteTempFile("raw-*.tif", buf)
 }
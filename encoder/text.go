@@ -0,0 +1,161 @@
+package encoder
+
+/*
+#cgo pkg-config: vips
+#include <stdlib.h>
+#include <vips/vips.h>
+
+// 将文字渲染为单通道蒙版并编码为 PNG，fontfile 为 NULL 时只使用系统字体
+static int render_text_png(const char *text, const char *font, const char *fontfile, int width, void **buf, size_t *len) {
+	VipsImage *out = NULL;
+	int ret;
+	if (fontfile != NULL) {
+		ret = vips_text(&out, text, "font", font, "width", width, "dpi", 72, "fontfile", fontfile, NULL);
+	} else {
+		ret = vips_text(&out, text, "font", font, "width", width, "dpi", 72, NULL);
+	}
+	if (ret != 0) {
+		return ret;
+	}
+	ret = vips_pngsave_buffer(out, buf, len, NULL);
+	g_object_unref(out);
+	return ret;
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"unsafe"
+	"webp_server_go/config"
+	"webp_server_go/helper"
+
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+const defaultTextSize = 24
+
+// 按 TextOverlay 渲染文字（可选描边）并叠加到图像上
+func applyText(img *vips.ImageRef, overlay *config.TextOverlay) error {
+	size := overlay.Size
+	if size == 0 {
+		size = defaultTextSize
+	}
+	mask, err := renderText(overlay.Text, size, img.Width()-2*overlay.Padding)
+	if err != nil {
+		return err
+	}
+	defer mask.Close()
+
+	// 四周留出描边的空间，文字和描边使用同一坐标
+	stroke := overlay.StrokeWidth
+	width, height := mask.Width()+2*stroke, mask.Height()+2*stroke
+	if err := mask.Embed(stroke, stroke, width, height, vips.ExtendBlack); err != nil {
+		return err
+	}
+
+	hadAlpha := img.HasAlpha()
+	if img.Bands() < 3 {
+		if err := img.ToColorSpace(vips.InterpretationSRGB); err != nil {
+			return err
+		}
+	}
+	x, y := gravityPosition(overlay.Gravity, overlay.Padding, overlay.Padding, img.Width(), img.Height(), width, height)
+
+	if stroke > 0 {
+		strokeMask, err := mask.Copy()
+		if err != nil {
+			return err
+		}
+		defer strokeMask.Close()
+		// 模糊后增强，近似向外膨胀 stroke 像素
+		if err := strokeMask.GaussianBlur(float64(stroke) / 2); err != nil {
+			return err
+		}
+		if err := strokeMask.Linear1(4, 0); err != nil {
+			return err
+		}
+		if err := strokeMask.Cast(vips.BandFormatUchar); err != nil {
+			return err
+		}
+		if err := compositeMask(img, strokeMask, overlay.StrokeColor, "000000", x, y); err != nil {
+			return err
+		}
+	}
+	if err := compositeMask(img, mask, overlay.Color, "ffffff", x, y); err != nil {
+		return err
+	}
+
+	if !hadAlpha && img.HasAlpha() {
+		return img.ExtractBand(0, img.Bands()-1)
+	}
+	return nil
+}
+
+// 调用 libvips 的 vips_text 渲染文字，文字按 Pango 标记转义，宽度超过 maxWidth 时换行
+func renderText(text string, size, maxWidth int) (*vips.ImageRef, error) {
+	cText := C.CString(html.EscapeString(text))
+	defer C.free(unsafe.Pointer(cText))
+	cFont := C.CString(fmt.Sprintf("%s %d", config.Config.TextFont, size))
+	defer C.free(unsafe.Pointer(cFont))
+	var cFontFile *C.char
+	if config.Config.TextFontFile != "" {
+		cFontFile = C.CString(config.Config.TextFontFile)
+		defer C.free(unsafe.Pointer(cFontFile))
+	}
+
+	var buf unsafe.Pointer
+	var length C.size_t
+	if C.render_text_png(cText, cFont, cFontFile, C.int(max(maxWidth, 0)), &buf, &length) != 0 {
+		message := C.GoString(C.vips_error_buffer())
+		C.vips_error_clear()
+		return nil, errors.New("渲染文字失败: " + message)
+	}
+	defer C.g_free(C.gpointer(buf))
+	return vips.NewImageFromBuffer(C.GoBytes(buf, C.int(length)))
+}
+
+// 以蒙版为 alpha、单一颜色为内容生成图层并叠加
+func compositeMask(img, mask *vips.ImageRef, color, defaultColor string, x, y int) error {
+	if color == "" {
+		color = defaultColor
+	}
+	r, g, b, a := helper.ParseHexColor(color)
+
+	layer, err := mask.Copy()
+	if err != nil {
+		return err
+	}
+	defer layer.Close()
+	if err := layer.Linear1(0, float64(r)); err != nil {
+		return err
+	}
+	if err := layer.BandJoinConst([]float64{float64(g), float64(b)}); err != nil {
+		return err
+	}
+
+	alpha, err := mask.Copy()
+	if err != nil {
+		return err
+	}
+	defer alpha.Close()
+	if a < 255 {
+		if err := alpha.Linear1(float64(a)/255, 0); err != nil {
+			return err
+		}
+	}
+	if err := layer.BandJoin(alpha); err != nil {
+		return err
+	}
+	if err := layer.Cast(vips.BandFormatUchar); err != nil {
+		return err
+	}
+	srgb, err := layer.CopyChangingInterpretation(vips.InterpretationSRGB)
+	if err != nil {
+		return err
+	}
+	defer srgb.Close()
+	return img.Composite(srgb, vips.BlendModeOver, x, y)
+}
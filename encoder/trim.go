@@ -0,0 +1,75 @@
+package encoder
+
+import (
+	"webp_server_go/config"
+	"webp_server_go/helper"
+
+	"github.com/davidbyttow/govips/v2/vips"
+	log "github.com/sirupsen/logrus"
+)
+
+// 去边后保留的区域
+type trimBox struct {
+	left, top, width, height int
+}
+
+// 去除与背景色相近的均匀边框，背景色未指定时取左上角像素
+// 动图只在明确要求时处理，所有帧使用第一帧检测到的区域
+func trimImage(img *vips.ImageRef, trim *config.TrimParams, state *frameState) error {
+	if state.animated && !trim.Animated {
+		log.Debug("动图未指定 trim_animated，跳过去边")
+		return nil
+	}
+	if !state.trimDetected {
+		box, found, err := findTrimBox(img, trim)
+		if err != nil {
+			return err
+		}
+		state.trimDetected = true
+		if found {
+			state.trimBox = &box
+		}
+	}
+	if state.trimBox == nil {
+		return nil
+	}
+	box := state.trimBox
+	return img.ExtractArea(box.left, box.top, box.width, box.height)
+}
+
+// 在单帧图像上检测边框，没有可去除的边框或整张图都是背景时 found 为 false
+func findTrimBox(img *vips.ImageRef, trim *config.TrimParams) (box trimBox, found bool, err error) {
+	// 在副本上检测，避免为检测而做的色彩空间转换影响输出
+	probe, err := img.Copy()
+	if err != nil {
+		return box, false, err
+	}
+	defer probe.Close()
+	if probe.Interpretation() != vips.InterpretationSRGB {
+		if err := probe.ToColorSpace(vips.InterpretationSRGB); err != nil {
+			return box, false, err
+		}
+	}
+
+	background := &vips.Color{}
+	if trim.Background != "" {
+		background.R, background.G, background.B, _ = helper.ParseHexColor(trim.Background)
+	} else {
+		pixel, err := probe.GetPoint(0, 0)
+		if err != nil {
+			return box, false, err
+		}
+		background.R, background.G, background.B = uint8(pixel[0]), uint8(pixel[1]), uint8(pixel[2])
+	}
+
+	left, top, width, height, err := probe.FindTrim(trim.Threshold, background)
+	if err != nil {
+		return box, false, err
+	}
+	if width <= 0 || height <= 0 || (width == probe.Width() && height == probe.Height()) {
+		log.Debug("未检测到可去除的边框")
+		return box, false, nil
+	}
+	log.Debugf("去边: left=%d top=%d width=%d height=%d", left, top, width, height)
+	return trimBox{left: left, top: top, width: width, height: height}, true, nil
+}
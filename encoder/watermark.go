@@ -0,0 +1,131 @@
+package encoder
+
+import (
+	"strings"
+	"webp_server_go/config"
+
+	"github.com/davidbyttow/govips/v2/vips"
+	log "github.com/sirupsen/logrus"
+)
+
+// 按前缀配置叠加水印，输出尺寸小于 MIN_WIDTH/MIN_HEIGHT 时跳过
+// 所有帧的输出尺寸相同，水印只在第一帧加载、缩放和平铺，保存在 state 中供后续帧使用
+func applyWatermark(img *vips.ImageRef, watermark *config.Watermark, state *frameState) error {
+	if img.Width() < watermark.MinWidth || img.Height() < watermark.MinHeight {
+		log.Debugf("图像尺寸 %dx%d 小于水印最小尺寸，跳过水印", img.Width(), img.Height())
+		return nil
+	}
+
+	if state.watermark == nil {
+		logo, err := loadWatermark(watermark, img.Width())
+		if err != nil {
+			return err
+		}
+		if watermark.Tile {
+			if err := tileWatermark(logo, watermark, img.Width(), img.Height()); err != nil {
+				logo.Close()
+				return err
+			}
+		}
+		state.watermark = logo
+	}
+	logo := state.watermark
+
+	// 叠加需要与水印相同的 sRGB 颜色空间，原图没有 alpha 时叠加后去掉 alpha
+	hadAlpha := img.HasAlpha()
+	if img.Bands() < 3 {
+		if err := img.ToColorSpace(vips.InterpretationSRGB); err != nil {
+			return err
+		}
+	}
+
+	if watermark.Tile {
+		if err := img.Composite(logo, vips.BlendModeOver, 0, 0); err != nil {
+			return err
+		}
+	} else {
+		x, y := gravityPosition(watermark.Gravity, watermark.OffsetX, watermark.OffsetY, img.Width(), img.Height(), logo.Width(), logo.Height())
+		if err := img.Composite(logo, vips.BlendModeOver, x, y); err != nil {
+			return err
+		}
+	}
+
+	if !hadAlpha && img.HasAlpha() {
+		return img.ExtractBand(0, img.Bands()-1)
+	}
+	return nil
+}
+
+// 加载水印图像，按 SCALE 缩放并把 OPACITY 应用到 alpha 通道
+func loadWatermark(watermark *config.Watermark, outputWidth int) (*vips.ImageRef, error) {
+	logo, err := vips.NewImageFromFile(watermark.Image)
+	if err != nil {
+		return nil, err
+	}
+	if err := prepareWatermark(logo, watermark, outputWidth); err != nil {
+		logo.Close()
+		return nil, err
+	}
+	return logo, nil
+}
+
+func prepareWatermark(logo *vips.ImageRef, watermark *config.Watermark, outputWidth int) error {
+	if watermark.Scale > 0 {
+		scale := watermark.Scale * float64(outputWidth) / float64(logo.Width())
+		if err := logo.Resize(scale, vips.KernelAuto); err != nil {
+			return err
+		}
+	}
+	if err := logo.ToColorSpace(vips.InterpretationSRGB); err != nil {
+		return err
+	}
+	if !logo.HasAlpha() {
+		if err := logo.AddAlpha(); err != nil {
+			return err
+		}
+	}
+	if watermark.Opacity > 0 && watermark.Opacity < 1 {
+		if err := logo.Linear([]float64{1, 1, 1, watermark.Opacity}, []float64{0, 0, 0, 0}); err != nil {
+			return err
+		}
+		return logo.Cast(vips.BandFormatUchar)
+	}
+	return nil
+}
+
+// 在水印四周加上 OFFSET 间距后平铺，裁剪到输出尺寸
+func tileWatermark(logo *vips.ImageRef, watermark *config.Watermark, width, height int) error {
+	cellWidth := logo.Width() + watermark.OffsetX
+	cellHeight := logo.Height() + watermark.OffsetY
+	transparent := &vips.ColorRGBA{}
+	if err := logo.EmbedBackgroundRGBA(0, 0, cellWidth, cellHeight, transparent); err != nil {
+		return err
+	}
+	across := (width + cellWidth - 1) / cellWidth
+	down := (height + cellHeight - 1) / cellHeight
+	if err := logo.Replicate(across, down); err != nil {
+		return err
+	}
+	return logo.ExtractArea(0, 0, width, height)
+}
+
+// 根据方位和边距计算叠加层左上角坐标，方位为空时使用右下角
+func gravityPosition(gravity string, offsetX, offsetY, width, height, layerWidth, layerHeight int) (int, int) {
+	if gravity == "" {
+		gravity = "south-east"
+	}
+
+	x := (width - layerWidth) / 2
+	y := (height - layerHeight) / 2
+	if strings.Contains(gravity, "west") {
+		x = offsetX
+	} else if strings.Contains(gravity, "east") {
+		x = width - layerWidth - offsetX
+	}
+	if strings.HasPrefix(gravity, "north") {
+		y = offsetY
+	} else if strings.HasPrefix(gravity, "south") {
+		y = height - layerHeight - offsetY
+	}
+	return x, y
+}
@@ -0,0 +1,49 @@
+package handler
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+	"webp_server_go/cachectl"
+	"webp_server_go/config"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+// 校验管理接口令牌，未配置 ADMIN_TOKEN 时管理接口不可用
+func AdminAuth(c *gin.Context) {
+	if config.Config.AdminToken == "" {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(config.Config.AdminToken)) != 1 {
+		log.Warnf("管理接口认证失败: %s", c.ClientIP())
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "未授权"})
+		return
+	}
+	c.Next()
+}
+
+// POST /admin/purge
+func PurgeCache(c *gin.Context) {
+	var req cachectl.PurgeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "请求体不是有效的 JSON"})
+		return
+	}
+
+	result, err := cachectl.Purge(req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// GET /admin/stats
+func CacheStats(c *gin.Context) {
+	c.JSON(http.StatusOK, cachectl.CollectStats())
+}
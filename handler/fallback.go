@@ -0,0 +1,34 @@
+package handler
+
+import (
+	"path"
+	"strings"
+	"webp_server_go/config"
+	"webp_server_go/helper"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"github.com/valyala/fasthttp"
+)
+
+// 原图为 WebP 而客户端不支持 WebP 时，动图改为 ANIMATED_FALLBACK 指定的格式，静态图改为 PNG
+// 只有 Accept 中列出了图像类型却没有 image/webp 时才认为不支持，curl 等发送 */* 的客户端仍然得到 WebP
+func negotiateFallback(c *gin.Context, reqURI string, extraParams *config.ExtraParams) {
+	if config.Config.AnimatedFallback == "" || extraParams.Format != "" || !strings.EqualFold(path.Ext(reqURI), ".webp") {
+		return
+	}
+	c.Writer.Header().Add("Vary", "Accept")
+
+	accept := c.GetHeader("Accept")
+	if !strings.Contains(strings.ToLower(accept), "image/") {
+		return
+	}
+	var header fasthttp.RequestHeader
+	header.Set("Accept", accept)
+	header.Set("User-Agent", c.GetHeader("User-Agent"))
+	if helper.GuessSupportedFormat(&header)["webp"] {
+		return
+	}
+	log.Debugf("客户端不支持 WebP，使用 %s 回退: %s", config.Config.AnimatedFallback, reqURI)
+	extraParams.Fallback = config.Config.AnimatedFallback
+}
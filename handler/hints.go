@@ -0,0 +1,139 @@
+package handler
+
+import (
+	"fmt"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+	"webp_server_go/config"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+// 服务端接受的 Client Hints，响应中通过 Accept-CH 请求浏览器发送
+var clientHints = []string{"Sec-CH-DPR", "Sec-CH-Width", "Sec-CH-Viewport-Width"}
+
+// 根据 dpr 参数与 Client Hints 计算目标尺寸，返回实际使用的 DPR（未使用时为 0）
+func applyClientHints(c *gin.Context, query url.Values, extraParams *config.ExtraParams) (float64, error) {
+	// 仅允许预设时，尺寸完全由预设决定
+	if config.Config.PresetsOnly {
+		return 0, nil
+	}
+
+	// 尺寸参数只在启用额外参数或使用预设时生效（见 encoder.preProcessImage），
+	// 否则 DPR 和宽度不会改变输出，不写入尺寸，避免拆分缓存键；Save-Data 调整的质量仍然生效
+	if !config.Config.EnableExtraParams && extraParams.Preset == "" {
+		if config.Config.EnableClientHints {
+			c.Header("Vary", "Save-Data")
+			applySaveData(c, extraParams)
+		}
+		return 0, nil
+	}
+
+	var dpr float64
+	if dprParam := query.Get("dpr"); dprParam != "" {
+		value, err := strconv.ParseFloat(dprParam, 64)
+		if err != nil || math.IsNaN(value) || math.IsInf(value, 0) || value <= 0 {
+			return 0, fmt.Errorf("dpr 无效: %s", dprParam)
+		}
+		dpr = value
+	}
+
+	if !config.Config.EnableClientHints {
+		if dpr > 0 {
+			dpr = scaleByDPR(extraParams, dpr)
+		}
+		return dpr, nil
+	}
+
+	c.Header("Accept-CH", strings.Join(clientHints, ", "))
+	c.Header("Vary", strings.Join(append(clientHints, "Save-Data"), ", "))
+
+	applySaveData(c, extraParams)
+
+	if dpr == 0 {
+		dpr = headerFloat(c, "Sec-CH-DPR", "DPR")
+	}
+
+	// 请求中没有指定尺寸时，用布局宽度或视口宽度作为最大宽度（均不放大）
+	if extraParams.Width == 0 && extraParams.Height == 0 && extraParams.MaxWidth == 0 && extraParams.MaxHeight == 0 {
+		// Sec-CH-Width 已经是物理像素
+		if width := headerFloat(c, "Sec-CH-Width", "Width"); width > 0 {
+			extraParams.MaxWidth = snapWidth(int(math.Ceil(width)))
+			log.Debugf("使用 Client Hints 宽度: %v -> %d", width, extraParams.MaxWidth)
+			return dpr, nil
+		}
+		if viewport := headerFloat(c, "Sec-CH-Viewport-Width", "Viewport-Width"); viewport > 0 {
+			extraParams.MaxWidth = snapWidth(int(math.Ceil(viewport * max(dpr, 1))))
+			log.Debugf("使用 Client Hints 视口宽度: %v x %v -> %d", viewport, dpr, extraParams.MaxWidth)
+			return dpr, nil
+		}
+	}
+
+	if dpr > 0 {
+		dpr = scaleByDPR(extraParams, dpr)
+	}
+	return dpr, nil
+}
+
+// 客户端开启 Save-Data 且请求没有指定质量时使用 SAVE_DATA_QUALITY
+func applySaveData(c *gin.Context, extraParams *config.ExtraParams) {
+	if strings.EqualFold(c.GetHeader("Save-Data"), "on") && extraParams.Quality == 0 {
+		extraParams.Quality = config.Config.SaveDataQuality
+	}
+}
+
+// 将请求的 CSS 像素尺寸乘以 DPR，宽度对齐到 WIDTH_BUCKETS，高度按相同比例缩放，没有指定尺寸时返回 0
+func scaleByDPR(extraParams *config.ExtraParams, dpr float64) float64 {
+	if extraParams.Width == 0 && extraParams.Height == 0 && extraParams.MaxWidth == 0 && extraParams.MaxHeight == 0 {
+		return 0
+	}
+	dpr = min(dpr, config.Config.MaxDPR)
+	if dpr <= 1 {
+		return 1
+	}
+
+	scale := func(value int) int {
+		return int(math.Round(float64(value) * dpr))
+	}
+	width, maxWidth := scale(extraParams.Width), scale(extraParams.MaxWidth)
+	if width > 0 {
+		snapped := snapWidth(width)
+		ratio := float64(snapped) / float64(width)
+		extraParams.Width = snapped
+		extraParams.Height = int(math.Round(float64(scale(extraParams.Height)) * ratio))
+	} else {
+		extraParams.Height = scale(extraParams.Height)
+	}
+	if maxWidth > 0 {
+		extraParams.MaxWidth = snapWidth(maxWidth)
+	}
+	extraParams.MaxHeight = scale(extraParams.MaxHeight)
+	return dpr
+}
+
+// 向上对齐到最近的宽度档位，超出最大档位时使用最大档位，避免缓存变体无限增长
+func snapWidth(width int) int {
+	buckets := config.Config.WidthBuckets
+	if len(buckets) == 0 {
+		return width
+	}
+	for _, bucket := range buckets {
+		if bucket >= width {
+			return bucket
+		}
+	}
+	return buckets[len(buckets)-1]
+}
+
+// 读取第一个存在且有效（有限的正数）的浮点数请求头
+func headerFloat(c *gin.Context, names ...string) float64 {
+	for _, name := range names {
+		if value, err := strconv.ParseFloat(c.GetHeader(name), 64); err == nil && value > 0 && !math.IsInf(value, 0) {
+			return value
+		}
+	}
+	return 0
+}
@@ -0,0 +1,129 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"webp_server_go/config"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestSnapWidth(t *testing.T) {
+	withExtraParams(t)
+	config.Config.WidthBuckets = []int{320, 640, 1280}
+	tests := []struct{ width, want int }{
+		{1, 320},
+		{320, 320},
+		{321, 640},
+		{1280, 1280},
+		{5000, 1280},
+	}
+	for _, tt := range tests {
+		if got := snapWidth(tt.width); got != tt.want {
+			t.Errorf("snapWidth(%d) = %d, want %d", tt.width, got, tt.want)
+		}
+	}
+
+	config.Config.WidthBuckets = nil
+	if got := snapWidth(333); got != 333 {
+		t.Errorf("snapWidth() without buckets = %d, want 333", got)
+	}
+}
+
+func TestScaleByDPR(t *testing.T) {
+	withExtraParams(t)
+	config.Config.WidthBuckets = []int{320, 640, 1280}
+	config.Config.MaxDPR = 3
+	tests := []struct {
+		name    string
+		params  config.ExtraParams
+		dpr     float64
+		want    config.ExtraParams
+		wantDPR float64
+	}{
+		{"no sizes", config.ExtraParams{}, 2, config.ExtraParams{}, 0},
+		{"dpr 1", config.ExtraParams{Width: 300}, 1, config.ExtraParams{Width: 300}, 1},
+		{"width snaps and height keeps ratio", config.ExtraParams{Width: 300, Height: 200}, 2, config.ExtraParams{Width: 640, Height: 427}, 2},
+		{"height only", config.ExtraParams{Height: 200}, 1.5, config.ExtraParams{Height: 300}, 1.5},
+		{"max sizes", config.ExtraParams{MaxWidth: 500, MaxHeight: 400}, 2, config.ExtraParams{MaxWidth: 1280, MaxHeight: 800}, 2},
+		{"capped at MAX_DPR", config.ExtraParams{Height: 100}, 5, config.ExtraParams{Height: 300}, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params := tt.params
+			dpr := scaleByDPR(&params, tt.dpr)
+			if params != tt.want || dpr != tt.wantDPR {
+				t.Fatalf("scaleByDPR() = %+v, %v, want %+v, %v", params, dpr, tt.want, tt.wantDPR)
+			}
+		})
+	}
+}
+
+func TestApplyClientHints(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	withExtraParams(t)
+	config.Config.WidthBuckets = []int{320, 640, 1280}
+	config.Config.MaxDPR = 3
+	config.Config.SaveDataQuality = 50
+
+	tests := []struct {
+		name        string
+		extraParams bool
+		clientHints bool
+		query       string
+		headers     map[string]string
+		params      config.ExtraParams
+		want        config.ExtraParams
+		wantDPR     float64
+		wantErr     bool
+	}{
+		{name: "dpr param", extraParams: true, query: "dpr=2", params: config.ExtraParams{Width: 300},
+			want: config.ExtraParams{Width: 640}, wantDPR: 2},
+		{name: "invalid dpr", extraParams: true, query: "dpr=0", wantErr: true},
+		{name: "NaN dpr", extraParams: true, query: "dpr=NaN", wantErr: true},
+		{name: "infinite dpr", extraParams: true, query: "dpr=Inf", wantErr: true},
+		{name: "hints ignored when disabled", extraParams: true, headers: map[string]string{"Sec-CH-DPR": "2", "Save-Data": "on"},
+			params: config.ExtraParams{Width: 300}, want: config.ExtraParams{Width: 300}},
+		{name: "dpr header", extraParams: true, clientHints: true, headers: map[string]string{"Sec-CH-DPR": "2"},
+			params: config.ExtraParams{Width: 300}, want: config.ExtraParams{Width: 640}, wantDPR: 2},
+		{name: "infinite dpr header", extraParams: true, clientHints: true, headers: map[string]string{"Sec-CH-DPR": "Inf"},
+			params: config.ExtraParams{Width: 300}, want: config.ExtraParams{Width: 300}},
+		{name: "width header", extraParams: true, clientHints: true, headers: map[string]string{"Sec-CH-Width": "500"},
+			want: config.ExtraParams{MaxWidth: 640}},
+		{name: "viewport header", extraParams: true, clientHints: true, headers: map[string]string{"Sec-CH-Viewport-Width": "400", "Sec-CH-DPR": "2"},
+			want: config.ExtraParams{MaxWidth: 1280}, wantDPR: 2},
+		{name: "save data", extraParams: true, clientHints: true, headers: map[string]string{"Save-Data": "on"},
+			want: config.ExtraParams{Quality: 50}},
+		{name: "save data keeps explicit quality", extraParams: true, clientHints: true, headers: map[string]string{"Save-Data": "on"},
+			params: config.ExtraParams{Quality: 80}, want: config.ExtraParams{Quality: 80}},
+		// 未开启额外参数时尺寸不生效，只应用 Save-Data
+		{name: "sizes need extra params", clientHints: true, query: "dpr=2", headers: map[string]string{"Sec-CH-Width": "500", "Save-Data": "on"},
+			params: config.ExtraParams{Width: 300}, want: config.ExtraParams{Width: 300, Quality: 50}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.Config.EnableExtraParams = tt.extraParams
+			config.Config.EnableClientHints = tt.clientHints
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = httptest.NewRequest(http.MethodGet, "/a.jpg?"+tt.query, nil)
+			for name, value := range tt.headers {
+				c.Request.Header.Set(name, value)
+			}
+			query, _ := url.ParseQuery(tt.query)
+
+			params := tt.params
+			dpr, err := applyClientHints(c, query, &params)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("applyClientHints() should fail")
+				}
+				return
+			}
+			if err != nil || params != tt.want || dpr != tt.wantDPR {
+				t.Fatalf("applyClientHints() = %+v, %v, %v, want %+v, %v", params, dpr, err, tt.want, tt.wantDPR)
+			}
+		})
+	}
+}
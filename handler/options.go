@@ -0,0 +1,112 @@
+package handler
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"webp_server_go/config"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// 将请求参数限制在 IMG_MAP_OPTIONS 为该前缀配置的范围内并附加水印和元数据策略，拒绝模式下超限返回错误
+func applyPrefixOptions(extraParams *config.ExtraParams, prefix string) error {
+	opts := config.Config.PrefixOptions(prefix)
+
+	if extraParams.Quality > 0 {
+		quality := extraParams.Quality
+		if opts.MinQuality > 0 {
+			quality = max(quality, opts.MinQuality)
+		}
+		if opts.MaxQuality > 0 {
+			quality = min(quality, opts.MaxQuality)
+		}
+		if quality != extraParams.Quality {
+			log.Debugf("前缀 %s 的质量限制为 %d-%d，%d 调整为 %d", prefix, opts.MinQuality, opts.MaxQuality, extraParams.Quality, quality)
+			extraParams.Quality = quality
+		}
+	}
+
+	if extraParams.Format != "" && len(opts.AllowedFormats) > 0 && !slices.Contains(opts.AllowedFormats, extraParams.Format) {
+		log.Debugf("前缀 %s 不允许格式 %s，使用 %s", prefix, extraParams.Format, opts.AllowedFormats[0])
+		extraParams.Format = opts.AllowedFormats[0]
+	}
+
+	extraParams.Watermark = opts.Watermark
+
+	// 预设中的元数据策略优先于前缀配置
+	if extraParams.Metadata == "" {
+		extraParams.Metadata = opts.Metadata
+	}
+
+	reject := opts.OnLimitExceeded == config.LimitReject
+	if err := limitSize(&extraParams.Width, &extraParams.Height, opts, reject); err != nil {
+		return err
+	}
+	return limitSize(&extraParams.MaxWidth, &extraParams.MaxHeight, opts, reject)
+}
+
+// 检查一组宽高（0 表示未指定）：先按最大尺寸和像素数等比缩小，再对齐到允许的宽高
+// 只检查请求的尺寸，旋转、fit=outside 和去边之后的实际输出尺寸不在这里限制
+func limitSize(width, height *int, opts config.PrefixOptions, reject bool) error {
+	w, h := *width, *height
+	if w == 0 && h == 0 {
+		return nil
+	}
+
+	scale := 1.0
+	if opts.MaxOutputWidth > 0 && w > opts.MaxOutputWidth {
+		scale = min(scale, float64(opts.MaxOutputWidth)/float64(w))
+	}
+	if opts.MaxOutputHeight > 0 && h > opts.MaxOutputHeight {
+		scale = min(scale, float64(opts.MaxOutputHeight)/float64(h))
+	}
+	// 只指定一边时乘积为 0，无法在解码前得知像素数；按浮点数计算避免宽高很大时溢出
+	if pixels := float64(w) * float64(h); opts.MaxOutputPixels > 0 && pixels > float64(opts.MaxOutputPixels) {
+		scale = min(scale, math.Sqrt(float64(opts.MaxOutputPixels)/pixels))
+	}
+	if scale < 1 {
+		if reject {
+			return fmt.Errorf("请求尺寸 %dx%d 超出限制", w, h)
+		}
+		w, h = scaleDimension(w, scale), scaleDimension(h, scale)
+	}
+
+	var err error
+	if w, err = snapToAllowed(w, opts.AllowedWidths, reject); err != nil {
+		return fmt.Errorf("不允许的宽度: %v", err)
+	}
+	if h, err = snapToAllowed(h, opts.AllowedHeights, reject); err != nil {
+		return fmt.Errorf("不允许的高度: %v", err)
+	}
+
+	if w != *width || h != *height {
+		log.Debugf("请求尺寸 %dx%d 调整为 %dx%d", *width, *height, w, h)
+		*width, *height = w, h
+	}
+	return nil
+}
+
+// 按比例缩小一边，指定了的边至少保留 1 像素，未指定（0）的边保持为 0
+func scaleDimension(value int, scale float64) int {
+	if value == 0 {
+		return 0
+	}
+	return max(int(float64(value)*scale), 1)
+}
+
+// 对齐到不小于 value 的最小允许值，超过最大允许值时使用最大值
+func snapToAllowed(value int, allowed []int, reject bool) (int, error) {
+	if value == 0 || len(allowed) == 0 || slices.Contains(allowed, value) {
+		return value, nil
+	}
+	if reject {
+		return 0, fmt.Errorf("%d", value)
+	}
+	for _, candidate := range allowed {
+		if candidate >= value {
+			return candidate, nil
+		}
+	}
+	return allowed[len(allowed)-1], nil
+}
@@ -0,0 +1,144 @@
+package handler
+
+import (
+	"testing"
+	"webp_server_go/config"
+)
+
+func TestApplyPrefixOptionsQuality(t *testing.T) {
+	withExtraParams(t)
+	config.Config.ImageMapOpts = map[string]config.PrefixOptions{
+		"/img": {MinQuality: 40, MaxQuality: 80, AllowedFormats: []string{config.FormatWebp, config.FormatJpeg}},
+	}
+	tests := []struct {
+		name   string
+		prefix string
+		params config.ExtraParams
+		want   config.ExtraParams
+	}{
+		{"in range", "/img", config.ExtraParams{Quality: 60, Format: config.FormatJpeg}, config.ExtraParams{Quality: 60, Format: config.FormatJpeg}},
+		{"below min", "/img", config.ExtraParams{Quality: 10}, config.ExtraParams{Quality: 40}},
+		{"above max", "/img", config.ExtraParams{Quality: 95}, config.ExtraParams{Quality: 80}},
+		{"unset quality", "/img", config.ExtraParams{}, config.ExtraParams{}},
+		{"disallowed format", "/img", config.ExtraParams{Format: config.FormatAvif}, config.ExtraParams{Format: config.FormatWebp}},
+		{"unconfigured prefix", "/other", config.ExtraParams{Quality: 95, Format: config.FormatAvif}, config.ExtraParams{Quality: 95, Format: config.FormatAvif}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params := tt.params
+			if err := applyPrefixOptions(&params, tt.prefix); err != nil {
+				t.Fatal(err)
+			}
+			if params.Quality != tt.want.Quality || params.Format != tt.want.Format {
+				t.Fatalf("applyPrefixOptions() = %+v, want %+v", params, tt.want)
+			}
+		})
+	}
+}
+
+func TestLimitSize(t *testing.T) {
+	tests := []struct {
+		name          string
+		width, height int
+		opts          config.PrefixOptions
+		reject        bool
+		wantW, wantH  int
+		wantErr       bool
+	}{
+		{name: "unset", opts: config.PrefixOptions{MaxOutputWidth: 100}},
+		{name: "within limits", width: 100, height: 50, opts: config.PrefixOptions{MaxOutputWidth: 200}, wantW: 100, wantH: 50},
+		{name: "max width keeps ratio", width: 400, height: 200, opts: config.PrefixOptions{MaxOutputWidth: 200}, wantW: 200, wantH: 100},
+		{name: "max height", width: 400, height: 200, opts: config.PrefixOptions{MaxOutputHeight: 50}, wantW: 100, wantH: 50},
+		{name: "single dimension", width: 400, opts: config.PrefixOptions{MaxOutputWidth: 200, MaxOutputPixels: 10}, wantW: 200},
+		{name: "max pixels", width: 400, height: 400, opts: config.PrefixOptions{MaxOutputPixels: 40000}, wantW: 200, wantH: 200},
+		{name: "scaled size at least 1px", width: 10000, height: 1, opts: config.PrefixOptions{MaxOutputWidth: 100}, wantW: 100, wantH: 1},
+		{name: "huge sizes do not overflow", width: 1 << 40, height: 1 << 40, opts: config.PrefixOptions{MaxOutputPixels: 1000000}, wantW: 1000, wantH: 1000},
+		{name: "snap to allowed widths", width: 300, height: 200, opts: config.PrefixOptions{AllowedWidths: []int{320, 640}}, wantW: 320, wantH: 200},
+		{name: "reject oversized", width: 400, height: 200, opts: config.PrefixOptions{MaxOutputWidth: 200}, reject: true, wantErr: true},
+		{name: "reject disallowed width", width: 300, opts: config.PrefixOptions{AllowedWidths: []int{320, 640}}, reject: true, wantErr: true},
+		{name: "reject disallowed height", height: 300, opts: config.PrefixOptions{AllowedHeights: []int{320}}, reject: true, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, h := tt.width, tt.height
+			err := limitSize(&w, &h, tt.opts, tt.reject)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("limitSize() = %dx%d, want an error", w, h)
+				}
+				return
+			}
+			if err != nil || w != tt.wantW || h != tt.wantH {
+				t.Fatalf("limitSize() = %dx%d, %v, want %dx%d", w, h, err, tt.wantW, tt.wantH)
+			}
+		})
+	}
+}
+
+func TestSnapToAllowed(t *testing.T) {
+	allowed := []int{320, 640, 1280}
+	tests := []struct {
+		value   int
+		allowed []int
+		reject  bool
+		want    int
+		wantErr bool
+	}{
+		{0, allowed, true, 0, false},
+		{500, nil, true, 500, false},
+		{640, allowed, true, 640, false},
+		{1, allowed, false, 320, false},
+		{641, allowed, false, 1280, false},
+		{2000, allowed, false, 1280, false},
+		{500, allowed, true, 0, true},
+	}
+	for _, tt := range tests {
+		got, err := snapToAllowed(tt.value, tt.allowed, tt.reject)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("snapToAllowed(%d, %v, %v) = %d, %v, want %d, error %v", tt.value, tt.allowed, tt.reject, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestApplyPrefixOptionsSize(t *testing.T) {
+	withExtraParams(t)
+	config.Config.ImageMapOpts = map[string]config.PrefixOptions{
+		config.DefaultPrefixOptions: {MaxOutputWidth: 1000},
+		"/strict":                   {MaxOutputWidth: 500, OnLimitExceeded: config.LimitReject},
+	}
+
+	params := config.ExtraParams{Width: 2000, Height: 1000, MaxWidth: 4000}
+	if err := applyPrefixOptions(&params, "/img"); err != nil {
+		t.Fatal(err)
+	}
+	if params.Width != 1000 || params.Height != 500 || params.MaxWidth != 1000 {
+		t.Fatalf("applyPrefixOptions() = %+v, want the default limits", params)
+	}
+
+	params = config.ExtraParams{Width: 600}
+	if err := applyPrefixOptions(&params, "/strict"); err == nil {
+		t.Fatal("applyPrefixOptions() should reject sizes over the limit")
+	}
+}
+
+func TestApplyPrefixOptionsWatermark(t *testing.T) {
+	withExtraParams(t)
+	watermark := &config.Watermark{Image: "logo.png"}
+	config.Config.ImageMapOpts = map[string]config.PrefixOptions{"/img": {Watermark: watermark}}
+
+	params := config.ExtraParams{Width: 200}
+	if err := applyPrefixOptions(&params, "/img"); err != nil {
+		t.Fatal(err)
+	}
+	if params.Watermark != watermark || params.CanServeOriginal() {
+		t.Fatalf("applyPrefixOptions() = %+v, want the prefix watermark", params)
+	}
+
+	params = config.ExtraParams{Width: 200}
+	if err := applyPrefixOptions(&params, "/other"); err != nil {
+		t.Fatal(err)
+	}
+	if params.Watermark != nil {
+		t.Fatal("other prefixes should not be watermarked")
+	}
+}
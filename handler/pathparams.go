@@ -0,0 +1,63 @@
+package handler
+
+import (
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+	"webp_server_go/config"
+)
+
+// 路径参数的简写，其余参数使用与查询参数相同的名称
+var pathParamAliases = map[string]string{
+	"w":  "width",
+	"h":  "height",
+	"mw": "max_width",
+	"mh": "max_height",
+	"bg": "background",
+	"we": "without_enlargement",
+	"r":  "rotate",
+	"c":  "crop",
+	"i":  "interesting",
+	"f":  "format",
+	"p":  "preset",
+}
+
+// 拆分 /<PARAMS_PATH_MARKER>/<参数>/<path>，返回参数段和去掉参数后的路径
+func cutParamsPath(reqURI string) (string, string, bool) {
+	if config.Config.ParamsPathMarker == "" {
+		return "", reqURI, false
+	}
+	rest, ok := strings.CutPrefix(reqURI, "/"+config.Config.ParamsPathMarker+"/")
+	if !ok {
+		return "", reqURI, false
+	}
+	segment, rest, ok := strings.Cut(rest, "/")
+	if !ok || segment == "" {
+		return "", reqURI, false
+	}
+	return segment, "/" + rest, true
+}
+
+// 将 w_400,h_300,fit_cover 形式的参数段写入 query，路径参数覆盖同名查询参数
+// 键和值以最后一个 '_' 分隔，因此 max_width_400 也是合法的；crop 中的 ',' 写作 ':'
+func mergePathParams(query url.Values, segment string) error {
+	for _, param := range strings.Split(segment, ",") {
+		i := strings.LastIndex(param, "_")
+		if i <= 0 {
+			return fmt.Errorf("路径参数格式应为 key_value: %s", param)
+		}
+		key, value := param[:i], param[i+1:]
+		if alias, ok := pathParamAliases[key]; ok {
+			key = alias
+		}
+		if key != "preset" && !slices.Contains(rawParamKeys, key) {
+			return fmt.Errorf("不支持的路径参数: %s", key)
+		}
+		if key == "crop" {
+			value = strings.ReplaceAll(value, ":", ",")
+		}
+		query.Set(key, value)
+	}
+	return nil
+}
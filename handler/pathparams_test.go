@@ -0,0 +1,101 @@
+package handler
+
+import (
+	"net/url"
+	"testing"
+	"webp_server_go/config"
+)
+
+func TestCutParamsPath(t *testing.T) {
+	old := config.Config.ParamsPathMarker
+	t.Cleanup(func() { config.Config.ParamsPathMarker = old })
+
+	tests := []struct {
+		name        string
+		marker      string
+		reqURI      string
+		wantSegment string
+		wantRest    string
+		wantOK      bool
+	}{
+		{"params", "_", "/_/w_400,h_300/img/a.jpg", "w_400,h_300", "/img/a.jpg", true},
+		{"nested path", "_", "/_/w_400/a/b/c.png", "w_400", "/a/b/c.png", true},
+		{"custom marker", "t", "/t/w_400/img/a.jpg", "w_400", "/img/a.jpg", true},
+		{"no marker", "_", "/img/a.jpg", "", "/img/a.jpg", false},
+		{"marker as prefix of a directory", "_", "/_x/w_400/a.jpg", "", "/_x/w_400/a.jpg", false},
+		{"missing path", "_", "/_/w_400", "", "/_/w_400", false},
+		{"empty segment", "_", "/_//img/a.jpg", "", "/_//img/a.jpg", false},
+		{"disabled", "", "/_/w_400/img/a.jpg", "", "/_/w_400/img/a.jpg", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.Config.ParamsPathMarker = tt.marker
+			segment, rest, ok := cutParamsPath(tt.reqURI)
+			if segment != tt.wantSegment || rest != tt.wantRest || ok != tt.wantOK {
+				t.Fatalf("cutParamsPath(%q) = %q, %q, %v, want %q, %q, %v",
+					tt.reqURI, segment, rest, ok, tt.wantSegment, tt.wantRest, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestMergePathParams(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   url.Values
+		segment string
+		want    url.Values
+		wantErr bool
+	}{
+		{
+			name:    "aliases",
+			segment: "w_400,h_300,mw_800,mh_600,f_avif,p_thumb",
+			want: url.Values{"width": {"400"}, "height": {"300"}, "max_width": {"800"},
+				"max_height": {"600"}, "format": {"avif"}, "preset": {"thumb"}},
+		},
+		{
+			name:    "full names split at the last underscore",
+			segment: "max_width_400,without_enlargement_true",
+			want:    url.Values{"max_width": {"400"}, "without_enlargement": {"true"}},
+		},
+		{
+			name:    "crop uses colons",
+			segment: "c_10:20:300:200",
+			want:    url.Values{"crop": {"10,20,300,200"}},
+		},
+		{
+			name:    "empty value",
+			segment: "bg_",
+			want:    url.Values{"background": {""}},
+		},
+		{
+			name:    "overrides query",
+			query:   url.Values{"width": {"100"}, "height": {"50"}},
+			segment: "w_400",
+			want:    url.Values{"width": {"400"}, "height": {"50"}},
+		},
+		{name: "missing separator", segment: "w400", wantErr: true},
+		{name: "missing key", segment: "_400", wantErr: true},
+		{name: "empty parameter", segment: "w_400,", wantErr: true},
+		{name: "unknown key", segment: "x_1", wantErr: true},
+		{name: "signature is not a path param", segment: "s_abc", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query := url.Values{}
+			for k, v := range tt.query {
+				query[k] = v
+			}
+			err := mergePathParams(query, tt.segment)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("mergePathParams(%q) error = %v, wantErr %v", tt.segment, err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if query.Encode() != tt.want.Encode() {
+				t.Fatalf("mergePathParams(%q) = %v, want %v", tt.segment, query, tt.want)
+			}
+		})
+	}
+}
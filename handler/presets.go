@@ -0,0 +1,95 @@
+package handler
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"webp_server_go/config"
+	"webp_server_go/helper"
+)
+
+// 路径形式的预设前缀，例如 /_p/card/products/a.jpg
+const presetPathPrefix = "/_p/"
+
+// 除 preset 外所有会改变输出的请求参数，PRESETS_ONLY 时一律拒绝
+var rawParamKeys = append([]string{
+	"width", "height", "max_width", "max_height",
+	"fit", "background", "without_enlargement",
+	"rotate", "flip", "flop", "autorotate", "frame",
+	"trim", "trim_background", "trim_animated",
+	"crop", "fx", "fy", "interesting",
+	"blur", "sharpen", "brightness", "saturation", "contrast", "gamma", "grayscale", "tint", "negate",
+	"q", "format", "gamut", "dpr",
+}, textParamKeys...)
+
+// 文字叠加参数
+var textParamKeys = []string{"text", "text_size", "text_color", "text_stroke", "text_stroke_color", "text_gravity", "text_padding"}
+
+// 拆分 /_p/<name>/<path>，返回预设名称和去掉前缀后的路径
+func cutPresetPath(reqURI string) (string, string, bool) {
+	rest, ok := strings.CutPrefix(reqURI, presetPathPrefix)
+	if !ok {
+		return "", reqURI, false
+	}
+	name, rest, ok := strings.Cut(rest, "/")
+	if !ok || name == "" {
+		return "", reqURI, false
+	}
+	return name, "/" + rest, true
+}
+
+// 将预设展开为 ExtraParams，名称为空时返回零值
+func presetParams(name string) (config.ExtraParams, error) {
+	if name == "" {
+		return config.ExtraParams{}, nil
+	}
+	preset, ok := config.Config.Presets[name]
+	if !ok {
+		return config.ExtraParams{}, fmt.Errorf("未知的预设: %s", name)
+	}
+
+	extraParams := config.ExtraParams{
+		Width:              preset.Width,
+		Height:             preset.Height,
+		MaxWidth:           preset.MaxWidth,
+		MaxHeight:          preset.MaxHeight,
+		Fit:                preset.Fit,
+		WithoutEnlargement: preset.WithoutEnlargement,
+		Interesting:        preset.Interesting,
+		Quality:            preset.Quality,
+		Format:             preset.Format,
+		Filters:            preset.Filters,
+		Metadata:           preset.Metadata,
+		Preset:             name,
+	}
+	// 颜色格式已在加载配置时校验
+	if preset.Background != "" {
+		extraParams.Background, _ = helper.NormalizeHexColor(preset.Background)
+	}
+	if preset.Tint != "" {
+		extraParams.Tint, _ = helper.NormalizeHexColor(preset.Tint)
+	}
+	if preset.Text != nil {
+		text := *preset.Text
+		text.Color, _ = normalizeOptionalColor(text.Color)
+		text.StrokeColor, _ = normalizeOptionalColor(text.StrokeColor)
+		extraParams.Text = &text
+	}
+	return extraParams, nil
+}
+
+func hasRawParams(query url.Values) bool {
+	for _, key := range rawParamKeys {
+		if query.Has(key) {
+			return true
+		}
+	}
+	return false
+}
+
+func normalizeOptionalColor(color string) (string, error) {
+	if color == "" {
+		return "", nil
+	}
+	return helper.NormalizeHexColor(color)
+}
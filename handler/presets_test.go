@@ -0,0 +1,76 @@
+package handler
+
+import (
+	"net/url"
+	"testing"
+	"webp_server_go/config"
+)
+
+func TestCutPresetPath(t *testing.T) {
+	tests := []struct {
+		reqURI   string
+		wantName string
+		wantRest string
+		wantOK   bool
+	}{
+		{"/_p/card/products/a.jpg", "card", "/products/a.jpg", true},
+		{"/_p/card/a.jpg", "card", "/a.jpg", true},
+		{"/_p/card", "", "/_p/card", false},
+		{"/_p//a.jpg", "", "/_p//a.jpg", false},
+		{"/_pics/a.jpg", "", "/_pics/a.jpg", false},
+		{"/products/a.jpg", "", "/products/a.jpg", false},
+	}
+	for _, tt := range tests {
+		name, rest, ok := cutPresetPath(tt.reqURI)
+		if name != tt.wantName || rest != tt.wantRest || ok != tt.wantOK {
+			t.Errorf("cutPresetPath(%q) = %q, %q, %v, want %q, %q, %v", tt.reqURI, name, rest, ok, tt.wantName, tt.wantRest, tt.wantOK)
+		}
+	}
+}
+
+func TestParseExtraParamsPreset(t *testing.T) {
+	withExtraParams(t)
+	config.Config.Presets = map[string]config.Preset{
+		"card": {Width: 400, Height: 300, Fit: config.FitContain, Background: "#FFF", Quality: 70},
+	}
+
+	tests := []struct {
+		name        string
+		query       string
+		preset      string
+		extraParams bool
+		presetsOnly bool
+		want        config.ExtraParams
+		wantErr     bool
+	}{
+		{name: "preset", preset: "card", extraParams: true,
+			want: config.ExtraParams{Width: 400, Height: 300, Fit: config.FitContain, Background: "ffffff", Quality: 70, Preset: "card"}},
+		{name: "request overrides preset", query: "width=200&q=90", preset: "card", extraParams: true,
+			want: config.ExtraParams{Width: 200, Height: 300, Fit: config.FitContain, Background: "ffffff", Quality: 90, Preset: "card"}},
+		// 预设不受 ENABLE_EXTRA_PARAMS 限制
+		{name: "preset with extra params disabled", preset: "card",
+			want: config.ExtraParams{Width: 400, Height: 300, Fit: config.FitContain, Background: "ffffff", Quality: 70, Preset: "card"}},
+		{name: "unknown preset", preset: "hero", extraParams: true, wantErr: true},
+		{name: "presets only", preset: "card", presetsOnly: true,
+			want: config.ExtraParams{Width: 400, Height: 300, Fit: config.FitContain, Background: "ffffff", Quality: 70, Preset: "card"}},
+		{name: "presets only rejects raw params", query: "width=200", preset: "card", presetsOnly: true, wantErr: true},
+		{name: "presets only rejects dpr", query: "dpr=2", presetsOnly: true, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.Config.EnableExtraParams = tt.extraParams
+			config.Config.PresetsOnly = tt.presetsOnly
+			query, _ := url.ParseQuery(tt.query)
+			got, err := parseExtraParams(query, tt.preset)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseExtraParams() = %+v, want an error", got)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Fatalf("parseExtraParams() = %+v, %v, want %+v", got, err, tt.want)
+			}
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package handler
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -43,6 +44,13 @@ func downloadFile(filepath string, url string) error {
 		return fmt.Errorf("远程服务器返回非预期状态")
 	}
 
+	// MAX_INPUT_BYTES 在下载时就限制写入的字节数，不把超大的文件整个写到磁盘上
+	maxBytes := helper.MaxDownloadBytes()
+	if maxBytes > 0 && resp.ContentLength > maxBytes {
+		helper.RecordInputRejected("bytes")
+		return &helper.InputLimitError{Reason: "bytes", Detail: fmt.Sprintf("远程文件大小 %d 超过 %d 字节", resp.ContentLength, maxBytes)}
+	}
+
 	// 创建目标文件
 	err = os.MkdirAll(path.Dir(filepath), 0755)
 	if err != nil {
@@ -57,30 +65,50 @@ func downloadFile(filepath string, url string) error {
 	}
 	defer out.Close()
 
-	// 使用小缓冲区流式写入文件
+	// 使用小缓冲区流式写入文件，多读一个字节以判断是否超出限制
+	var body io.Reader = resp.Body
+	if maxBytes > 0 {
+		body = io.LimitReader(resp.Body, maxBytes+1)
+	}
 	buf := make([]byte, 32*1024)
-	_, err = io.CopyBuffer(out, resp.Body, buf)
+	written, err := io.CopyBuffer(out, body, buf)
 	if err != nil {
 		log.Errorf("写入文件失败。文件路径: %s, 上游链接: %s, 错误: %v", filepath, url, err)
 		return fmt.Errorf("写入文件时发生错误")
 	}
+	if maxBytes > 0 && written > maxBytes {
+		out.Close()
+		_ = os.Remove(filepath)
+		helper.RecordInputRejected("bytes")
+		return &helper.InputLimitError{Reason: "bytes", Detail: fmt.Sprintf("远程文件超过 %d 字节", maxBytes)}
+	}
 
 	// log.Infof("文件下载成功")
 	return nil
 }
 
-func fetchRemoteImg(url, subdir string) (string, bool, error) {
+func fetchRemoteImg(url, subdir, prefix string) (string, bool, error) {
 	// log.Infof("正在获取远程图像: %s", url)
 
 	fileName := helper.HashString(url)
 	localRawImagePath := path.Join(config.Config.RemoteRawPath, subdir, fileName)
 
 	if helper.FileExists(localRawImagePath) {
-		// log.Infof("远程图像已存在于本地: %s", localRawImagePath)
-		return localRawImagePath, false, nil
+		if !helper.IsStale(localRawImagePath) {
+			// log.Infof("远程图像已存在于本地: %s", localRawImagePath)
+			helper.RecordCacheHit(helper.TierRaw, prefix)
+			return localRawImagePath, false, nil
+		}
+		helper.RecordCacheStale(helper.TierRaw, prefix)
+	} else {
+		helper.RecordCacheMiss(helper.TierRaw, prefix)
 	}
 
 	err := downloadFile(localRawImagePath, url)
+	var limitErr *helper.InputLimitError
+	if errors.As(err, &limitErr) {
+		return "", false, err
+	}
 	if err != nil {
 		log.Errorf("下载远程图像失败。URL: %s, 错误: %v", url, err)
 		return "", false, fmt.Errorf("下载远程图像失败")
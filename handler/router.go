@@ -1,7 +1,9 @@
 package handler
 
 import (
+	"errors"
 	"fmt"
+	"math"
 	"net/url"
 	"os"
 	"path"
@@ -44,6 +46,35 @@ func Convert(c *gin.Context) {
 
 	log.Debugf("传入连接来自 %s %s", c.ClientIP(), reqURIwithQuery)
 
+	// 预设可以通过 ?preset=name 或 /_p/name/path 指定
+	query := c.Request.URL.Query()
+	if name, rest, ok := cutPresetPath(reqURI); ok {
+		query.Set("preset", name)
+		reqURI = rest
+		reqURIwithQuery = strings.TrimPrefix(reqURIwithQuery, presetPathPrefix+name)
+	}
+
+	// 路径形式的参数，例如 /_/w_400,h_300/path，与查询参数合并
+	if segment, rest, ok := cutParamsPath(reqURI); ok {
+		if err := mergePathParams(query, segment); err != nil {
+			log.Warnf("路径参数无效: %s, %v", reqURIwithQuery, err)
+			c.String(400, err.Error())
+			return
+		}
+		reqURI = rest
+		reqURIwithQuery = strings.TrimPrefix(reqURIwithQuery, "/"+config.Config.ParamsPathMarker+"/"+segment)
+	}
+	presetName := query.Get("preset")
+
+	// 配置了签名密钥时，带变换参数的请求必须签名，在任何下载或转换之前校验
+	if len(config.Config.SignatureKeys) > 0 && (presetName != "" || hasRawParams(query)) {
+		if err := helper.VerifySignature(c.Request.URL.Path, c.Request.URL.Query()); err != nil {
+			log.Warnf("签名校验失败: %s, %v", reqURIwithQuery, err)
+			c.String(403, err.Error())
+			return
+		}
+	}
+
 	// 首先检查是否为图片文件
 	if !isImageFile(filename) {
 		log.Infof("请求非图像文件: %s", reqURI)
@@ -60,36 +91,70 @@ func Convert(c *gin.Context) {
 	}
 
 	// 解析额外参数
-	extraParams := parseExtraParams(c)
+	extraParams, err := parseExtraParams(query, presetName)
+	if err != nil {
+		log.Warnf("额外参数无效: %s, %v", reqURIwithQuery, err)
+		c.String(400, err.Error())
+		return
+	}
+	dpr, err := applyClientHints(c, query, &extraParams)
+	if err != nil {
+		log.Warnf("DPR 无效: %s, %v", reqURIwithQuery, err)
+		c.String(400, err.Error())
+		return
+	}
+	if dpr > 0 {
+		c.Header("Content-DPR", strconv.FormatFloat(dpr, 'f', -1, 64))
+	}
 
 	// 检查路径是否匹配 IMG_MAP 中的任何前缀
-	matchedPrefix, matchedTarget := findMatchingPrefix(reqURI)
+	matchedPrefix, matchedTarget := helper.FindMatchingPrefix(reqURI)
 	if matchedPrefix == "" {
 		log.Warnf("请求的路径不匹配: %s", c.Request.URL.Path)
 		c.Status(404)
 		return
 	}
 
+	// 按前缀限制质量、输出格式和尺寸
+	if err := applyPrefixOptions(&extraParams, matchedPrefix); err != nil {
+		log.Warnf("请求参数超出限制: %s, %v", reqURIwithQuery, err)
+		c.String(400, err.Error())
+		return
+	}
+
+	negotiateFallback(c, reqURI, &extraParams)
+
 	// 构建 EXHAUST_PATH 中的文件路径
-	exhaustFilename := buildExhaustFilename(reqURI, extraParams)
+	exhaustKey := buildExhaustKey(reqURI, extraParams)
+	exhaustFilename := helper.ExhaustFilename(exhaustKey)
 
 	// 检查文件是否已经在 EXHAUST_PATH 中
 	if helper.FileExists(exhaustFilename) {
 		if info, err := os.Stat(exhaustFilename); err == nil && info.Size() > 0 {
-			log.Infof("文件已存在: %s", exhaustFilename)
-			c.File(exhaustFilename)
-			return
+			if !info.ModTime().Equal(helper.StaleModTime) {
+				log.Infof("文件已存在: %s", exhaustFilename)
+				helper.RecordCacheHit(helper.TierExhaust, matchedPrefix)
+				serveExhaustFile(c, exhaustFilename, extraParams)
+				return
+			}
+			// 已被软清除，保留旧文件，重新生成成功后再替换
+			log.Infof("文件已过期，重新生成: %s", exhaustFilename)
+			helper.RecordCacheStale(helper.TierExhaust, matchedPrefix)
+		} else {
+			// 如果文件存在但大小为0，删除它并重新处理
+			os.Remove(exhaustFilename)
+			helper.RecordCacheMiss(helper.TierExhaust, matchedPrefix)
 		}
-		// 如果文件存在但大小为0，删除它并重新处理
-		os.Remove(exhaustFilename)
+	} else {
+		helper.RecordCacheMiss(helper.TierExhaust, matchedPrefix)
 	}
 
 	// 处理图像
 	isLocalPath := strings.HasPrefix(matchedTarget, "./") || strings.HasPrefix(matchedTarget, "/")
 	if isLocalPath {
-		handleLocalImage(c, matchedTarget, reqURI, exhaustFilename, extraParams)
+		handleLocalImage(c, matchedTarget, reqURI, exhaustKey, extraParams)
 	} else {
-		handleRemoteImage(c, matchedTarget, matchedPrefix, reqURIwithQuery, exhaustFilename, extraParams)
+		handleRemoteImage(c, matchedTarget, matchedPrefix, reqURIwithQuery, exhaustKey, extraParams)
 	}
 }
 
@@ -145,64 +210,342 @@ func parseRequestURI(c *gin.Context) (string, string) {
 	return path.Clean(reqURIRaw), path.Clean(reqURIwithQueryRaw)
 }
 
-func parseExtraParams(c *gin.Context) config.ExtraParams {
-	width, _ := strconv.Atoi(c.Query("width"))
-	height, _ := strconv.Atoi(c.Query("height"))
-	maxHeight, _ := strconv.Atoi(c.Query("max_height"))
-	maxWidth, _ := strconv.Atoi(c.Query("max_width"))
-	return config.ExtraParams{
-		Width:     width,
-		Height:    height,
-		MaxWidth:  maxWidth,
-		MaxHeight: maxHeight,
+func parseExtraParams(query url.Values, presetName string) (config.ExtraParams, error) {
+	// 预设作为基础，请求中显式给出的参数覆盖预设
+	extraParams, err := presetParams(presetName)
+	if err != nil {
+		return extraParams, err
+	}
+	if config.Config.PresetsOnly && hasRawParams(query) {
+		return extraParams, fmt.Errorf("仅允许使用预设")
+	}
+
+	for key, value := range map[string]*int{
+		"width":      &extraParams.Width,
+		"height":     &extraParams.Height,
+		"max_width":  &extraParams.MaxWidth,
+		"max_height": &extraParams.MaxHeight,
+	} {
+		if query.Get(key) != "" {
+			n, err := strconv.Atoi(query.Get(key))
+			if err != nil || n < 0 {
+				return extraParams, fmt.Errorf("%s 应为非负整数: %s", key, query.Get(key))
+			}
+			*value = n
+		}
+	}
+
+	if fit := strings.ToLower(query.Get("fit")); fit != "" {
+		if !slices.Contains(config.AvailableFits, fit) {
+			return extraParams, fmt.Errorf("不支持的 fit: %s", fit)
+		}
+		extraParams.Fit = fit
+	}
+	if background := query.Get("background"); background != "" {
+		normalized, err := helper.NormalizeHexColor(background)
+		if err != nil {
+			return extraParams, err
+		}
+		extraParams.Background = normalized
+	}
+	if withoutEnlargement := query.Get("without_enlargement"); withoutEnlargement != "" {
+		value, err := strconv.ParseBool(withoutEnlargement)
+		if err != nil {
+			return extraParams, fmt.Errorf("without_enlargement 不是有效的布尔值: %s", withoutEnlargement)
+		}
+		extraParams.WithoutEnlargement = value
+	}
+	if rotate := query.Get("rotate"); rotate != "" {
+		angle, err := strconv.ParseFloat(rotate, 64)
+		if err != nil || math.IsNaN(angle) || math.IsInf(angle, 0) {
+			return extraParams, fmt.Errorf("rotate 不是有效的角度: %s", rotate)
+		}
+		// 统一到 [0, 360)，-90 与 270 使用同一个缓存键
+		extraParams.Rotate = math.Mod(math.Mod(angle, 360)+360, 360)
+	}
+	for key, value := range map[string]*bool{
+		"flip":      &extraParams.Flip,
+		"flop":      &extraParams.Flop,
+		"grayscale": &extraParams.Grayscale,
+		"negate":    &extraParams.Negate,
+	} {
+		if query.Get(key) != "" {
+			b, err := strconv.ParseBool(query.Get(key))
+			if err != nil {
+				return extraParams, fmt.Errorf("%s 不是有效的布尔值: %s", key, query.Get(key))
+			}
+			*value = b
+		}
+	}
+	if autorotate := query.Get("autorotate"); autorotate != "" {
+		value, err := strconv.ParseBool(autorotate)
+		if err != nil {
+			return extraParams, fmt.Errorf("autorotate 不是有效的布尔值: %s", autorotate)
+		}
+		extraParams.NoAutoRotate = !value
+	}
+	if frame := query.Get("frame"); frame != "" {
+		index, err := strconv.Atoi(frame)
+		if err != nil || index < 0 {
+			return extraParams, fmt.Errorf("frame 应为非负整数: %s", frame)
+		}
+		extraParams.Frame = &index
+	}
+	if trim := query.Get("trim"); trim != "" {
+		trimParams, err := parseTrim(trim, query.Get("trim_background"), query.Get("trim_animated"))
+		if err != nil {
+			return extraParams, err
+		}
+		extraParams.Trim = trimParams
+	}
+	if crop := query.Get("crop"); crop != "" {
+		rect, err := parseCropRect(crop)
+		if err != nil {
+			return extraParams, err
+		}
+		extraParams.Crop = rect
+	}
+	if fx, fy := query.Get("fx"), query.Get("fy"); fx != "" || fy != "" {
+		focal, err := parseFocalPoint(fx, fy)
+		if err != nil {
+			return extraParams, err
+		}
+		extraParams.Focal = focal
+	}
+	if interesting := query.Get("interesting"); interesting != "" {
+		if !slices.Contains(config.AvailableInteresting, interesting) {
+			return extraParams, fmt.Errorf("不支持的裁剪策略: %s", interesting)
+		}
+		extraParams.Interesting = interesting
+	}
+	if q := query.Get("q"); q != "" {
+		quality, err := strconv.Atoi(q)
+		if err != nil || quality < 1 || quality > 100 {
+			return extraParams, fmt.Errorf("q 应为 1-100 的整数: %s", q)
+		}
+		extraParams.Quality = quality
+	}
+	if format := strings.ToLower(query.Get("format")); format != "" {
+		if format == "jpg" {
+			format = config.FormatJpeg
+		}
+		if !slices.Contains(config.AvailableFormats, format) {
+			return extraParams, fmt.Errorf("不支持的 format: %s", format)
+		}
+		extraParams.Format = format
+	}
+	if gamut := strings.ToLower(query.Get("gamut")); gamut != "" {
+		if gamut != config.GamutSRGB && gamut != config.GamutP3 {
+			return extraParams, fmt.Errorf("不支持的 gamut: %s", gamut)
+		}
+		// 只有 COLOR_MANAGEMENT 为 wide 时 p3 才有意义，其余情况都输出 sRGB，不产生额外缓存变体
+		if gamut == config.GamutP3 && config.Config.ColorManagement == config.ColorManagementWide {
+			extraParams.Gamut = gamut
+		}
+	}
+	for key, value := range map[string]*float64{
+		"blur":       &extraParams.Blur,
+		"sharpen":    &extraParams.Sharpen,
+		"brightness": &extraParams.Brightness,
+		"saturation": &extraParams.Saturation,
+		"contrast":   &extraParams.Contrast,
+		"gamma":      &extraParams.Gamma,
+	} {
+		if query.Get(key) != "" {
+			f, err := strconv.ParseFloat(query.Get(key), 64)
+			if err != nil || math.IsNaN(f) {
+				return extraParams, fmt.Errorf("%s 不是有效的数值: %s", key, query.Get(key))
+			}
+			*value = f
+		}
+	}
+	if tint := query.Get("tint"); tint != "" {
+		normalized, err := helper.NormalizeHexColor(tint)
+		if err != nil {
+			return extraParams, err
+		}
+		extraParams.Tint = normalized
+	}
+	if err := extraParams.Filters.Validate(); err != nil {
+		return extraParams, err
+	}
+	if err := parseTextOverlay(query, &extraParams); err != nil {
+		return extraParams, err
+	}
+
+	// 未开启 ENABLE_EXTRA_PARAMS 且没有使用预设时，变换、质量和格式参数不会被应用，也不应拆分缓存键，
+	// 只保留与原来一样进入缓存键的宽高，以及不受该开关限制的帧和色域
+	if !config.Config.EnableExtraParams && presetName == "" {
+		extraParams = config.ExtraParams{
+			Width:     extraParams.Width,
+			Height:    extraParams.Height,
+			MaxWidth:  extraParams.MaxWidth,
+			MaxHeight: extraParams.MaxHeight,
+			Frame:     extraParams.Frame,
+			Gamut:     extraParams.Gamut,
+		}
+	}
+	return extraParams, nil
+}
+
+// 解析 text 及 text_* 参数，可以修改预设中的文字；任意文字会被渲染进图像，因此只接受签名过的请求
+func parseTextOverlay(query url.Values, extraParams *config.ExtraParams) error {
+	if !slices.ContainsFunc(textParamKeys, query.Has) {
+		return nil
+	}
+	if len(config.Config.SignatureKeys) == 0 {
+		return fmt.Errorf("text 参数需要配置 SIGNATURE_KEYS")
+	}
+
+	overlay := &config.TextOverlay{}
+	if extraParams.Text != nil {
+		*overlay = *extraParams.Text
+	}
+	if query.Has("text") {
+		overlay.Text = query.Get("text")
 	}
+	for key, value := range map[string]*int{
+		"text_size":    &overlay.Size,
+		"text_stroke":  &overlay.StrokeWidth,
+		"text_padding": &overlay.Padding,
+	} {
+		if query.Get(key) != "" {
+			n, err := strconv.Atoi(query.Get(key))
+			if err != nil {
+				return fmt.Errorf("%s 不是有效的整数: %s", key, query.Get(key))
+			}
+			*value = n
+		}
+	}
+	for key, value := range map[string]*string{
+		"text_color":        &overlay.Color,
+		"text_stroke_color": &overlay.StrokeColor,
+	} {
+		if query.Get(key) != "" {
+			normalized, err := helper.NormalizeHexColor(query.Get(key))
+			if err != nil {
+				return err
+			}
+			*value = normalized
+		}
+	}
+	if gravity := query.Get("text_gravity"); gravity != "" {
+		overlay.Gravity = gravity
+	}
+	if err := overlay.Validate(); err != nil {
+		return err
+	}
+	extraParams.Text = overlay
+	return nil
 }
 
-func findMatchingPrefix(reqURI string) (string, string) {
-	for prefix, target := range config.Config.ImageMap {
-		if strings.HasPrefix(reqURI, prefix) {
-			return prefix, target
+// 解析 trim=阈值（true 使用默认阈值 10，false 不去边）以及可选的背景色和是否处理动图
+// 只有字面的 true/false 是开关，1、0 等都按阈值解析
+func parseTrim(trim, background, animated string) (*config.TrimParams, error) {
+	trimParams := &config.TrimParams{Threshold: 10}
+	switch trim {
+	case "true":
+	case "false":
+		return nil, nil
+	default:
+		threshold, err := strconv.ParseFloat(trim, 64)
+		if err != nil || math.IsNaN(threshold) || threshold < 0 || threshold > 255 {
+			return nil, fmt.Errorf("trim 应为 0-255 的阈值: %s", trim)
+		}
+		trimParams.Threshold = threshold
+	}
+	if background != "" {
+		normalized, err := helper.NormalizeHexColor(background)
+		if err != nil {
+			return nil, err
+		}
+		trimParams.Background = normalized
+	}
+	if animated != "" {
+		value, err := strconv.ParseBool(animated)
+		if err != nil {
+			return nil, fmt.Errorf("trim_animated 不是有效的布尔值: %s", animated)
 		}
+		trimParams.Animated = value
 	}
-	return "", ""
+	return trimParams, nil
 }
 
-func buildRealRemoteAddr(targetUrl *url.URL, matchedPrefix, reqURIwithQuery string) string {
-	targetHost := targetUrl.Scheme + "://" + targetUrl.Host
-	reqURIwithQuery = strings.Replace(reqURIwithQuery, matchedPrefix, targetUrl.Path, 1)
-	if strings.HasSuffix(targetUrl.Path, "/") {
-		reqURIwithQuery = strings.TrimPrefix(reqURIwithQuery, "/")
+// 解析 crop=x,y,w,h，数值为像素，全部带 % 时为百分比
+func parseCropRect(crop string) (*config.CropRect, error) {
+	parts := strings.Split(crop, ",")
+	if len(parts) != 4 {
+		return nil, fmt.Errorf("crop 格式应为 x,y,w,h: %s", crop)
 	}
-	return targetHost + reqURIwithQuery
+
+	rect := &config.CropRect{Percent: strings.HasSuffix(parts[0], "%")}
+	values := make([]float64, 4)
+	for i, part := range parts {
+		if strings.HasSuffix(part, "%") != rect.Percent {
+			return nil, fmt.Errorf("crop 不能混用像素和百分比: %s", crop)
+		}
+		value, err := strconv.ParseFloat(strings.TrimSuffix(part, "%"), 64)
+		if err != nil || math.IsNaN(value) || math.IsInf(value, 0) || value < 0 || (rect.Percent && value > 100) {
+			return nil, fmt.Errorf("crop 数值无效: %s", part)
+		}
+		values[i] = value
+	}
+	rect.X, rect.Y, rect.Width, rect.Height = values[0], values[1], values[2], values[3]
+	if rect.Width == 0 || rect.Height == 0 {
+		return nil, fmt.Errorf("crop 宽高必须大于 0: %s", crop)
+	}
+	return rect, nil
 }
 
-func buildExhaustFilename(reqURI string, extraParams config.ExtraParams) string {
-	exhaustFilename := path.Join(config.Config.ExhaustPath, reqURI)
-	if extraParams.Width > 0 || extraParams.Height > 0 || extraParams.MaxWidth > 0 || extraParams.MaxHeight > 0 {
-		ext := path.Ext(exhaustFilename)
-		extraParamsStr := fmt.Sprintf("_w%d_h%d_mw%d_mh%d", extraParams.Width, extraParams.Height, extraParams.MaxWidth, extraParams.MaxHeight)
-		exhaustFilename = exhaustFilename[:len(exhaustFilename)-len(ext)] + extraParamsStr + ext
+// 解析焦点 fx、fy，取值 0-1，缺省为 0.5
+func parseFocalPoint(fx, fy string) (*config.FocalPoint, error) {
+	focal := &config.FocalPoint{X: 0.5, Y: 0.5}
+	for _, v := range []struct {
+		name  string
+		value string
+		dest  *float64
+	}{{"fx", fx, &focal.X}, {"fy", fy, &focal.Y}} {
+		if v.value == "" {
+			continue
+		}
+		value, err := strconv.ParseFloat(v.value, 64)
+		if err != nil || math.IsNaN(value) || value < 0 || value > 1 {
+			return nil, fmt.Errorf("%s 必须在 0 到 1 之间: %s", v.name, v.value)
+		}
+		*v.dest = value
 	}
-	return exhaustFilename
+	return focal, nil
 }
 
-func handleLocalImage(c *gin.Context, matchedTarget, reqURI, exhaustFilename string, extraParams config.ExtraParams) {
+// 缓存键为请求路径加变体后缀，由 helper.ExhaustFilename 映射到 EXHAUST_PATH 中的文件
+func buildExhaustKey(reqURI string, extraParams config.ExtraParams) string {
+	exhaustKey := reqURI
+	if extraParamsStr := extraParams.Variant(); extraParamsStr != "" {
+		ext := path.Ext(exhaustKey)
+		exhaustKey = exhaustKey[:len(exhaustKey)-len(ext)] + extraParamsStr + ext
+	}
+	return exhaustKey
+}
+
+func handleLocalImage(c *gin.Context, matchedTarget, reqURI, exhaustKey string, extraParams config.ExtraParams) {
 	rawImageAbs := path.Join(matchedTarget, reqURI)
 
 	if !helper.FileExists(rawImageAbs) {
 		c.String(404, "本地文件不存在")
 		return
 	}
+	if !checkInputLimits(c, rawImageAbs) {
+		return
+	}
 
-	err := processAndSaveImage(c, rawImageAbs, exhaustFilename, extraParams)
+	err := processAndSaveImage(c, rawImageAbs, exhaustKey, extraParams)
 	if err != nil {
-		log.Error(err)
-		c.String(500, "处理图像时出错")
+		respondProcessError(c, err)
 		return
 	}
 }
 
-func handleRemoteImage(c *gin.Context, matchedTarget, matchedPrefix, reqURIwithQuery, exhaustFilename string, extraParams config.ExtraParams) {
+func handleRemoteImage(c *gin.Context, matchedTarget, matchedPrefix, reqURIwithQuery, exhaustKey string, extraParams config.ExtraParams) {
 	targetUrl, err := url.Parse(matchedTarget)
 	if err != nil {
 		log.Errorf("解析目标 URL 失败: %v", err)
@@ -210,42 +553,118 @@ func handleRemoteImage(c *gin.Context, matchedTarget, matchedPrefix, reqURIwithQ
 		return
 	}
 
-	realRemoteAddr := buildRealRemoteAddr(targetUrl, matchedPrefix, reqURIwithQuery)
+	realRemoteAddr := helper.BuildRealRemoteAddr(targetUrl, matchedPrefix, reqURIwithQuery)
 
-	rawImageAbs, isNewDownload, err := fetchRemoteImg(realRemoteAddr, targetUrl.Host)
+	rawImageAbs, isNewDownload, err := fetchRemoteImg(realRemoteAddr, targetUrl.Host, matchedPrefix)
+	var limitErr *helper.InputLimitError
+	if errors.As(err, &limitErr) {
+		log.Warnf("拒绝下载远程图像: %s, %v", realRemoteAddr, err)
+		c.String(422, err.Error())
+		return
+	}
 	if err != nil {
 		log.Errorf("获取远程图像失败: %v", err)
 		c.String(500, "无法获取远程图像")
 		return
 	}
-
-	err = processAndSaveImage(c, rawImageAbs, exhaustFilename, extraParams)
-	if err != nil {
-		log.Error(err)
-		c.String(500, "处理图像时出错")
+	if !checkInputLimits(c, rawImageAbs) {
+		// 超出限制的原图不会被处理，直接删除，下次请求重新下载
+		if err := os.Remove(rawImageAbs); err != nil {
+			log.Warnf("删除被拒绝的原始文件失败: %s, 错误: %v", rawImageAbs, err)
+		}
 		return
 	}
-
+	// 处理失败时原图同样需要清理
 	if isNewDownload {
-		go schedule.ScheduleCleanup(rawImageAbs)
+		go schedule.ScheduleCleanup(rawImageAbs, matchedPrefix)
+	}
+
+	err = processAndSaveImage(c, rawImageAbs, exhaustKey, extraParams)
+	if err != nil {
+		respondProcessError(c, err)
 	}
 }
 
-func processAndSaveImage(c *gin.Context, rawImageAbs, exhaustFilename string, extraParams config.ExtraParams) error {
+func processAndSaveImage(c *gin.Context, rawImageAbs, exhaustKey string, extraParams config.ExtraParams) error {
+	exhaustFilename := helper.ExhaustFilename(exhaustKey)
+
 	// 获取文件锁
 	lock := getFileLock(exhaustFilename)
 	lock.Lock()
 	defer lock.Unlock()
 
 	// 再次检查文件是否存在
+	stale := false
 	if helper.FileExists(exhaustFilename) {
 		if info, err := os.Stat(exhaustFilename); err == nil && info.Size() > 0 {
-			c.File(exhaustFilename)
+			if !info.ModTime().Equal(helper.StaleModTime) {
+				serveExhaustFile(c, exhaustFilename, extraParams)
+				return nil
+			}
+			stale = true
+		} else {
+			os.Remove(exhaustFilename)
+		}
+	}
+
+	err := saveImage(rawImageAbs, exhaustFilename, extraParams)
+	if err == nil && config.Config.ExhaustLayout == helper.ExhaustLayoutSharded {
+		if err := helper.WriteExhaustSidecar(exhaustFilename, exhaustKey); err != nil {
+			log.Warnf("写入缓存旁路文件失败: %s, 错误: %v", exhaustFilename, err)
+		}
+	}
+	if err != nil {
+		if stale {
+			// 重新生成失败时继续提供过期的文件
+			log.Warnf("重新生成过期文件失败，返回旧文件: %s, 错误: %v", exhaustFilename, err)
+			serveExhaustFile(c, exhaustFilename, extraParams)
 			return nil
 		}
-		os.Remove(exhaustFilename)
+		return err
 	}
 
+	serveExhaustFile(c, exhaustFilename, extraParams)
+	return nil
+}
+
+// 解码前检查输入限制，超限时返回 422，避免解压炸弹耗尽内存
+func checkInputLimits(c *gin.Context, rawImageAbs string) bool {
+	if err := helper.CheckInputLimits(rawImageAbs); err != nil {
+		log.Warnf("拒绝处理图像: %s, %v", rawImageAbs, err)
+		c.String(422, err.Error())
+		return false
+	}
+	return true
+}
+
+// RAW 转换出的中间文件超出输入限制时同样返回 422，其他错误返回 500
+func respondProcessError(c *gin.Context, err error) {
+	log.Error(err)
+	var limitErr *helper.InputLimitError
+	if errors.As(err, &limitErr) {
+		c.String(422, limitErr.Error())
+		return
+	}
+	c.String(500, "处理图像时出错")
+}
+
+// 按实际内容设置 Content-Type，避免 gin 根据请求扩展名推断
+func serveExhaustFile(c *gin.Context, exhaustFilename string, extraParams config.ExtraParams) {
+	if contentType := helper.ExhaustContentType(exhaustFilename); contentType != "" {
+		c.Header("Content-Type", contentType)
+	}
+	// 去边后的尺寸无法从请求推断，从文件头读取输出尺寸
+	if extraParams.Trim != nil {
+		if probe, err := helper.ProbeImage(exhaustFilename); err == nil && probe.Width > 0 {
+			c.Header("X-Image-Width", strconv.Itoa(probe.Width))
+			c.Header("X-Image-Height", strconv.Itoa(probe.Height))
+		}
+	}
+	c.File(exhaustFilename)
+}
+
+// 转换图像并原子性地写入 EXHAUST_PATH
+func saveImage(rawImageAbs, exhaustFilename string, extraParams config.ExtraParams) error {
 	isSmall, err := helper.IsFileSizeSmall(rawImageAbs, 30*1024)
 	if err != nil {
 		return fmt.Errorf("检查文件大小时出错: %v", err)
@@ -260,15 +679,22 @@ func processAndSaveImage(c *gin.Context, rawImageAbs, exhaustFilename string, ex
 	tempFile := exhaustFilename + ".tmp"
 	defer os.Remove(tempFile)
 
-	if isSmall {
-		if err := helper.CopyFile(rawImageAbs, tempFile); err != nil {
+	if isSmall && extraParams.CanServeOriginal() {
+		if err := encoder.CopyOriginal(rawImageAbs, tempFile, extraParams); err != nil {
 			return fmt.Errorf("复制小文件失败: %v", err)
 		}
 	} else {
 		err := encoder.ProcessAndSaveImage(rawImageAbs, tempFile, extraParams)
+		var limitErr *helper.InputLimitError
+		if errors.As(err, &limitErr) {
+			return err
+		}
+		if err != nil && !extraParams.CanServeOriginal() {
+			return fmt.Errorf("处理图片失败: %v", err)
+		}
 		if err != nil {
 			// log.Warnf("处理图片失败，将直接复制原图: %v", err)
-			if copyErr := helper.CopyFile(rawImageAbs, tempFile); copyErr != nil {
+			if copyErr := encoder.CopyOriginal(rawImageAbs, tempFile, extraParams); copyErr != nil {
 				return fmt.Errorf("复制原图失败: %v", copyErr)
 			}
 		}
@@ -284,6 +710,7 @@ func processAndSaveImage(c *gin.Context, rawImageAbs, exhaustFilename string, ex
 		return fmt.Errorf("重命名临时文件失败: %v", err)
 	}
 
-	c.File(exhaustFilename)
+	helper.RecordConversion(rawImageAbs, exhaustFilename)
+
 	return nil
 }
@@ -0,0 +1,369 @@
+package handler
+
+import (
+	"net/url"
+	"testing"
+	"webp_server_go/config"
+)
+
+// 解析 rawQuery 中的参数，不使用预设
+func parseQuery(t *testing.T, rawQuery string) (config.ExtraParams, error) {
+	t.Helper()
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parseExtraParams(query, "")
+}
+
+// 使用开启 ENABLE_EXTRA_PARAMS 的配置副本
+func withExtraParams(t *testing.T) {
+	t.Helper()
+	old := config.Config
+	cfg := *old
+	cfg.EnableExtraParams = true
+	config.Config = &cfg
+	t.Cleanup(func() { config.Config = old })
+}
+
+func TestParseExtraParams(t *testing.T) {
+	withExtraParams(t)
+	tests := []struct {
+		query   string
+		want    config.ExtraParams
+		wantErr bool
+	}{
+		{"width=200&height=100", config.ExtraParams{Width: 200, Height: 100}, false},
+		{"fit=CONTAIN&background=%23FFF", config.ExtraParams{Fit: config.FitContain, Background: "ffffff"}, false},
+		{"without_enlargement=1", config.ExtraParams{WithoutEnlargement: true}, false},
+		{"fit=stretch", config.ExtraParams{}, true},
+		{"background=red", config.ExtraParams{}, true},
+		{"without_enlargement=yes", config.ExtraParams{}, true},
+		{"width=200&height=100&crop=0,0,50%25,50%25", config.ExtraParams{}, true},
+		{"width=200&height=100&fx=0.3&interesting=InterestingEntropy",
+			config.ExtraParams{Width: 200, Height: 100, Focal: &config.FocalPoint{X: 0.3, Y: 0.5}, Interesting: "InterestingEntropy"}, false},
+		{"interesting=InterestingSomething", config.ExtraParams{}, true},
+		{"q=75&format=JPG", config.ExtraParams{Quality: 75, Format: config.FormatJpeg}, false},
+		{"q=0", config.ExtraParams{}, true},
+		{"q=101", config.ExtraParams{}, true},
+		{"format=bmp", config.ExtraParams{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			got, err := parseQuery(t, tt.query)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseExtraParams() = %+v, want an error", got)
+				}
+				return
+			}
+			if err != nil || got.Variant() != tt.want.Variant() {
+				t.Fatalf("parseExtraParams() = %+v, %v, want %+v", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuildExhaustKey(t *testing.T) {
+	tests := []struct {
+		reqURI string
+		params config.ExtraParams
+		want   string
+	}{
+		{"/img/a.jpg", config.ExtraParams{}, "/img/a.jpg"},
+		{"/img/a.jpg", config.ExtraParams{Width: 200}, "/img/a_w200_h0_mw0_mh0.jpg"},
+		{"/img/a.jpg", config.ExtraParams{Width: 200, Height: 100, Fit: config.FitInside}, "/img/a_w200_h100_mw0_mh0_fitinside.jpg"},
+		{"/img/a", config.ExtraParams{Width: 200}, "/img/a_w200_h0_mw0_mh0"},
+	}
+	for _, tt := range tests {
+		if got := buildExhaustKey(tt.reqURI, tt.params); got != tt.want {
+			t.Errorf("buildExhaustKey(%q, %+v) = %q, want %q", tt.reqURI, tt.params, got, tt.want)
+		}
+	}
+}
+
+func TestParseCropRect(t *testing.T) {
+	tests := []struct {
+		crop    string
+		want    config.CropRect
+		wantErr bool
+	}{
+		{"10,20,300,200", config.CropRect{X: 10, Y: 20, Width: 300, Height: 200}, false},
+		{"0%,10%,50%,50.5%", config.CropRect{Y: 10, Width: 50, Height: 50.5, Percent: true}, false},
+		{"10,20,300", config.CropRect{}, true},
+		{"10%,20,300,200", config.CropRect{}, true},
+		{"0,0,0,200", config.CropRect{}, true},
+		{"-1,0,10,10", config.CropRect{}, true},
+		{"0%,0%,101%,50%", config.CropRect{}, true},
+		{"NaN,0,10,10", config.CropRect{}, true},
+		{"0,0,Inf,10", config.CropRect{}, true},
+		{"0,0,a,10", config.CropRect{}, true},
+	}
+	for _, tt := range tests {
+		got, err := parseCropRect(tt.crop)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseCropRect(%q) = %+v, want an error", tt.crop, *got)
+			}
+			continue
+		}
+		if err != nil || *got != tt.want {
+			t.Errorf("parseCropRect(%q) = %+v, %v, want %+v", tt.crop, got, err, tt.want)
+		}
+	}
+}
+
+func TestParseFocalPoint(t *testing.T) {
+	tests := []struct {
+		fx, fy  string
+		want    config.FocalPoint
+		wantErr bool
+	}{
+		{"0.2", "0.8", config.FocalPoint{X: 0.2, Y: 0.8}, false},
+		{"1", "", config.FocalPoint{X: 1, Y: 0.5}, false},
+		{"", "0", config.FocalPoint{X: 0.5, Y: 0}, false},
+		{"1.1", "", config.FocalPoint{}, true},
+		{"", "-0.1", config.FocalPoint{}, true},
+		{"NaN", "", config.FocalPoint{}, true},
+		{"Inf", "", config.FocalPoint{}, true},
+		{"x", "", config.FocalPoint{}, true},
+	}
+	for _, tt := range tests {
+		got, err := parseFocalPoint(tt.fx, tt.fy)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseFocalPoint(%q, %q) = %+v, want an error", tt.fx, tt.fy, *got)
+			}
+			continue
+		}
+		if err != nil || *got != tt.want {
+			t.Errorf("parseFocalPoint(%q, %q) = %+v, %v, want %+v", tt.fx, tt.fy, got, err, tt.want)
+		}
+	}
+}
+
+func TestParseExtraParamsDisabled(t *testing.T) {
+	withExtraParams(t)
+	config.Config.EnableExtraParams = false
+
+	// 未开启额外参数时只保留宽高，其余参数不会被应用，也不进入缓存键
+	got, err := parseQuery(t, "width=200&height=100&fit=contain&q=50&format=avif&crop=0,0,10,10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (config.ExtraParams{Width: 200, Height: 100}); got.Variant() != want.Variant() {
+		t.Fatalf("parseExtraParams() = %+v, want %+v", got, want)
+	}
+}
+
+func TestParseOrientation(t *testing.T) {
+	withExtraParams(t)
+	tests := []struct {
+		query   string
+		want    config.ExtraParams
+		wantErr bool
+	}{
+		{"rotate=90", config.ExtraParams{Rotate: 90}, false},
+		{"rotate=-90", config.ExtraParams{Rotate: 270}, false},
+		{"rotate=450", config.ExtraParams{Rotate: 90}, false},
+		{"rotate=360", config.ExtraParams{}, false},
+		{"rotate=12.5", config.ExtraParams{Rotate: 12.5}, false},
+		{"flip=true&flop=1", config.ExtraParams{Flip: true, Flop: true}, false},
+		{"autorotate=false", config.ExtraParams{NoAutoRotate: true}, false},
+		{"autorotate=true", config.ExtraParams{}, false},
+		{"rotate=NaN", config.ExtraParams{}, true},
+		{"rotate=Inf", config.ExtraParams{}, true},
+		{"rotate=left", config.ExtraParams{}, true},
+		{"flip=yes", config.ExtraParams{}, true},
+		{"autorotate=no", config.ExtraParams{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			got, err := parseQuery(t, tt.query)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseExtraParams() = %+v, want an error", got)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Fatalf("parseExtraParams() = %+v, %v, want %+v", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseFilters(t *testing.T) {
+	withExtraParams(t)
+	tests := []struct {
+		query   string
+		want    config.Filters
+		wantErr bool
+	}{
+		{"blur=2&sharpen=1.5", config.Filters{Blur: 2, Sharpen: 1.5}, false},
+		{"brightness=-10&saturation=20&contrast=5&gamma=2.2", config.Filters{Brightness: -10, Saturation: 20, Contrast: 5, Gamma: 2.2}, false},
+		{"grayscale=true&tint=%23F00&negate=1", config.Filters{Grayscale: true, Tint: "ff0000", Negate: true}, false},
+		{"blur=0.1", config.Filters{}, true},
+		{"brightness=NaN", config.Filters{}, true},
+		{"gamma=x", config.Filters{}, true},
+		{"tint=red", config.Filters{}, true},
+		{"negate=maybe", config.Filters{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			got, err := parseQuery(t, tt.query)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseExtraParams() = %+v, want an error", got)
+				}
+				return
+			}
+			if err != nil || got.Filters != tt.want {
+				t.Fatalf("parseExtraParams() = %+v, %v, want %+v", got.Filters, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTextOverlay(t *testing.T) {
+	withExtraParams(t)
+	config.Config.TextMaxLength = 100
+
+	config.Config.SignatureKeys = nil
+	if _, err := parseQuery(t, "text=hello"); err == nil {
+		t.Fatal("text without SIGNATURE_KEYS should be rejected")
+	}
+
+	config.Config.SignatureKeys = []string{"secret"}
+	tests := []struct {
+		query   string
+		want    *config.TextOverlay
+		wantErr bool
+	}{
+		{"width=200", nil, false},
+		{"text=hello", &config.TextOverlay{Text: "hello"}, false},
+		{"text=hi&text_size=32&text_color=%23FFF&text_stroke=2&text_gravity=north&text_padding=8",
+			&config.TextOverlay{Text: "hi", Size: 32, Color: "ffffff", StrokeWidth: 2, Gravity: "north", Padding: 8}, false},
+		{"text_size=32", nil, true},
+		{"text=hi&text_size=big", nil, true},
+		{"text=hi&text_color=white", nil, true},
+		{"text=hi&text_gravity=top", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			got, err := parseQuery(t, tt.query)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseExtraParams() = %+v, want an error", got.Text)
+				}
+				return
+			}
+			if err != nil || (got.Text == nil) != (tt.want == nil) || (tt.want != nil && *got.Text != *tt.want) {
+				t.Fatalf("parseExtraParams() text = %+v, %v, want %+v", got.Text, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTrim(t *testing.T) {
+	tests := []struct {
+		trim, background, animated string
+		want                       *config.TrimParams
+		wantErr                    bool
+	}{
+		{"true", "", "", &config.TrimParams{Threshold: 10}, false},
+		{"false", "", "", nil, false},
+		{"25.5", "", "", &config.TrimParams{Threshold: 25.5}, false},
+		// 只有字面的 true/false 是开关，数字都按阈值解析
+		{"1", "", "", &config.TrimParams{Threshold: 1}, false},
+		{"0", "", "", &config.TrimParams{Threshold: 0}, false},
+		{"255", "#FFF", "true", &config.TrimParams{Threshold: 255, Background: "ffffff", Animated: true}, false},
+		{"TRUE", "", "", nil, true},
+		{"t", "", "", nil, true},
+		{"256", "", "", nil, true},
+		{"-1", "", "", nil, true},
+		{"NaN", "", "", nil, true},
+		{"true", "white", "", nil, true},
+		{"true", "", "maybe", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseTrim(tt.trim, tt.background, tt.animated)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseTrim(%q, %q, %q) = %+v, want an error", tt.trim, tt.background, tt.animated, got)
+			}
+			continue
+		}
+		if err != nil || (got == nil) != (tt.want == nil) || (got != nil && *got != *tt.want) {
+			t.Errorf("parseTrim(%q, %q, %q) = %+v, %v, want %+v", tt.trim, tt.background, tt.animated, got, err, tt.want)
+		}
+	}
+}
+
+func TestParseGamut(t *testing.T) {
+	withExtraParams(t)
+	tests := []struct {
+		query           string
+		colorManagement string
+		want            string
+		wantErr         bool
+	}{
+		{"gamut=p3", config.ColorManagementWide, config.GamutP3, false},
+		{"gamut=P3", config.ColorManagementWide, config.GamutP3, false},
+		{"gamut=srgb", config.ColorManagementWide, "", false},
+		// 只有 wide 模式下 p3 才生效，其余模式不拆分缓存键
+		{"gamut=p3", config.ColorManagementSRGB, "", false},
+		{"gamut=p3", config.ColorManagementOff, "", false},
+		{"gamut=rec2020", config.ColorManagementWide, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query+"/"+tt.colorManagement, func(t *testing.T) {
+			config.Config.ColorManagement = tt.colorManagement
+			got, err := parseQuery(t, tt.query)
+			if (err != nil) != tt.wantErr || got.Gamut != tt.want {
+				t.Fatalf("parseExtraParams() gamut = %q, %v, want %q, error %v", got.Gamut, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+
+	// 色域不受 ENABLE_EXTRA_PARAMS 限制
+	config.Config.EnableExtraParams = false
+	config.Config.ColorManagement = config.ColorManagementWide
+	if got, err := parseQuery(t, "gamut=p3"); err != nil || got.Variant() != "_w0_h0_mw0_mh0_gp3" {
+		t.Fatalf("parseExtraParams() = %+v, %v, want gamut p3 with extra params disabled", got, err)
+	}
+}
+
+func TestParseFrame(t *testing.T) {
+	withExtraParams(t)
+	tests := []struct {
+		query   string
+		want    int
+		wantErr bool
+	}{
+		{"frame=0", 0, false},
+		{"frame=3", 3, false},
+		{"frame=-1", 0, true},
+		{"frame=first", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			got, err := parseQuery(t, tt.query)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseExtraParams() = %+v, want an error", got)
+				}
+				return
+			}
+			if err != nil || got.Frame == nil || *got.Frame != tt.want {
+				t.Fatalf("parseExtraParams() frame = %v, %v, want %d", got.Frame, err, tt.want)
+			}
+		})
+	}
+
+	// 帧选择不受 ENABLE_EXTRA_PARAMS 限制
+	config.Config.EnableExtraParams = false
+	if got, err := parseQuery(t, "frame=1"); err != nil || got.Frame == nil || *got.Frame != 1 {
+		t.Fatalf("parseExtraParams() = %+v, %v, want frame 1 with extra params disabled", got, err)
+	}
+}
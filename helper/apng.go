@@ -0,0 +1,109 @@
+package helper
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const pngSignature = "\x89PNG\r\n\x1a\n"
+
+// 一个 PNG 中 IHDR 和图像数据块
+type pngFrame struct {
+	ihdr []byte
+	idat [][]byte
+}
+
+// 把尺寸和像素格式相同的多张 PNG 合成为 APNG
+// delays 为每帧的毫秒数（不足时沿用最后一个，没有时为 100ms），loop 为 0 表示无限循环
+func AssembleAPNG(frames [][]byte, delays []int, loop int) ([]byte, error) {
+	if len(frames) == 0 {
+		return nil, errors.New("APNG 至少需要一帧")
+	}
+	parsed := make([]pngFrame, len(frames))
+	for i, data := range frames {
+		frame, err := parsePNGFrame(data)
+		if err != nil {
+			return nil, fmt.Errorf("第 %d 帧: %v", i, err)
+		}
+		// APNG 所有帧共用 IHDR，尺寸、位深和颜色类型必须一致
+		if i > 0 && !bytes.Equal(frame.ihdr, parsed[0].ihdr) {
+			return nil, fmt.Errorf("第 %d 帧的 IHDR 与第一帧不一致", i)
+		}
+		parsed[i] = frame
+	}
+
+	ihdr := parsed[0].ihdr
+	out := []byte(pngSignature)
+	out = appendPNGChunk(out, "IHDR", ihdr)
+
+	actl := binary.BigEndian.AppendUint32(nil, uint32(len(frames)))
+	actl = binary.BigEndian.AppendUint32(actl, uint32(max(loop, 0)))
+	out = appendPNGChunk(out, "acTL", actl)
+
+	// fcTL 和 fdAT 共用一个从 0 开始的序号
+	var sequence uint32
+	for i, frame := range parsed {
+		delay := 100
+		if len(delays) > 0 {
+			delay = delays[min(i, len(delays)-1)]
+		}
+		fctl := binary.BigEndian.AppendUint32(nil, sequence)
+		fctl = append(fctl, ihdr[:8]...) // width, height
+		fctl = binary.BigEndian.AppendUint32(fctl, 0)
+		fctl = binary.BigEndian.AppendUint32(fctl, 0)
+		fctl = binary.BigEndian.AppendUint16(fctl, uint16(min(max(delay, 0), 65535)))
+		fctl = binary.BigEndian.AppendUint16(fctl, 1000)
+		// 每帧都是完整画面，直接替换上一帧
+		fctl = append(fctl, 0, 0)
+		out = appendPNGChunk(out, "fcTL", fctl)
+		sequence++
+
+		for _, idat := range frame.idat {
+			// 第一帧使用 IDAT，作为不支持 APNG 的客户端看到的静态图
+			if i == 0 {
+				out = appendPNGChunk(out, "IDAT", idat)
+				continue
+			}
+			fdat := binary.BigEndian.AppendUint32(nil, sequence)
+			out = appendPNGChunk(out, "fdAT", append(fdat, idat...))
+			sequence++
+		}
+	}
+	return appendPNGChunk(out, "IEND", nil), nil
+}
+
+// 读取 PNG 的 IHDR 和所有 IDAT 块，其他块忽略
+func parsePNGFrame(data []byte) (pngFrame, error) {
+	var frame pngFrame
+	if !bytes.HasPrefix(data, []byte(pngSignature)) {
+		return frame, errors.New("不是 PNG")
+	}
+	pos := len(pngSignature)
+	for pos+12 <= len(data) {
+		length := int(binary.BigEndian.Uint32(data[pos:]))
+		if length < 0 || pos+12+length > len(data) {
+			return frame, errors.New("无效的 PNG 块长度")
+		}
+		chunkType := string(data[pos+4 : pos+8])
+		body := data[pos+8 : pos+8+length]
+		pos += 12 + length
+
+		switch chunkType {
+		case "IHDR":
+			frame.ihdr = body
+		case "PLTE":
+			// 各帧的调色板不同，无法共用
+			return frame, errors.New("不支持调色板 PNG")
+		case "IDAT":
+			frame.idat = append(frame.idat, body)
+		case "IEND":
+			pos = len(data)
+		}
+	}
+	if len(frame.ihdr) != 13 || len(frame.idat) == 0 {
+		return frame, errors.New("PNG 缺少 IHDR 或 IDAT")
+	}
+	return frame, nil
+}
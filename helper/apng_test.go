@@ -0,0 +1,176 @@
+package helper
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/png"
+	"slices"
+	"testing"
+)
+
+func encodeTestPNG(t *testing.T, img image.Image) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	encoder := png.Encoder{CompressionLevel: png.NoCompression}
+	if err := encoder.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func rgbaFrame(t *testing.T, width, height int, c color.RGBA) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for i := 0; i < len(img.Pix); i += 4 {
+		img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3] = c.R, c.G, c.B, 0x80
+	}
+	return encodeTestPNG(t, img)
+}
+
+type apngChunk struct {
+	chunkType string
+	body      []byte
+}
+
+func apngChunks(t *testing.T, data []byte) []apngChunk {
+	t.Helper()
+	var chunks []apngChunk
+	types, tail := pngChunks(t, data)
+	if len(tail) != 0 {
+		t.Fatalf("%d bytes after IEND", len(tail))
+	}
+	pos := len(pngSignature)
+	for _, chunkType := range types {
+		length := int(binary.BigEndian.Uint32(data[pos:]))
+		chunks = append(chunks, apngChunk{chunkType, data[pos+8 : pos+8+length]})
+		pos += 12 + length
+	}
+	return chunks
+}
+
+func TestAssembleAPNG(t *testing.T) {
+	red := color.RGBA{R: 0xff}
+	frames := [][]byte{
+		rgbaFrame(t, 4, 3, red),
+		rgbaFrame(t, 4, 3, color.RGBA{G: 0xff}),
+		rgbaFrame(t, 4, 3, color.RGBA{B: 0xff}),
+	}
+
+	tests := []struct {
+		name       string
+		delays     []int
+		loop       int
+		wantDelays []uint16
+		wantLoop   uint32
+	}{
+		{"per-frame delays", []int{10, 20, 30}, 2, []uint16{10, 20, 30}, 2},
+		{"short delays reuse the last one", []int{50}, 0, []uint16{50, 50, 50}, 0},
+		{"default delay", nil, 0, []uint16{100, 100, 100}, 0},
+		{"clamped delays and loop", []int{-5, 70000}, -1, []uint16{0, 65535, 65535}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := AssembleAPNG(frames, tt.delays, tt.loop)
+			if err != nil {
+				t.Fatal(err)
+			}
+			chunks := apngChunks(t, data)
+			var types []string
+			var delays []uint16
+			var sequence []uint32
+			for _, chunk := range chunks {
+				types = append(types, chunk.chunkType)
+				switch chunk.chunkType {
+				case "acTL":
+					if frames := binary.BigEndian.Uint32(chunk.body); frames != 3 {
+						t.Errorf("acTL frames = %d, want 3", frames)
+					}
+					if loop := binary.BigEndian.Uint32(chunk.body[4:]); loop != tt.wantLoop {
+						t.Errorf("acTL loop = %d, want %d", loop, tt.wantLoop)
+					}
+				case "fcTL":
+					sequence = append(sequence, binary.BigEndian.Uint32(chunk.body))
+					if width, height := binary.BigEndian.Uint32(chunk.body[4:]), binary.BigEndian.Uint32(chunk.body[8:]); width != 4 || height != 3 {
+						t.Errorf("fcTL size = %dx%d, want 4x3", width, height)
+					}
+					delays = append(delays, binary.BigEndian.Uint16(chunk.body[20:]))
+				case "fdAT":
+					sequence = append(sequence, binary.BigEndian.Uint32(chunk.body))
+				}
+			}
+			wantTypes := []string{"IHDR", "acTL", "fcTL", "IDAT", "fcTL", "fdAT", "fcTL", "fdAT", "IEND"}
+			if !slices.Equal(types, wantTypes) {
+				t.Fatalf("chunks = %v, want %v", types, wantTypes)
+			}
+			if !slices.Equal(sequence, []uint32{0, 1, 2, 3, 4}) {
+				t.Fatalf("sequence numbers = %v", sequence)
+			}
+			if !slices.Equal(delays, tt.wantDelays) {
+				t.Fatalf("delays = %v, want %v", delays, tt.wantDelays)
+			}
+
+			// 不支持 APNG 的解码器看到第一帧
+			img, err := png.Decode(bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r, g, _, _ := img.At(0, 0).RGBA(); r == 0 || g != 0 {
+				t.Fatalf("first frame pixel = %v", img.At(0, 0))
+			}
+		})
+	}
+
+	t.Run("probe counts frames", func(t *testing.T) {
+		data, err := AssembleAPNG(frames, nil, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		probe, err := ProbeImage(writeTestFile(t, "a.png", data))
+		if err != nil || probe.Frames != 3 || probe.Width != 4 || probe.Height != 3 {
+			t.Fatalf("ProbeImage() = %+v, %v", probe, err)
+		}
+	})
+}
+
+func TestAssembleAPNGErrors(t *testing.T) {
+	frame := rgbaFrame(t, 4, 3, color.RGBA{R: 0xff})
+	paletted := image.NewPaletted(image.Rect(0, 0, 4, 3), color.Palette{color.Black, color.White})
+
+	tests := []struct {
+		name   string
+		frames [][]byte
+	}{
+		{"no frames", nil},
+		{"not png", [][]byte{frame, []byte("GIF89a")}},
+		{"different size", [][]byte{frame, rgbaFrame(t, 3, 4, color.RGBA{})}},
+		{"palette", [][]byte{encodeTestPNG(t, paletted)}},
+		{"truncated chunk", [][]byte{frame[:len(frame)-20]}},
+		{"missing IDAT", [][]byte{testPNG(4, 3)[:33]}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := AssembleAPNG(tt.frames, nil, 0); err == nil {
+				t.Fatal("AssembleAPNG() should fail")
+			}
+		})
+	}
+}
+
+func TestParsePNGFrameIgnoresTrailingData(t *testing.T) {
+	frame := rgbaFrame(t, 4, 3, color.RGBA{R: 0xff})
+	// IEND 之后看起来像 IDAT 的数据不属于图像
+	withTail := append(slices.Clone(frame), pngChunk("IDAT", []byte("garbage"))...)
+	parsed, err := parsePNGFrame(withTail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	original, err := parsePNGFrame(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parsed.idat) != len(original.idat) {
+		t.Fatalf("%d IDAT chunks, want %d", len(parsed.idat), len(original.idat))
+	}
+}
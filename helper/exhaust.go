@@ -0,0 +1,120 @@
+package helper
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"webp_server_go/config"
+
+	"github.com/cespare/xxhash"
+)
+
+// EXHAUST_PATH 的目录布局
+const (
+	ExhaustLayoutMirror  = "mirror"  // 按请求路径镜像，例如 EXHAUST_PATH/img/a_w200_h0_mw0_mh0.jpg
+	ExhaustLayoutSharded = "sharded" // 按缓存键哈希分片，例如 EXHAUST_PATH/ab/cd/abcd....jpg，旁边附带 .json 记录缓存键
+)
+
+type ExhaustSidecar struct {
+	Key         string `json:"key"`
+	ContentType string `json:"content_type"`
+}
+
+// 根据缓存键（请求路径加变体后缀）得到 EXHAUST_PATH 中的文件路径
+func ExhaustFilename(key string) string {
+	if config.Config.ExhaustLayout == ExhaustLayoutSharded {
+		return ShardedExhaustFilename(key)
+	}
+	return path.Join(config.Config.ExhaustPath, key)
+}
+
+func ShardedExhaustFilename(key string) string {
+	key = path.Clean("/" + key)
+	hash := fmt.Sprintf("%016x", xxhash.Sum64String(key))
+	return path.Join(config.Config.ExhaustPath, hash[0:2], hash[2:4], hash+path.Ext(key))
+}
+
+func sidecarFilename(exhaustFilename string) string {
+	return strings.TrimSuffix(exhaustFilename, path.Ext(exhaustFilename)) + ".json"
+}
+
+// 分片布局下写入记录缓存键和实际内容类型的旁路文件
+func WriteExhaustSidecar(exhaustFilename, key string) error {
+	sidecar := ExhaustSidecar{
+		Key:         path.Clean("/" + key),
+		ContentType: sniffContentType(exhaustFilename),
+	}
+	buf, err := json.Marshal(sidecar)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(sidecarFilename(exhaustFilename), buf, 0600)
+}
+
+func ReadExhaustSidecar(exhaustFilename string) (ExhaustSidecar, error) {
+	var sidecar ExhaustSidecar
+	buf, err := os.ReadFile(sidecarFilename(exhaustFilename))
+	if err != nil {
+		return sidecar, err
+	}
+	err = json.Unmarshal(buf, &sidecar)
+	return sidecar, err
+}
+
+func IsExhaustSidecar(filename string) bool {
+	return path.Ext(filename) == ".json"
+}
+
+// 删除缓存文件对应的旁路文件（如果存在），返回删除的字节数
+func RemoveExhaustSidecar(exhaustFilename string) int64 {
+	sidecar := sidecarFilename(exhaustFilename)
+	info, err := os.Stat(sidecar)
+	if err != nil || os.Remove(sidecar) != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+// 返回 EXHAUST_PATH 中某个文件的缓存键，有旁路文件时以其为准，否则按镜像布局还原
+func ExhaustKey(exhaustFilename string) string {
+	if sidecar, err := ReadExhaustSidecar(exhaustFilename); err == nil && sidecar.Key != "" {
+		return sidecar.Key
+	}
+	rel, _ := filepath.Rel(config.Config.ExhaustPath, exhaustFilename)
+	return path.Clean("/" + filepath.ToSlash(rel))
+}
+
+// 遍历 EXHAUST_PATH 中的缓存文件及其缓存键，兼容两种布局以及迁移中的混合目录
+func WalkExhaust(fn func(file string, info os.FileInfo, key string)) {
+	_ = filepath.Walk(config.Config.ExhaustPath, func(file string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || IsExhaustSidecar(file) || strings.HasSuffix(file, ".tmp") {
+			return nil
+		}
+		fn(file, info, ExhaustKey(file))
+		return nil
+	})
+}
+
+// 缓存文件的实际内容类型，与请求路径的扩展名无关（例如 .jpg 请求返回 WebP）
+func ExhaustContentType(exhaustFilename string) string {
+	if sidecar, err := ReadExhaustSidecar(exhaustFilename); err == nil && sidecar.ContentType != "" {
+		return sidecar.ContentType
+	}
+	return sniffContentType(exhaustFilename)
+}
+
+func sniffContentType(filename string) string {
+	f, err := os.Open(filename)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	// filetype 只需要文件头
+	buf := make([]byte, 8192)
+	n, _ := io.ReadFull(f, buf)
+	return GetContentType(buf[:n])
+}
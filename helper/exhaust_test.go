@@ -0,0 +1,96 @@
+package helper
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"webp_server_go/config"
+)
+
+func withExhaustLayout(t *testing.T, layout string) {
+	t.Helper()
+	oldPath, oldLayout := config.Config.ExhaustPath, config.Config.ExhaustLayout
+	config.Config.ExhaustPath, config.Config.ExhaustLayout = t.TempDir(), layout
+	t.Cleanup(func() { config.Config.ExhaustPath, config.Config.ExhaustLayout = oldPath, oldLayout })
+}
+
+func TestExhaustFilename(t *testing.T) {
+	withExhaustLayout(t, ExhaustLayoutMirror)
+	const key = "/img/a_w200_h0_mw0_mh0.jpg"
+	if got, want := ExhaustFilename(key), filepath.Join(config.Config.ExhaustPath, key); got != want {
+		t.Fatalf("mirror ExhaustFilename() = %q, want %q", got, want)
+	}
+	if got := ExhaustKey(ExhaustFilename(key)); got != key {
+		t.Fatalf("mirror ExhaustKey() = %q, want %q", got, key)
+	}
+
+	config.Config.ExhaustLayout = ExhaustLayoutSharded
+	sharded := ExhaustFilename(key)
+	rel, _ := filepath.Rel(config.Config.ExhaustPath, sharded)
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	if len(parts) != 3 || !strings.HasPrefix(parts[2], parts[0]+parts[1]) || filepath.Ext(sharded) != ".jpg" {
+		t.Fatalf("sharded ExhaustFilename() = %q, want ab/cd/abcd....jpg", rel)
+	}
+	if ExhaustFilename("img/a_w200_h0_mw0_mh0.jpg") != sharded {
+		t.Fatal("keys should be normalised before hashing")
+	}
+	if ExhaustFilename("/img/b.jpg") == sharded {
+		t.Fatal("different keys should not share a file")
+	}
+}
+
+func TestExhaustSidecar(t *testing.T) {
+	withExhaustLayout(t, ExhaustLayoutSharded)
+	const key = "/img/a.png"
+	file := ExhaustFilename(key)
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		t.Fatal(err)
+	}
+	// 内容是 WebP，扩展名仍为 .png
+	if err := os.WriteFile(file, []byte("RIFF\x0c\x00\x00\x00WEBPVP8L\x00\x00\x00\x00"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteExhaustSidecar(file, "img/a.png"); err != nil {
+		t.Fatal(err)
+	}
+
+	sidecar, err := ReadExhaustSidecar(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sidecar.Key != key || sidecar.ContentType != "image/webp" {
+		t.Fatalf("sidecar = %+v", sidecar)
+	}
+	if got := ExhaustKey(file); got != key {
+		t.Fatalf("ExhaustKey() = %q, want the key from the sidecar %q", got, key)
+	}
+
+	var walked []string
+	WalkExhaust(func(_ string, _ os.FileInfo, key string) { walked = append(walked, key) })
+	if len(walked) != 1 || walked[0] != key {
+		t.Fatalf("WalkExhaust() keys = %v, want [%s]", walked, key)
+	}
+
+	if RemoveExhaustSidecar(file) == 0 || IsExhaustSidecar(file) {
+		t.Fatal("RemoveExhaustSidecar() should remove the sidecar")
+	}
+	if _, err := ReadExhaustSidecar(file); err == nil {
+		t.Fatal("sidecar still exists")
+	}
+}
+
+func TestExhaustContentTypeAnimatedAvif(t *testing.T) {
+	withExhaustLayout(t, ExhaustLayoutMirror)
+	// avif 动图请求返回 WebP 动图，Content-Type 按文件内容判断
+	file := ExhaustFilename("/img/anim.gif.avif")
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(file, []byte("RIFF\x0c\x00\x00\x00WEBPVP8X\x00\x00\x00\x00"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := ExhaustContentType(file); got != "image/webp" {
+		t.Fatalf("ExhaustContentType() = %q, want image/webp", got)
+	}
+}
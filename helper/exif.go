@@ -0,0 +1,219 @@
+package helper
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"slices"
+	"webp_server_go/config"
+)
+
+// JPEG APP1 以及部分 WebP 编码器在 TIFF 数据前加的前缀
+const exifPrefix = "Exif\x00\x00"
+
+// EXIF 中用到的标签
+const (
+	exifTagOrientation = 0x0112
+	exifTagArtist      = 0x013b
+	exifTagCopyright   = 0x8298
+	exifTagGPSInfo     = 0x8825
+)
+
+var errBadExif = errors.New("无效的 EXIF 数据")
+
+// 各 TIFF 数据类型单个值的字节数
+var tiffTypeSizes = map[uint16]uint32{
+	1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8, 13: 4,
+}
+
+// TIFF 数据可能是大端或小端，既要读取也要写入
+type byteOrder interface {
+	binary.ByteOrder
+	binary.AppendByteOrder
+}
+
+type tiffEntry struct {
+	tag, typ uint16
+	count    uint32
+	value    []byte
+}
+
+// 按元数据策略过滤 EXIF（可以带 Exif\0\0 前缀），返回 nil 表示应整体删除
+// strip 和 copyright 重新生成只含保留标签的 EXIF，nogps 原地删除 GPS IFD
+func FilterExif(exif []byte, policy string) ([]byte, error) {
+	prefix := ""
+	tiff := exif
+	if bytes.HasPrefix(exif, []byte(exifPrefix)) {
+		prefix = exifPrefix
+		tiff = exif[len(exifPrefix):]
+	}
+
+	var (
+		filtered []byte
+		err      error
+	)
+	switch policy {
+	case config.MetadataKeep:
+		return exif, nil
+	case config.MetadataStrip:
+		filtered, err = rebuildExif(tiff, exifTagOrientation)
+	case config.MetadataCopyright:
+		filtered, err = rebuildExif(tiff, exifTagOrientation, exifTagArtist, exifTagCopyright)
+	case config.MetadataNoGPS:
+		filtered, err = removeExifGPS(tiff)
+	default:
+		return nil, errors.New("未知的元数据策略: " + policy)
+	}
+	if err != nil || filtered == nil {
+		return nil, err
+	}
+	return append([]byte(prefix), filtered...), nil
+}
+
+// 解析 TIFF 头，返回字节序和 IFD0 的偏移
+func tiffHeader(tiff []byte) (byteOrder, uint32, error) {
+	if len(tiff) < 8 {
+		return nil, 0, errBadExif
+	}
+	var order byteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil, 0, errBadExif
+	}
+	if order.Uint16(tiff[2:]) != 42 {
+		return nil, 0, errBadExif
+	}
+	return order, order.Uint32(tiff[4:]), nil
+}
+
+// 读取 offset 处 IFD 的所有条目，value 为值的原始字节
+func readIFD(tiff []byte, order byteOrder, offset uint32) ([]tiffEntry, error) {
+	if uint64(offset)+2 > uint64(len(tiff)) {
+		return nil, errBadExif
+	}
+	count := uint32(order.Uint16(tiff[offset:]))
+	if uint64(offset)+2+uint64(count)*12+4 > uint64(len(tiff)) {
+		return nil, errBadExif
+	}
+	entries := make([]tiffEntry, 0, count)
+	for i := range count {
+		raw := tiff[offset+2+i*12:]
+		entry := tiffEntry{tag: order.Uint16(raw), typ: order.Uint16(raw[2:]), count: order.Uint32(raw[4:])}
+		size, ok := tiffTypeSizes[entry.typ]
+		if !ok {
+			// 未知类型无法确定长度，跳过该条目
+			continue
+		}
+		length := uint64(size) * uint64(entry.count)
+		if length <= 4 {
+			entry.value = raw[8 : 8+length]
+		} else {
+			start := uint64(order.Uint32(raw[8:]))
+			// 值超出数据范围（数据被截断或只读取了文件头），跳过该条目
+			if start+length > uint64(len(tiff)) {
+				continue
+			}
+			entry.value = tiff[start : start+length]
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// 用 IFD0 中指定的标签生成新的 TIFF，没有任何保留标签时返回 nil
+func rebuildExif(tiff []byte, keep ...uint16) ([]byte, error) {
+	order, ifd0, err := tiffHeader(tiff)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := readIFD(tiff, order, ifd0)
+	if err != nil {
+		return nil, err
+	}
+	entries = slices.DeleteFunc(entries, func(entry tiffEntry) bool {
+		return !slices.Contains(keep, entry.tag)
+	})
+	// 方向为 1 时与没有该标签相同
+	entries = slices.DeleteFunc(entries, func(entry tiffEntry) bool {
+		return entry.tag == exifTagOrientation && entry.typ == 3 && entry.count == 1 && order.Uint16(entry.value) == 1
+	})
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	// IFD 中的条目必须按标签升序排列
+	slices.SortFunc(entries, func(a, b tiffEntry) int {
+		return int(a.tag) - int(b.tag)
+	})
+
+	out := make([]byte, 8, 64)
+	copy(out, tiff[:4])
+	order.PutUint32(out[4:], 8)
+	out = order.AppendUint16(out, uint16(len(entries)))
+	dataOffset := uint32(8 + 2 + len(entries)*12 + 4)
+	var data []byte
+	for _, entry := range entries {
+		out = order.AppendUint16(out, entry.tag)
+		out = order.AppendUint16(out, entry.typ)
+		out = order.AppendUint32(out, entry.count)
+		if len(entry.value) <= 4 {
+			value := make([]byte, 4)
+			copy(value, entry.value)
+			out = append(out, value...)
+			continue
+		}
+		out = order.AppendUint32(out, dataOffset+uint32(len(data)))
+		data = append(data, entry.value...)
+		// 值的偏移需要按字对齐
+		if len(data)%2 == 1 {
+			data = append(data, 0)
+		}
+	}
+	// 没有下一个 IFD（缩略图也一并删除）
+	out = order.AppendUint32(out, 0)
+	return append(out, data...), nil
+}
+
+// 从 IFD0 中删除 GPS IFD 指针，并把 GPS IFD 及其数据清零，其余内容保持不变
+func removeExifGPS(tiff []byte) ([]byte, error) {
+	order, ifd0, err := tiffHeader(tiff)
+	if err != nil {
+		return nil, err
+	}
+	if uint64(ifd0)+2 > uint64(len(tiff)) {
+		return nil, errBadExif
+	}
+	count := uint32(order.Uint16(tiff[ifd0:]))
+	end := uint64(ifd0) + 2 + uint64(count)*12 + 4
+	if end > uint64(len(tiff)) {
+		return nil, errBadExif
+	}
+
+	out := slices.Clone(tiff)
+	for i := range count {
+		entryOffset := ifd0 + 2 + i*12
+		if order.Uint16(out[entryOffset:]) != exifTagGPSInfo {
+			continue
+		}
+		gps := order.Uint32(out[entryOffset+8:])
+		if gpsEntries, err := readIFD(out, order, gps); err == nil {
+			// 先清零 IFD 外的值，再清零 IFD 本身
+			for _, entry := range gpsEntries {
+				if len(entry.value) > 4 {
+					clear(entry.value)
+				}
+			}
+			gpsCount := uint32(order.Uint16(out[gps:]))
+			clear(out[gps : gps+2+gpsCount*12+4])
+		}
+		// 后面的条目和下一个 IFD 的偏移前移一个条目
+		copy(out[entryOffset:end-12], out[entryOffset+12:end])
+		clear(out[end-12 : end])
+		order.PutUint16(out[ifd0:], uint16(count-1))
+		return out, nil
+	}
+	return out, nil
+}
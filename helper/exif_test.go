@@ -0,0 +1,195 @@
+package helper
+
+import (
+	"bytes"
+	"encoding/binary"
+	"slices"
+	"testing"
+	"webp_server_go/config"
+)
+
+// 按给定顺序写出只有 IFD0 的 TIFF，超过 4 字节的值放在 IFD 之后
+func buildTIFF(order byteOrder, entries ...tiffEntry) []byte {
+	out := []byte("II*\x00")
+	if order == binary.BigEndian {
+		out = []byte("MM\x00*")
+	}
+	out = order.AppendUint32(out, 8)
+	out = order.AppendUint16(out, uint16(len(entries)))
+	dataOffset := uint32(8 + 2 + len(entries)*12 + 4)
+	var data []byte
+	for _, entry := range entries {
+		out = order.AppendUint16(out, entry.tag)
+		out = order.AppendUint16(out, entry.typ)
+		out = order.AppendUint32(out, entry.count)
+		if len(entry.value) <= 4 {
+			value := make([]byte, 4)
+			copy(value, entry.value)
+			out = append(out, value...)
+			continue
+		}
+		out = order.AppendUint32(out, dataOffset+uint32(len(data)))
+		data = append(data, entry.value...)
+	}
+	out = order.AppendUint32(out, 0)
+	return append(out, data...)
+}
+
+func shortEntry(order byteOrder, tag, value uint16) tiffEntry {
+	return tiffEntry{tag: tag, typ: 3, count: 1, value: order.AppendUint16(nil, value)}
+}
+
+func asciiEntry(tag uint16, value string) tiffEntry {
+	return tiffEntry{tag: tag, typ: 2, count: uint32(len(value) + 1), value: append([]byte(value), 0)}
+}
+
+// IFD0 中的标签及其值
+func exifTags(t *testing.T, exif []byte) map[uint16][]byte {
+	t.Helper()
+	order, ifd0, err := tiffHeader(bytes.TrimPrefix(exif, []byte(exifPrefix)))
+	if err != nil {
+		t.Fatalf("tiffHeader: %v", err)
+	}
+	entries, err := readIFD(bytes.TrimPrefix(exif, []byte(exifPrefix)), order, ifd0)
+	if err != nil {
+		t.Fatalf("readIFD: %v", err)
+	}
+	tags := map[uint16][]byte{}
+	for _, entry := range entries {
+		tags[entry.tag] = entry.value
+	}
+	return tags
+}
+
+func sortedTags(tags map[uint16][]byte) []uint16 {
+	var keys []uint16
+	for tag := range tags {
+		keys = append(keys, tag)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+func TestFilterExif(t *testing.T) {
+	const exifTagMake = 0x010f
+	for _, order := range []byteOrder{binary.LittleEndian, binary.BigEndian} {
+		full := buildTIFF(order,
+			asciiEntry(exifTagMake, "Canon"),
+			shortEntry(order, exifTagOrientation, 6),
+			asciiEntry(exifTagArtist, "Someone"),
+			asciiEntry(exifTagCopyright, "(c) Someone"),
+		)
+		upright := buildTIFF(order, asciiEntry(exifTagMake, "Canon"), shortEntry(order, exifTagOrientation, 1))
+
+		tests := []struct {
+			name     string
+			exif     []byte
+			policy   string
+			wantTags []uint16 // nil: the whole EXIF is removed
+		}{
+			{"strip keeps orientation", full, config.MetadataStrip, []uint16{exifTagOrientation}},
+			{"strip with prefix", append([]byte(exifPrefix), full...), config.MetadataStrip, []uint16{exifTagOrientation}},
+			{"strip drops upright orientation", upright, config.MetadataStrip, nil},
+			{"copyright", full, config.MetadataCopyright, []uint16{exifTagOrientation, exifTagArtist, exifTagCopyright}},
+			{"nogps without gps", full, config.MetadataNoGPS, []uint16{exifTagMake, exifTagOrientation, exifTagArtist, exifTagCopyright}},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				got, err := FilterExif(tt.exif, tt.policy)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if tt.wantTags == nil {
+					if got != nil {
+						t.Fatalf("FilterExif() = %x, want nil", got)
+					}
+					return
+				}
+				if bytes.HasPrefix(tt.exif, []byte(exifPrefix)) != bytes.HasPrefix(got, []byte(exifPrefix)) {
+					t.Fatal("Exif prefix not preserved")
+				}
+				tags := exifTags(t, got)
+				if !slices.Equal(sortedTags(tags), tt.wantTags) {
+					t.Fatalf("tags = %x, want %x", sortedTags(tags), tt.wantTags)
+				}
+				if value, ok := tags[exifTagArtist]; ok && string(value) != "Someone\x00" {
+					t.Fatalf("Artist = %q", value)
+				}
+			})
+		}
+	}
+}
+
+func TestFilterExifNoGPS(t *testing.T) {
+	order := binary.LittleEndian
+	// IFD0: Orientation、GPS 指针；GPS IFD 中的纬度为 RATIONAL x3，值在 IFD 之外
+	tiff := buildTIFF(order, shortEntry(order, exifTagOrientation, 6), tiffEntry{tag: exifTagGPSInfo, typ: 4, count: 1})
+	gps := uint32(len(tiff))
+	order.PutUint32(tiff[8+2+12+8:], gps)
+	latitude := bytes.Repeat([]byte{0x42}, 24)
+	tiff = order.AppendUint16(tiff, 1)
+	tiff = order.AppendUint16(tiff, 0x0002)
+	tiff = order.AppendUint16(tiff, 5)
+	tiff = order.AppendUint32(tiff, 3)
+	tiff = order.AppendUint32(tiff, gps+2+12+4)
+	tiff = order.AppendUint32(tiff, 0)
+	tiff = append(tiff, latitude...)
+
+	got, err := FilterExif(tiff, config.MetadataNoGPS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(tiff) {
+		t.Fatalf("nogps should edit in place, length %d -> %d", len(tiff), len(got))
+	}
+	if tags := exifTags(t, got); !slices.Equal(sortedTags(tags), []uint16{exifTagOrientation}) {
+		t.Fatalf("tags = %x, want only orientation", sortedTags(tags))
+	}
+	if bytes.Contains(got, latitude[:8]) {
+		t.Fatal("GPS values were not cleared")
+	}
+	if !bytes.Contains(tiff, latitude) {
+		t.Fatal("input was modified instead of copied")
+	}
+}
+
+func TestFilterExifMalformed(t *testing.T) {
+	order := binary.LittleEndian
+	valid := buildTIFF(order, shortEntry(order, exifTagOrientation, 6), asciiEntry(exifTagArtist, "Someone"))
+
+	// 值的偏移超出数据范围时只跳过该条目
+	outOfRange := slices.Clone(valid)
+	order.PutUint32(outOfRange[8+2+12+8:], 0xffff)
+	got, err := FilterExif(outOfRange, config.MetadataCopyright)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tags := exifTags(t, got); !slices.Equal(sortedTags(tags), []uint16{exifTagOrientation}) {
+		t.Fatalf("tags = %x, want only orientation", sortedTags(tags))
+	}
+
+	tests := []struct {
+		name   string
+		exif   []byte
+		policy string
+	}{
+		{"empty", nil, config.MetadataStrip},
+		{"bad byte order", append([]byte("XX"), valid[2:]...), config.MetadataStrip},
+		{"bad magic", append([]byte("II\x2b\x00"), valid[4:]...), config.MetadataStrip},
+		{"ifd0 out of range", append(append([]byte("II*\x00"), order.AppendUint32(nil, 0xffff)...), valid[8:]...), config.MetadataStrip},
+		{"truncated ifd", valid[:20], config.MetadataCopyright},
+		{"truncated ifd nogps", valid[:20], config.MetadataNoGPS},
+		{"unknown policy", valid, "bogus"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, err := FilterExif(tt.exif, tt.policy); err == nil {
+				t.Fatalf("FilterExif() = %x, want error", got)
+			}
+		})
+	}
+
+	if got, err := FilterExif(valid, config.MetadataKeep); err != nil || !bytes.Equal(got, valid) {
+		t.Fatalf("keep should return the input unchanged, got %x, %v", got, err)
+	}
+}
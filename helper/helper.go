@@ -3,9 +3,12 @@ package helper
 import (
 	"fmt"
 	"io"
+	"maps"
+	"net/url"
 	"os"
 	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 	"webp_server_go/config"
@@ -105,17 +108,29 @@ func GenOptimizedAbsPath(metadata config.MetaFile, subdir string) (string, strin
 }
 
 func GetCompressionRate(RawImagePath string, optimizedImg string) string {
+	originalSize, optimizedSize, err := compressionSizes(RawImagePath, optimizedImg)
+	if err != nil {
+		return ""
+	}
+	return formatCompressionRate(originalSize, optimizedSize)
+}
+
+func compressionSizes(RawImagePath string, optimizedImg string) (int64, int64, error) {
 	originFileInfo, err := os.Stat(RawImagePath)
 	if err != nil {
 		log.Warnf("Failed to get raw image %v", err)
-		return ""
+		return 0, 0, err
 	}
 	optimizedFileInfo, err := os.Stat(optimizedImg)
 	if err != nil {
 		log.Warnf("Failed to get optimized image %v", err)
-		return ""
+		return 0, 0, err
 	}
-	compressionRate := float64(optimizedFileInfo.Size()) / float64(originFileInfo.Size())
+	return originFileInfo.Size(), optimizedFileInfo.Size(), nil
+}
+
+func formatCompressionRate(originalSize, optimizedSize int64) string {
+	compressionRate := float64(optimizedSize) / float64(originalSize)
 	return fmt.Sprintf(`%.2f`, compressionRate)
 }
 
@@ -221,7 +236,7 @@ func IsFileSizeSmall(filepath string, sizeLimit int64) (bool, error) {
 }
 
 // 新增：检查文件是否为允许的图片的辅助函数
-var defaultAllowedTypes = []string{"jpg", "png", "jpeg", "bmp", "gif", "svg", "nef", "heic", "webp"}
+var defaultAllowedTypes = []string{"jpg", "png", "jpeg", "bmp", "gif", "svg", "nef", "cr2", "cr3", "arw", "dng", "raf", "orf", "heic", "webp"}
 
 func IsAllowedImageFile(filename string) bool {
 	ext := strings.ToLower(path.Ext(filename))
@@ -268,3 +283,111 @@ func CopyFile(src, dst string) error {
 	_, err = io.Copy(destination, source)
 	return err
 }
+
+// 查找请求路径匹配的 IMG_MAP 前缀及其目标
+func FindMatchingPrefix(reqURI string) (string, string) {
+	for prefix, target := range config.Config.ImageMap {
+		if strings.HasPrefix(reqURI, prefix) {
+			return prefix, target
+		}
+	}
+	return "", ""
+}
+
+// 根据缓存中记录的源地址（请求路径、本地文件路径或远程地址）找到对应的 IMG_MAP 前缀，用于统计
+func PrefixForSource(source string) string {
+	parsed, err := url.Parse(source)
+	if err != nil {
+		return ""
+	}
+	if parsed.Host != "" {
+		for _, prefix := range slices.Sorted(maps.Keys(config.Config.ImageMap)) {
+			if strings.HasPrefix(source, config.Config.ImageMap[prefix]) {
+				return prefix
+			}
+		}
+		return PrefixForHost(parsed.Host)
+	}
+	if prefix, _ := FindMatchingPrefix(parsed.Path); prefix != "" {
+		return prefix
+	}
+	for _, prefix := range slices.Sorted(maps.Keys(config.Config.ImageMap)) {
+		target := config.Config.ImageMap[prefix]
+		if (strings.HasPrefix(target, "./") || strings.HasPrefix(target, "/")) && strings.HasPrefix(path.Clean(parsed.Path), path.Clean(target)+"/") {
+			return prefix
+		}
+	}
+	return ""
+}
+
+// 远程原图缓存按主机分目录，找到指向该主机的 IMG_MAP 前缀，多个前缀指向同一主机时取字典序第一个
+func PrefixForHost(host string) string {
+	for _, prefix := range slices.Sorted(maps.Keys(config.Config.ImageMap)) {
+		if targetUrl, err := url.Parse(config.Config.ImageMap[prefix]); err == nil && targetUrl.Host == host {
+			return prefix
+		}
+	}
+	return ""
+}
+
+// 将请求路径中匹配的前缀替换为远程目标，得到真实的远程地址
+func BuildRealRemoteAddr(targetUrl *url.URL, matchedPrefix, reqURIwithQuery string) string {
+	targetHost := targetUrl.Scheme + "://" + targetUrl.Host
+	reqURIwithQuery = strings.Replace(reqURIwithQuery, matchedPrefix, targetUrl.Path, 1)
+	if strings.HasSuffix(targetUrl.Path, "/") {
+		reqURIwithQuery = strings.TrimPrefix(reqURIwithQuery, "/")
+	}
+	return targetHost + reqURIwithQuery
+}
+
+// 软清除时写入的修改时间，带有该时间戳的缓存文件视为过期，需要重新生成或重新下载
+var StaleModTime = time.Unix(0, 0)
+
+// 将缓存文件标记为过期
+func MarkStale(filename string) error {
+	return os.Chtimes(filename, StaleModTime, StaleModTime)
+}
+
+// 检查缓存文件是否已被软清除
+func IsStale(filename string) bool {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return false
+	}
+	return info.ModTime().Equal(StaleModTime)
+}
+
+func HashBytes(buf []byte) string {
+	return fmt.Sprintf("%x", xxhash.Sum64(buf))
+}
+
+// 将 #rgb、rgb、#rrggbb、#rrggbbaa 等十六进制颜色统一为小写的 rrggbb 或 rrggbbaa
+func NormalizeHexColor(color string) (string, error) {
+	hex := strings.ToLower(strings.TrimPrefix(color, "#"))
+	if len(hex) == 3 || len(hex) == 4 {
+		expanded := ""
+		for _, ch := range hex {
+			expanded += string(ch) + string(ch)
+		}
+		hex = expanded
+	}
+	if len(hex) != 6 && len(hex) != 8 {
+		return "", fmt.Errorf("无效的颜色: %s", color)
+	}
+	if _, err := strconv.ParseUint(hex, 16, 32); err != nil {
+		return "", fmt.Errorf("无效的颜色: %s", color)
+	}
+	if strings.HasSuffix(hex, "ff") && len(hex) == 8 {
+		hex = hex[:6]
+	}
+	return hex, nil
+}
+
+// 解析 NormalizeHexColor 得到的颜色
+func ParseHexColor(hex string) (r, g, b, a uint8) {
+	value, _ := strconv.ParseUint(hex, 16, 32)
+	if len(hex) == 6 {
+		value = value<<8 | 0xff
+	}
+	return uint8(value >> 24), uint8(value >> 16), uint8(value >> 8), uint8(value)
+}
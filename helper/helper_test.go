@@ -0,0 +1,47 @@
+package helper
+
+import "testing"
+
+func TestNormalizeHexColor(t *testing.T) {
+	tests := []struct {
+		color   string
+		want    string
+		wantErr bool
+	}{
+		{"ffffff", "ffffff", false},
+		{"#FFAA00", "ffaa00", false},
+		{"#fa0", "ffaa00", false},
+		{"fa08", "ffaa0088", false},
+		{"#ffaa0080", "ffaa0080", false},
+		{"ffaa00ff", "ffaa00", false},
+		{"", "", true},
+		{"#ff", "", true},
+		{"fffff", "", true},
+		{"gggggg", "", true},
+		{"+fffff", "", true},
+		{"ffaa00ff00", "", true},
+	}
+	for _, tt := range tests {
+		got, err := NormalizeHexColor(tt.color)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("NormalizeHexColor(%q) = %q, %v, want %q, error %v", tt.color, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestParseHexColor(t *testing.T) {
+	tests := []struct {
+		hex        string
+		r, g, b, a uint8
+	}{
+		{"ffaa00", 0xff, 0xaa, 0x00, 0xff},
+		{"10203040", 0x10, 0x20, 0x30, 0x40},
+		{"000000", 0, 0, 0, 0xff},
+	}
+	for _, tt := range tests {
+		r, g, b, a := ParseHexColor(tt.hex)
+		if r != tt.r || g != tt.g || b != tt.b || a != tt.a {
+			t.Errorf("ParseHexColor(%q) = %d, %d, %d, %d, want %d, %d, %d, %d", tt.hex, r, g, b, a, tt.r, tt.g, tt.b, tt.a)
+		}
+	}
+}
@@ -32,11 +32,19 @@ func ReadMetadata(p, etag string, subdir string) config.MetaFile {
 	// try to read metadata, if we can't read, create one
 	var metadata config.MetaFile
 	var id, _, _ = getId(p)
+	prefix := PrefixForSource(p)
 
-	if buf, err := os.ReadFile(path.Join(config.Config.MetadataPath, subdir, id+".json")); err != nil {
+	metadataPath := path.Join(config.Config.MetadataPath, subdir, id+".json")
+	if IsStale(metadataPath) {
+		// 已被软清除，重建元数据
+		RecordCacheStale(TierMetadata, prefix)
+		return WriteMetadata(p, etag, subdir)
+	}
+
+	if buf, err := os.ReadFile(metadataPath); err != nil {
 		// First time reading metadata, create one
-		WriteMetadata(p, etag, subdir)
-		return ReadMetadata(p, etag, subdir)
+		RecordCacheMiss(TierMetadata, prefix)
+		return WriteMetadata(p, etag, subdir)
 	} else {
 		err = json.Unmarshal(buf, &metadata)
 		if err != nil {
@@ -44,6 +52,7 @@ func ReadMetadata(p, etag string, subdir string) config.MetaFile {
 			WriteMetadata(p, etag, subdir)
 			return ReadMetadata(p, etag, subdir)
 		}
+		RecordCacheHit(TierMetadata, prefix)
 		return metadata
 	}
 }
@@ -0,0 +1,316 @@
+package helper
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	"io"
+	"os"
+	"strings"
+	"webp_server_go/config"
+
+	"github.com/h2non/filetype"
+	log "github.com/sirupsen/logrus"
+)
+
+// 只读取文件头得到的图像信息，不解码像素
+type ImageProbe struct {
+	Format string // filetype extension, e.g. jpg, png, gif, webp; lower-case decoder name for camera RAW
+	Width  int    // 0 when the format can't be probed, may be set even when probing fails halfway
+	Height int
+	Frames int
+	Size   int64
+	Raw    bool // camera RAW, pixels and frames are checked on the decoded intermediate file
+}
+
+// 没有内置解析的格式（HEIC、AVIF、TIFF、BMP、SVG 等）读取文件头的方法，由 encoder 使用 libvips 提供
+var HeaderProber func(filename string) (width, height, frames int, err error)
+
+// 输入超出 MAX_INPUT_* 限制或文件头无法解析时返回的错误
+type InputLimitError struct {
+	Reason string // bytes, pixels, frames or header
+	Detail string
+}
+
+func (e *InputLimitError) Error() string {
+	if e.Reason == "header" {
+		return "无法解析输入图像: " + e.Detail
+	}
+	return "输入图像超出限制: " + e.Detail
+}
+
+// 在完整解码之前检查输入文件的字节数、像素数和帧数，超限时记录统计并返回 *InputLimitError
+// 文件头只解析了一部分时按已得到的尺寸检查，完全无法解析时拒绝
+// RAW 文件只检查字节数，像素数和帧数在转换出的中间文件上检查
+func CheckInputLimits(filename string) error {
+	probe, err := ProbeImage(filename)
+	if err != nil && probe.Size == 0 && probe.Format == "" {
+		// 文件无法读取，交给后续的解码流程报错
+		return nil
+	}
+
+	var limitErr *InputLimitError
+	maxBytes, ok := config.Config.MaxInputBytes[probe.Format]
+	if !ok {
+		maxBytes = config.Config.MaxInputBytes["*"]
+	}
+	switch {
+	case maxBytes > 0 && probe.Size > maxBytes:
+		limitErr = &InputLimitError{Reason: "bytes", Detail: fmt.Sprintf("%s 文件大小 %d 超过 %d 字节", probe.Format, probe.Size, maxBytes)}
+	case probe.Raw:
+		return nil
+	case config.Config.MaxInputPixels > 0 && probe.Width*probe.Height > config.Config.MaxInputPixels:
+		limitErr = &InputLimitError{Reason: "pixels", Detail: fmt.Sprintf("%dx%d 超过 %d 像素", probe.Width, probe.Height, config.Config.MaxInputPixels)}
+	case config.Config.MaxInputFrames > 0 && probe.Frames > config.Config.MaxInputFrames:
+		limitErr = &InputLimitError{Reason: "frames", Detail: fmt.Sprintf("%d 帧超过 %d 帧", probe.Frames, config.Config.MaxInputFrames)}
+	case err != nil && (probe.Width <= 0 || probe.Height <= 0):
+		limitErr = &InputLimitError{Reason: "header", Detail: fmt.Sprintf("%s: %v", probe.Format, err)}
+	default:
+		if err != nil {
+			log.Debugf("文件头不完整，按已解析的尺寸 %dx%d 检查: %s, %v", probe.Width, probe.Height, filename, err)
+		}
+		return nil
+	}
+	RecordInputRejected(limitErr.Reason)
+	return limitErr
+}
+
+// 下载远程图像时允许写入的最大字节数。下载前不知道格式，使用所有格式中最大的限制，
+// 没有设置 * 时未列出的格式不受限制，返回 0
+func MaxDownloadBytes() int64 {
+	if config.Config.MaxInputBytes["*"] <= 0 {
+		return 0
+	}
+	var maxBytes int64
+	for _, limit := range config.Config.MaxInputBytes {
+		if limit <= 0 {
+			return 0
+		}
+		maxBytes = max(maxBytes, limit)
+	}
+	return maxBytes
+}
+
+// 读取图像文件头，出错时 probe 中保留已经解析出的字段
+func ProbeImage(filename string) (ImageProbe, error) {
+	var probe ImageProbe
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return probe, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return probe, err
+	}
+	probe.Size = info.Size()
+
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(f, head)
+	kind, _ := filetype.Match(head[:n])
+	probe.Format = kind.Extension
+	probe.Frames = 1
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return probe, err
+	}
+
+	switch probe.Format {
+	case "jpg":
+		var cfg image.Config
+		if cfg, _, err = image.DecodeConfig(f); err == nil {
+			probe.Width, probe.Height = cfg.Width, cfg.Height
+		}
+	case "png":
+		err = probePNG(f, &probe)
+	case "gif":
+		err = probeGIF(bufio.NewReader(f), &probe)
+	case "webp":
+		err = probeWebP(f, &probe)
+	default:
+		// RAW 的 IFD0 通常只是缩略图，尺寸没有意义
+		if decoder := DetectRaw(filename); decoder != nil {
+			probe.Format = strings.ToLower(decoder.Name)
+			probe.Raw = true
+			return probe, nil
+		}
+		err = errBadHeader
+	}
+
+	// 内置解析不支持该格式或完全失败（例如 12 位 JPEG）时，由 libvips 读取文件头
+	if err != nil && probe.Width == 0 && HeaderProber != nil {
+		width, height, frames, proberErr := HeaderProber(filename)
+		if proberErr == nil {
+			probe.Width, probe.Height, probe.Frames = width, height, frames
+		}
+		err = proberErr
+	}
+	return probe, err
+}
+
+var errBadHeader = errors.New("无法解析图像文件头")
+
+// IHDR 记录尺寸，APNG 的 acTL 在 IDAT 之前记录帧数
+func probePNG(r io.ReadSeeker, probe *ImageProbe) error {
+	if _, err := r.Seek(8, io.SeekStart); err != nil {
+		return err
+	}
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			return err
+		}
+		length := int64(binary.BigEndian.Uint32(header[0:4]))
+		switch string(header[4:8]) {
+		case "IHDR", "acTL":
+			data := make([]byte, 8)
+			if length < 8 {
+				return errBadHeader
+			}
+			if _, err := io.ReadFull(r, data); err != nil {
+				return err
+			}
+			if string(header[4:8]) == "IHDR" {
+				probe.Width = int(binary.BigEndian.Uint32(data[0:4]))
+				probe.Height = int(binary.BigEndian.Uint32(data[4:8]))
+			} else {
+				probe.Frames = int(binary.BigEndian.Uint32(data[0:4]))
+			}
+			length -= 8
+		case "IDAT", "IEND":
+			return nil
+		}
+		// 跳过剩余数据和 CRC
+		if _, err := r.Seek(length+4, io.SeekCurrent); err != nil {
+			return err
+		}
+	}
+}
+
+// 逐块遍历 GIF，只统计图像描述符，不解压 LZW 数据
+func probeGIF(r *bufio.Reader, probe *ImageProbe) error {
+	header := make([]byte, 13)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return err
+	}
+	probe.Width = int(binary.LittleEndian.Uint16(header[6:8]))
+	probe.Height = int(binary.LittleEndian.Uint16(header[8:10]))
+	if header[10]&0x80 != 0 {
+		if _, err := r.Discard(3 << ((header[10] & 0x07) + 1)); err != nil {
+			return err
+		}
+	}
+
+	probe.Frames = 0
+	for {
+		block, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		switch block {
+		case 0x21: // 扩展块
+			if _, err := r.ReadByte(); err != nil {
+				return err
+			}
+		case 0x2C: // 图像描述符
+			probe.Frames++
+			descriptor := make([]byte, 9)
+			if _, err := io.ReadFull(r, descriptor); err != nil {
+				return err
+			}
+			// 局部颜色表和 LZW 最小码长
+			skip := 1
+			if descriptor[8]&0x80 != 0 {
+				skip += 3 << ((descriptor[8] & 0x07) + 1)
+			}
+			if _, err := r.Discard(skip); err != nil {
+				return err
+			}
+		case 0x3B: // 结束
+			return nil
+		default:
+			return errBadHeader
+		}
+		if err := skipGIFSubBlocks(r); err != nil {
+			return err
+		}
+	}
+}
+
+func skipGIFSubBlocks(r *bufio.Reader) error {
+	for {
+		size, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		if size == 0 {
+			return nil
+		}
+		if _, err := r.Discard(int(size)); err != nil {
+			return err
+		}
+	}
+}
+
+// VP8X 记录画布尺寸，动图的每一帧是一个 ANMF 块
+func probeWebP(r io.ReadSeeker, probe *ImageProbe) error {
+	if _, err := r.Seek(12, io.SeekStart); err != nil {
+		return err
+	}
+	header := make([]byte, 8)
+	frames := 0
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			break
+		}
+		length := int64(binary.LittleEndian.Uint32(header[4:8]))
+		consumed := int64(0)
+		switch string(header[0:4]) {
+		case "VP8X":
+			data := make([]byte, 10)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return err
+			}
+			probe.Width = int(uint32(data[4])|uint32(data[5])<<8|uint32(data[6])<<16) + 1
+			probe.Height = int(uint32(data[7])|uint32(data[8])<<8|uint32(data[9])<<16) + 1
+			consumed = 10
+		case "VP8 ":
+			data := make([]byte, 10)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return err
+			}
+			if probe.Width == 0 {
+				probe.Width = int(binary.LittleEndian.Uint16(data[6:8]) & 0x3FFF)
+				probe.Height = int(binary.LittleEndian.Uint16(data[8:10]) & 0x3FFF)
+			}
+			consumed = 10
+		case "VP8L":
+			data := make([]byte, 5)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return err
+			}
+			if probe.Width == 0 {
+				bits := binary.LittleEndian.Uint32(data[1:5])
+				probe.Width = int(bits&0x3FFF) + 1
+				probe.Height = int((bits>>14)&0x3FFF) + 1
+			}
+			consumed = 5
+		case "ANMF":
+			frames++
+		}
+		// 块按偶数字节对齐
+		if _, err := r.Seek(length+length%2-consumed, io.SeekCurrent); err != nil {
+			return err
+		}
+	}
+	if frames > 0 {
+		probe.Frames = frames
+	}
+	if probe.Width == 0 {
+		return errBadHeader
+	}
+	return nil
+}
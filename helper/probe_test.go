@@ -0,0 +1,188 @@
+package helper
+
+import (
+	"encoding/binary"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"webp_server_go/config"
+)
+
+// 只有 SOF0 和 SOS 的 JPEG，image.DecodeConfig 读到 SOS 即返回
+func testJPEG(width, height int) []byte {
+	sof := []byte{8}
+	sof = binary.BigEndian.AppendUint16(sof, uint16(height))
+	sof = binary.BigEndian.AppendUint16(sof, uint16(width))
+	sof = append(sof, 3, 1, 0x11, 0, 2, 0x11, 0, 3, 0x11, 0)
+	out := append([]byte{0xff, 0xd8}, jpegSegment(0xc0, sof)...)
+	return append(out, jpegSegment(0xda, []byte{1, 1, 0, 0, 63, 0})...)
+}
+
+func testPNG(width, height int, extra ...[]byte) []byte {
+	ihdr := binary.BigEndian.AppendUint32(nil, uint32(width))
+	ihdr = binary.BigEndian.AppendUint32(ihdr, uint32(height))
+	ihdr = append(ihdr, 8, 6, 0, 0, 0)
+	out := append([]byte(pngSignature), pngChunk("IHDR", ihdr)...)
+	for _, chunk := range extra {
+		out = append(out, chunk...)
+	}
+	out = append(out, pngChunk("IDAT", []byte{1, 2, 3})...)
+	return append(out, pngChunk("IEND", nil)...)
+}
+
+// 全局颜色表 2 色，每帧一个图形控制扩展和一个只有一个子块的图像
+func testGIF(width, height, frames int, trailer bool) []byte {
+	out := []byte("GIF89a")
+	out = binary.LittleEndian.AppendUint16(out, uint16(width))
+	out = binary.LittleEndian.AppendUint16(out, uint16(height))
+	out = append(out, 0x80, 0, 0)
+	out = append(out, 0, 0, 0, 0xff, 0xff, 0xff)
+	for range frames {
+		out = append(out, 0x21, 0xf9, 4, 0, 10, 0, 0, 0)
+		out = append(out, 0x2c, 0, 0, 0, 0, 1, 0, 1, 0, 0)
+		out = append(out, 2, 2, 0x44, 0x01, 0)
+	}
+	if trailer {
+		out = append(out, 0x3b)
+	}
+	return out
+}
+
+func testAnimatedWebP(width, height, frames int) []byte {
+	vp8x := []byte{0x02, 0, 0, 0}
+	vp8x = append(vp8x, byte(width-1), byte((width-1)>>8), byte((width-1)>>16))
+	vp8x = append(vp8x, byte(height-1), byte((height-1)>>8), byte((height-1)>>16))
+	chunks := [][]byte{webpChunk("VP8X", vp8x), webpChunk("ANIM", make([]byte, 6))}
+	for range frames {
+		chunks = append(chunks, webpChunk("ANMF", make([]byte, 17)))
+	}
+	return riff(chunks...)
+}
+
+func testLosslessWebP(width, height int) []byte {
+	bits := uint32(width-1) | uint32(height-1)<<14
+	return riff(webpChunk("VP8L", binary.LittleEndian.AppendUint32([]byte{0x2f}, bits)))
+}
+
+func TestProbeImage(t *testing.T) {
+	pngFile := testPNG(300, 200)
+	tests := []struct {
+		name       string
+		data       []byte
+		wantFormat string
+		wantWidth  int
+		wantHeight int
+		wantFrames int
+		wantErr    bool
+	}{
+		{"jpeg", testJPEG(640, 480), "jpg", 640, 480, 1, false},
+		{"png", pngFile, "png", 300, 200, 1, false},
+		{"apng", testPNG(300, 200, pngChunk("acTL", []byte{0, 0, 0, 5, 0, 0, 0, 0})), "png", 300, 200, 5, false},
+		{"png trailing bytes", append(testPNG(300, 200), "trailing"...), "png", 300, 200, 1, false},
+		{"png truncated after IHDR", pngFile[:33], "png", 300, 200, 1, true},
+		{"png truncated before IHDR", pngFile[:20], "png", 0, 0, 1, true},
+		{"png short IHDR", append([]byte(pngSignature), pngChunk("IHDR", []byte{0, 0, 1})...), "png", 0, 0, 1, true},
+		{"gif", testGIF(100, 50, 3, true), "gif", 100, 50, 3, false},
+		{"gif without trailer", testGIF(100, 50, 3, false), "gif", 100, 50, 3, true},
+		{"gif bad block", append(testGIF(100, 50, 1, false), 0x99), "gif", 100, 50, 1, true},
+		{"webp animated", testAnimatedWebP(400, 300, 4), "webp", 400, 300, 4, false},
+		{"webp lossless", testLosslessWebP(123, 45), "webp", 123, 45, 1, false},
+		{"webp without image chunk", riff(webpChunk("ANIM", make([]byte, 6))), "webp", 0, 0, 1, true},
+		{"unknown format", []byte("BM this is not probed"), "bmp", 0, 0, 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			probe, err := ProbeImage(writeTestFile(t, "image", tt.data))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ProbeImage() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if probe.Format != tt.wantFormat || probe.Width != tt.wantWidth || probe.Height != tt.wantHeight || probe.Frames != tt.wantFrames {
+				t.Fatalf("ProbeImage() = %s %dx%d %d frames, want %s %dx%d %d frames",
+					probe.Format, probe.Width, probe.Height, probe.Frames, tt.wantFormat, tt.wantWidth, tt.wantHeight, tt.wantFrames)
+			}
+			if probe.Size != int64(len(tt.data)) {
+				t.Fatalf("Size = %d, want %d", probe.Size, len(tt.data))
+			}
+		})
+	}
+
+	if _, err := ProbeImage(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Fatal("ProbeImage() on a missing file should fail")
+	}
+}
+
+func TestProbeImageHeaderProber(t *testing.T) {
+	old := HeaderProber
+	t.Cleanup(func() { HeaderProber = old })
+
+	bmp := writeTestFile(t, "image.bmp", []byte("BM this is not probed"))
+	HeaderProber = func(string) (int, int, int, error) { return 800, 600, 2, nil }
+	probe, err := ProbeImage(bmp)
+	if err != nil || probe.Width != 800 || probe.Height != 600 || probe.Frames != 2 {
+		t.Fatalf("ProbeImage() = %+v, %v", probe, err)
+	}
+
+	// 内置解析已经得到尺寸时不再调用 libvips
+	HeaderProber = func(string) (int, int, int, error) { t.Fatal("HeaderProber called"); return 0, 0, 0, nil }
+	if _, err := ProbeImage(writeTestFile(t, "image.gif", testGIF(100, 50, 1, false))); err == nil {
+		t.Fatal("truncated GIF should still report an error")
+	}
+
+	proberErr := errors.New("vips failed")
+	HeaderProber = func(string) (int, int, int, error) { return 0, 0, 0, proberErr }
+	if _, err := ProbeImage(bmp); !errors.Is(err, proberErr) {
+		t.Fatalf("ProbeImage() error = %v, want %v", err, proberErr)
+	}
+}
+
+func TestCheckInputLimits(t *testing.T) {
+	oldPixels, oldFrames, oldBytes := config.Config.MaxInputPixels, config.Config.MaxInputFrames, config.Config.MaxInputBytes
+	oldProber := HeaderProber
+	t.Cleanup(func() {
+		config.Config.MaxInputPixels, config.Config.MaxInputFrames, config.Config.MaxInputBytes = oldPixels, oldFrames, oldBytes
+		HeaderProber = oldProber
+	})
+	config.Config.MaxInputPixels = 100 * 100
+	config.Config.MaxInputFrames = 3
+	config.Config.MaxInputBytes = map[string]int64{"png": 200, "*": 1 << 20}
+	HeaderProber = nil
+
+	tests := []struct {
+		name       string
+		data       []byte
+		wantReason string // empty: accepted
+	}{
+		{"within limits", testGIF(100, 100, 3, true), ""},
+		{"too many pixels", testJPEG(101, 100), "pixels"},
+		{"too many frames", testGIF(10, 10, 4, true), "frames"},
+		{"too many bytes", testPNG(10, 10, pngChunk("tEXt", make([]byte, 200))), "bytes"},
+		{"partial header within limits", testGIF(10, 10, 2, false), ""},
+		{"partial header too many pixels", testPNG(1000, 1000)[:33], "pixels"},
+		{"partial header too many frames", testGIF(10, 10, 5, false), "frames"},
+		{"unparseable header", testPNG(10, 10)[:20], "header"},
+		{"unknown format", []byte("BM this is not probed"), "header"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CheckInputLimits(writeTestFile(t, "image", tt.data))
+			if tt.wantReason == "" {
+				if err != nil {
+					t.Fatalf("CheckInputLimits() = %v, want nil", err)
+				}
+				return
+			}
+			var limitErr *InputLimitError
+			if !errors.As(err, &limitErr) || limitErr.Reason != tt.wantReason {
+				t.Fatalf("CheckInputLimits() = %v, want reason %s", err, tt.wantReason)
+			}
+		})
+	}
+
+	if err := CheckInputLimits(filepath.Join(t.TempDir(), "missing")); err != nil {
+		t.Fatalf("missing file should be left to the decoder, got %v", err)
+	}
+	if !strings.Contains((&InputLimitError{Reason: "header", Detail: "x"}).Error(), "无法解析") {
+		t.Fatal("header errors should not be reported as limit errors")
+	}
+}
@@ -0,0 +1,411 @@
+package helper
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// 识别 RAW 格式时读取的文件头长度，TIFF 类 RAW 需要从中读取 IFD0
+const rawHeadSize = 64 * 1024
+
+// EXIF/TIFF 中用到的其他标签
+const (
+	tiffTagPhotometric     = 0x0106
+	tiffTagMake            = 0x010f
+	tiffTagStripOffsets    = 0x0111
+	tiffTagStripByteCounts = 0x0117
+	tiffTagSubIFDs         = 0x014a
+	tiffTagJPEGOffset      = 0x0201
+	tiffTagJPEGLength      = 0x0202
+	tiffTagDNGVersion      = 0xc612
+	tiffTagPrivateData     = 0xc634 // DNGPrivateData, Sony SR2Private
+
+	photometricCFA       = 32803
+	photometricLinearRaw = 34892
+)
+
+// 相机 RAW 格式的解码器，按文件头识别，扩展名只作为辅助
+type RawDecoder struct {
+	Name string
+	// head 为文件开头最多 64KB 的数据，ext 为小写且不带点的扩展名，仅作为 TIFF 类 RAW 的辅助证据
+	Match func(head []byte, ext string) bool
+	// 从完整文件中提取最大的内嵌 JPEG 预览以及 RAW 中记录的方向（1-8，未知时为 0），没有预览时返回 nil
+	Preview func(data []byte) (preview []byte, orientation int)
+}
+
+// 按注册顺序匹配，更具体的格式需要先注册
+var rawDecoders []RawDecoder
+
+// 注册 RAW 解码器，只应在 init 中调用
+func RegisterRawDecoder(decoder RawDecoder) {
+	rawDecoders = append(rawDecoders, decoder)
+}
+
+func init() {
+	RegisterRawDecoder(RawDecoder{Name: "CR3", Match: isCR3, Preview: cr3Preview})
+	RegisterRawDecoder(RawDecoder{Name: "RAF", Match: isRAF, Preview: rafPreview})
+	RegisterRawDecoder(RawDecoder{Name: "ORF", Match: isORF, Preview: tiffPreview})
+	RegisterRawDecoder(RawDecoder{Name: "CR2", Match: isCR2, Preview: tiffPreview})
+	RegisterRawDecoder(RawDecoder{Name: "DNG", Match: isDNG, Preview: tiffPreview})
+	RegisterRawDecoder(RawDecoder{Name: "NEF", Match: tiffMakeMatcher("NIKON", "nef", "nrw"), Preview: tiffPreview})
+	RegisterRawDecoder(RawDecoder{Name: "ARW", Match: tiffMakeMatcher("SONY", "arw", "sr2", "srf"), Preview: tiffPreview})
+}
+
+// 返回匹配文件头的 RAW 解码器，不是 RAW 文件时返回 nil
+// 先只读取开头的魔数，JPEG、PNG 等常见输入不会读取完整的文件头
+func DetectRaw(filename string) *RawDecoder {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	head := make([]byte, rawHeadSize)
+	n, _ := io.ReadFull(f, head[:16])
+	if !hasRawMagic(head[:n]) {
+		return nil
+	}
+	m, _ := io.ReadFull(f, head[n:])
+	head = head[:n+m]
+
+	ext := strings.TrimPrefix(strings.ToLower(filepath.Ext(filename)), ".")
+	for i := range rawDecoders {
+		if rawDecoders[i].Match(head, ext) {
+			return &rawDecoders[i]
+		}
+	}
+	return nil
+}
+
+// 所有已知 RAW 格式的开头：TIFF（含 ORF）、CR3 的 ftyp、RAF
+func hasRawMagic(head []byte) bool {
+	if _, _, ok := rawTIFFHeader(head); ok {
+		return true
+	}
+	return isCR3(head, "") || isRAF(head, "")
+}
+
+// 提取内嵌预览，RAW 中记录了方向而预览没有 EXIF 时补上方向，保证后续自动旋转正确
+func ExtractRawPreview(decoder *RawDecoder, data []byte) []byte {
+	preview, orientation := decoder.Preview(data)
+	if preview == nil {
+		return nil
+	}
+	if orientation > 1 && orientation <= 8 && !jpegHasExif(preview) {
+		preview = jpegWithOrientation(preview, orientation)
+	}
+	return preview
+}
+
+// Canon CR3 是 ISO BMFF 容器
+func isCR3(head []byte, _ string) bool {
+	return len(head) >= 12 && string(head[4:12]) == "ftypcrx "
+}
+
+// PRVW 块中的 JPEG（约 1620x1080），方向记录在 CMT1 块的 TIFF IFD0 中
+func cr3Preview(data []byte) ([]byte, int) {
+	orientation := 0
+	if i := bytes.Index(data, []byte("CMT1")); i >= 0 {
+		orientation = tiffOrientation(data[i+4:])
+	}
+	i := bytes.Index(data, []byte("PRVW"))
+	// 块头：长度(4) PRVW(4) 未知(6) 宽(2) 高(2) 未知(2) JPEG 长度(4)
+	if i < 4 || i+20 > len(data) {
+		return nil, orientation
+	}
+	length := int(binary.BigEndian.Uint32(data[i+16:]))
+	start := i + 20
+	if length <= 0 || start+length > len(data) || !isPreviewJPEG(data[start:start+length]) {
+		return nil, orientation
+	}
+	return data[start : start+length], orientation
+}
+
+// Fujifilm RAF 文件头固定，84 字节处为预览 JPEG 的偏移和长度（大端）
+func isRAF(head []byte, _ string) bool {
+	return bytes.HasPrefix(head, []byte("FUJIFILMCCD-RAW"))
+}
+
+// RAF 的预览 JPEG 自带 EXIF，不需要另外的方向
+func rafPreview(data []byte) ([]byte, int) {
+	if len(data) < 92 {
+		return nil, 0
+	}
+	offset := uint64(binary.BigEndian.Uint32(data[84:]))
+	length := uint64(binary.BigEndian.Uint32(data[88:]))
+	if length == 0 || offset+length > uint64(len(data)) || !isPreviewJPEG(data[offset:offset+length]) {
+		return nil, 0
+	}
+	return data[offset : offset+length], 0
+}
+
+// Olympus ORF 是 TIFF 变体，魔数为 RO 或 RS 而不是 42
+// 部分机型的预览只在 MakerNote 中，这里无法提取，交给 libvips 完整解码
+func isORF(head []byte, _ string) bool {
+	return len(head) >= 4 && (string(head[:4]) == "IIRO" || string(head[:4]) == "IIRS" || string(head[:4]) == "MMOR")
+}
+
+// Canon CR2 是 TIFF，8 字节处为 CR 标记
+func isCR2(head []byte, _ string) bool {
+	return len(head) >= 10 && string(head[:4]) == "II*\x00" && string(head[8:10]) == "CR"
+}
+
+// DNG 的 IFD0 中有 DNGVersion 标签，同时需要有原始数据或 .dng 扩展名
+func isDNG(head []byte, ext string) bool {
+	entries, _, ok := rawIFD0(head)
+	if !ok || !hasTag(entries, tiffTagDNGVersion) {
+		return false
+	}
+	return ext == "dng" || hasRawData(head)
+}
+
+// NEF、ARW 等需要 IFD0 中的厂商名，且有原始数据或对应的扩展名
+// 只凭厂商名会把尼康扫描仪、厂商软件导出的普通 TIFF 当作 RAW，只用到其中的缩略图
+func tiffMakeMatcher(vendor string, exts ...string) func(head []byte, ext string) bool {
+	return func(head []byte, ext string) bool {
+		entries, _, ok := rawIFD0(head)
+		if !ok {
+			return false
+		}
+		vendorMatched := false
+		for _, entry := range entries {
+			if entry.tag == tiffTagMake && entry.typ == 2 {
+				vendorMatched = strings.HasPrefix(strings.ToUpper(string(entry.value)), vendor)
+				break
+			}
+		}
+		if !vendorMatched {
+			return false
+		}
+		return slices.Contains(exts, ext) || hasTag(entries, tiffTagPrivateData) || hasRawData(head)
+	}
+}
+
+func hasTag(entries []tiffEntry, tag uint16) bool {
+	return slices.ContainsFunc(entries, func(entry tiffEntry) bool {
+		return entry.tag == tag
+	})
+}
+
+// IFD 链或 SubIFD 中是否有 CFA 或 LinearRaw 光度解释的原始数据，只检查 head 范围内的 IFD
+func hasRawData(head []byte) bool {
+	order, ifd0, ok := rawTIFFHeader(head)
+	if !ok {
+		return false
+	}
+	found := false
+	walkTIFF(head, order, ifd0, func(entries []tiffEntry) {
+		for _, entry := range entries {
+			if entry.tag != tiffTagPhotometric {
+				continue
+			}
+			switch tiffUint(order, entry, 0) {
+			case photometricCFA, photometricLinearRaw:
+				found = true
+			}
+		}
+	})
+	return found
+}
+
+// 解析 TIFF 类 RAW 的文件头（包括 ORF 的魔数），返回 IFD0 的条目
+func rawIFD0(data []byte) ([]tiffEntry, byteOrder, bool) {
+	order, ifd0, ok := rawTIFFHeader(data)
+	if !ok {
+		return nil, nil, false
+	}
+	entries, err := readIFD(data, order, ifd0)
+	if err != nil {
+		return nil, nil, false
+	}
+	return entries, order, true
+}
+
+func rawTIFFHeader(data []byte) (byteOrder, uint32, bool) {
+	if len(data) < 8 {
+		return nil, 0, false
+	}
+	var order byteOrder
+	switch string(data[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil, 0, false
+	}
+	switch order.Uint16(data[2:]) {
+	case 42, 0x4f52, 0x5352: // TIFF, ORF (RO, RS)
+	default:
+		return nil, 0, false
+	}
+	return order, order.Uint32(data[4:]), true
+}
+
+// 遍历 IFD 链和 SubIFD，收集 JPEGInterchangeFormat 和单条带的 JPEG 数据，返回其中最大的可显示 JPEG
+func tiffPreview(data []byte) ([]byte, int) {
+	order, ifd0, ok := rawTIFFHeader(data)
+	if !ok {
+		return nil, 0
+	}
+	var best []byte
+	consider := func(offset, length uint32) {
+		end := uint64(offset) + uint64(length)
+		if length == 0 || end > uint64(len(data)) || int(length) <= len(best) {
+			return
+		}
+		if candidate := data[offset:end]; isPreviewJPEG(candidate) {
+			best = candidate
+		}
+	}
+
+	walkTIFF(data, order, ifd0, func(entries []tiffEntry) {
+		var jpegOffset, jpegLength, stripOffset, stripLength uint32
+		singleStrip := false
+		for _, entry := range entries {
+			switch entry.tag {
+			case tiffTagJPEGOffset:
+				jpegOffset = tiffUint(order, entry, 0)
+			case tiffTagJPEGLength:
+				jpegLength = tiffUint(order, entry, 0)
+			case tiffTagStripOffsets:
+				stripOffset = tiffUint(order, entry, 0)
+				singleStrip = entry.count == 1
+			case tiffTagStripByteCounts:
+				stripLength = tiffUint(order, entry, 0)
+			}
+		}
+		consider(jpegOffset, jpegLength)
+		if singleStrip {
+			consider(stripOffset, stripLength)
+		}
+	})
+	return best, tiffOrientation(data)
+}
+
+// 依次对 IFD 链以及各 SubIFD 的条目调用 fn，无法解析的 IFD 跳过
+func walkTIFF(data []byte, order byteOrder, ifd0 uint32, fn func(entries []tiffEntry)) {
+	visited := map[uint32]bool{}
+	var walk func(offset uint32, depth int)
+	walk = func(offset uint32, depth int) {
+		// 防止循环引用和过深的嵌套
+		for offset != 0 && !visited[offset] && depth < 4 {
+			visited[offset] = true
+			entries, err := readIFD(data, order, offset)
+			if err != nil {
+				return
+			}
+			fn(entries)
+			for _, entry := range entries {
+				if entry.tag == tiffTagSubIFDs {
+					for i := range entry.count {
+						walk(tiffUint(order, entry, int(i)), depth+1)
+					}
+				}
+			}
+			// readIFD 已检查过下一个 IFD 偏移的范围
+			count := uint32(order.Uint16(data[offset:]))
+			offset = order.Uint32(data[offset+2+count*12:])
+		}
+	}
+	walk(ifd0, 0)
+}
+
+// SHORT 或 LONG 类型条目的第 i 个值，类型不符或越界时为 0
+func tiffUint(order byteOrder, entry tiffEntry, i int) uint32 {
+	switch entry.typ {
+	case 3:
+		if len(entry.value) >= (i+1)*2 {
+			return uint32(order.Uint16(entry.value[i*2:]))
+		}
+	case 4, 13:
+		if len(entry.value) >= (i+1)*4 {
+			return order.Uint32(entry.value[i*4:])
+		}
+	}
+	return 0
+}
+
+// TIFF 类数据 IFD0 中的方向，没有时为 0
+func tiffOrientation(data []byte) int {
+	entries, order, ok := rawIFD0(data)
+	if !ok {
+		return 0
+	}
+	for _, entry := range entries {
+		if entry.tag == exifTagOrientation {
+			return int(tiffUint(order, entry, 0))
+		}
+	}
+	return 0
+}
+
+// 是否为浏览器和 libvips 都能解码的 JPEG（基线或渐进），排除 RAW 数据使用的无损 JPEG
+func isPreviewJPEG(data []byte) bool {
+	if !bytes.HasPrefix(data, []byte{0xff, 0xd8}) {
+		return false
+	}
+	pos := 2
+	for pos+4 <= len(data) {
+		if data[pos] != 0xff {
+			return false
+		}
+		marker := data[pos+1]
+		switch {
+		case marker == 0xff:
+			pos++
+			continue
+		case marker == 0x01 || (marker >= 0xd0 && marker <= 0xd7):
+			pos += 2
+			continue
+		case marker == 0xc0 || marker == 0xc1 || marker == 0xc2:
+			return true
+		case marker >= 0xc3 && marker <= 0xcf && marker != 0xc4 && marker != 0xc8 && marker != 0xcc:
+			// 无损、差分和算术编码的 JPEG
+			return false
+		case marker == 0xda:
+			return false
+		}
+		pos += 2 + int(binary.BigEndian.Uint16(data[pos+2:]))
+	}
+	return false
+}
+
+// JPEG 在扫描数据之前是否有 EXIF 段
+func jpegHasExif(data []byte) bool {
+	pos := 2
+	for pos+4 <= len(data) && data[pos] == 0xff {
+		marker := data[pos+1]
+		if marker == 0xda {
+			return false
+		}
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		if marker == 0xe1 && bytes.HasPrefix(data[pos+4:], []byte(exifPrefix)) {
+			return true
+		}
+		pos += 2 + length
+	}
+	return false
+}
+
+// 在 SOI 之后插入只含方向的 EXIF 段
+func jpegWithOrientation(data []byte, orientation int) []byte {
+	exif := []byte(exifPrefix + "MM\x00\x2a\x00\x00\x00\x08")
+	exif = binary.BigEndian.AppendUint16(exif, 1)
+	exif = binary.BigEndian.AppendUint16(exif, exifTagOrientation)
+	exif = binary.BigEndian.AppendUint16(exif, 3)
+	exif = binary.BigEndian.AppendUint32(exif, 1)
+	exif = binary.BigEndian.AppendUint16(exif, uint16(orientation))
+	exif = append(exif, 0, 0, 0, 0, 0, 0)
+
+	out := make([]byte, 0, len(data)+len(exif)+4)
+	out = append(out, data[:2]...)
+	out = append(out, 0xff, 0xe1)
+	out = binary.BigEndian.AppendUint16(out, uint16(len(exif)+2))
+	out = append(out, exif...)
+	return append(out, data[2:]...)
+}
@@ -0,0 +1,231 @@
+package helper
+
+import (
+	"bytes"
+	"encoding/binary"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func longEntry(order byteOrder, tag uint16, value uint32) tiffEntry {
+	return tiffEntry{tag: tag, typ: 4, count: 1, value: order.AppendUint32(nil, value)}
+}
+
+// 在 TIFF 末尾附加 blobs 中的数据，对应标签写入数据的偏移，lengthTags 中对应的标签写入长度
+// 条目的值都不超过 4 字节，IFD 的长度不受偏移影响
+func tiffWithData(order byteOrder, entries []tiffEntry, blobs map[uint16][]byte, lengthTags map[uint16]uint16) []byte {
+	tiff := buildTIFF(order, entries...)
+	for i, entry := range entries {
+		blob, ok := blobs[entry.tag]
+		if !ok {
+			continue
+		}
+		entries[i] = longEntry(order, entry.tag, uint32(len(tiff)))
+		for j := range entries {
+			if entries[j].tag == lengthTags[entry.tag] {
+				entries[j] = longEntry(order, entries[j].tag, uint32(len(blob)))
+			}
+		}
+		tiff = append(tiff, blob...)
+	}
+	out := buildTIFF(order, entries...)
+	return append(out, tiff[len(out):]...)
+}
+
+// 无损 JPEG（SOF3），RAW 数据常用，不能作为预览
+func losslessJPEG() []byte {
+	jpeg := testJPEG(4000, 3000)
+	jpeg[3] = 0xc3
+	return jpeg
+}
+
+func TestDetectRaw(t *testing.T) {
+	order := binary.LittleEndian
+	nikon := asciiEntry(tiffTagMake, "NIKON CORPORATION")
+	sony := asciiEntry(tiffTagMake, "SONY")
+	cfa := shortEntry(order, tiffTagPhotometric, photometricCFA)
+	rgb := shortEntry(order, tiffTagPhotometric, 2)
+	dngVersion := tiffEntry{tag: tiffTagDNGVersion, typ: 1, count: 4, value: []byte{1, 4, 0, 0}}
+
+	cr2 := append([]byte("II*\x00\x10\x00\x00\x00CR\x02\x00\x00\x00\x00\x00"), 0, 0, 0, 0, 0, 0)
+	orf := buildTIFF(order, rgb)
+	copy(orf, "IIRO")
+	cr3 := append([]byte{0, 0, 0, 0x18}, "ftypcrx \x00\x00\x00\x01crx isom"...)
+	raf := []byte("FUJIFILMCCD-RAW 0201FF383501")
+
+	tests := []struct {
+		name     string
+		filename string
+		data     []byte
+		want     string // empty: not RAW
+	}{
+		{"nef by extension", "a.nef", buildTIFF(order, nikon), "NEF"},
+		{"nrw by extension", "a.NRW", buildTIFF(order, nikon), "NEF"},
+		{"nef by cfa data", "a.bin", buildTIFF(order, nikon, cfa), "NEF"},
+		{"nikon scanner tiff", "scan.tif", buildTIFF(order, nikon, rgb), ""},
+		{"arw by extension", "a.arw", buildTIFF(order, sony), "ARW"},
+		{"arw by private data", "a.tif", buildTIFF(order, sony, longEntry(order, tiffTagPrivateData, 0)), "ARW"},
+		{"sony exported tiff", "a.tif", buildTIFF(order, sony, rgb), ""},
+		{"dng by extension", "a.dng", buildTIFF(order, dngVersion), "DNG"},
+		{"dng by cfa data", "a.tif", buildTIFF(order, cfa, dngVersion), "DNG"},
+		{"tiff with dng version only", "a.tif", buildTIFF(order, rgb, dngVersion), ""},
+		{"big endian nef", "a.nef", buildTIFF(binary.BigEndian, nikon), "NEF"},
+		{"cr2", "a.cr2", cr2, "CR2"},
+		{"cr2 with wrong extension", "a.jpg", cr2, "CR2"},
+		{"orf", "a.orf", orf, "ORF"},
+		{"cr3", "a.cr3", cr3, "CR3"},
+		{"raf", "a.raf", raf, "RAF"},
+		{"plain tiff", "a.tif", buildTIFF(order, rgb), ""},
+		{"jpeg named nef", "a.nef", testJPEG(10, 10), ""},
+		{"png named dng", "a.dng", testPNG(10, 10), ""},
+		{"truncated header", "a.nef", []byte("II*\x00"), ""},
+		{"ifd0 out of range", "a.nef", []byte("II*\x00\xff\xff\x00\x00"), ""},
+		{"empty", "a.nef", nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decoder := DetectRaw(writeTestFile(t, tt.filename, tt.data))
+			got := ""
+			if decoder != nil {
+				got = decoder.Name
+			}
+			if got != tt.want {
+				t.Fatalf("DetectRaw() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	if DetectRaw(filepath.Join(t.TempDir(), "missing.nef")) != nil {
+		t.Fatal("DetectRaw() on a missing file should return nil")
+	}
+}
+
+func TestExtractRawPreview(t *testing.T) {
+	order := binary.LittleEndian
+	small := testJPEG(160, 120)
+	// 预览按字节数选择，大图加上填充
+	large := append(append([]byte{0xff, 0xd8}, jpegSegment(0xe0, make([]byte, 64))...), testJPEG(1600, 1200)[2:]...)
+	withExif := append([]byte{0xff, 0xd8}, jpegSegment(0xe1, testExif())...)
+	withExif = append(withExif, large[2:]...)
+	nef := func(orientation uint16, blobs map[uint16][]byte) []byte {
+		entries := []tiffEntry{
+			asciiEntry(tiffTagMake, "NIKON"),
+			shortEntry(order, exifTagOrientation, orientation),
+			longEntry(order, tiffTagStripOffsets, 0),
+			longEntry(order, tiffTagStripByteCounts, 0),
+			longEntry(order, tiffTagJPEGOffset, 0),
+			longEntry(order, tiffTagJPEGLength, 0),
+		}
+		return tiffWithData(order, entries, blobs, map[uint16]uint16{
+			tiffTagStripOffsets: tiffTagStripByteCounts,
+			tiffTagJPEGOffset:   tiffTagJPEGLength,
+		})
+	}
+	decoder := func(name string) *RawDecoder {
+		i := slices.IndexFunc(rawDecoders, func(d RawDecoder) bool { return d.Name == name })
+		return &rawDecoders[i]
+	}
+
+	raf := append([]byte("FUJIFILMCCD-RAW 0201FF383501"), make([]byte, 92-28)...)
+	binary.BigEndian.PutUint32(raf[84:], uint32(len(raf)))
+	binary.BigEndian.PutUint32(raf[88:], uint32(len(large)))
+	raf = append(raf, large...)
+
+	prvw := []byte{0, 0, 0, 0}
+	prvw = append(prvw, "PRVW"...)
+	prvw = append(prvw, make([]byte, 12)...)
+	prvw = binary.BigEndian.AppendUint32(prvw, uint32(len(large)))
+	cr3 := append(append([]byte{0, 0, 0, 0x18}, "ftypcrx "...), prvw...)
+	cr3 = append(cr3, large...)
+
+	tests := []struct {
+		name            string
+		decoder         string
+		data            []byte
+		want            []byte // preview without the injected EXIF, nil: no preview
+		wantOrientation int    // orientation injected into the preview, 0: none
+	}{
+		{"largest jpeg", "NEF", nef(1, map[uint16][]byte{tiffTagJPEGOffset: small, tiffTagStripOffsets: large}), large, 0},
+		{"orientation injected", "NEF", nef(6, map[uint16][]byte{tiffTagJPEGOffset: large}), large, 6},
+		{"existing exif kept", "NEF", nef(6, map[uint16][]byte{tiffTagJPEGOffset: withExif}), withExif, 0},
+		{"lossless strip ignored", "NEF", nef(1, map[uint16][]byte{tiffTagJPEGOffset: small, tiffTagStripOffsets: losslessJPEG()}), small, 0},
+		{"no preview", "NEF", nef(1, map[uint16][]byte{tiffTagStripOffsets: losslessJPEG()}), nil, 0},
+		{"preview out of range", "NEF", func() []byte {
+			data := nef(1, map[uint16][]byte{tiffTagJPEGOffset: large})
+			return data[:len(data)-10]
+		}(), nil, 0},
+		{"raf", "RAF", raf, large, 0},
+		{"raf truncated", "RAF", raf[:len(raf)-10], nil, 0},
+		{"raf short header", "RAF", raf[:60], nil, 0},
+		{"cr3", "CR3", cr3, large, 0},
+		{"cr3 truncated", "CR3", cr3[:len(cr3)-10], nil, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ExtractRawPreview(decoder(tt.decoder), tt.data)
+			if tt.want == nil {
+				if got != nil {
+					t.Fatalf("ExtractRawPreview() = %d bytes, want nil", len(got))
+				}
+				return
+			}
+			if tt.wantOrientation == 0 {
+				if !bytes.Equal(got, tt.want) {
+					t.Fatalf("ExtractRawPreview() = %d bytes, want %d bytes", len(got), len(tt.want))
+				}
+				return
+			}
+			if !jpegHasExif(got) || !isPreviewJPEG(got) {
+				t.Fatal("preview without a valid orientation EXIF")
+			}
+			i := bytes.Index(got, []byte(exifPrefix))
+			length := int(binary.BigEndian.Uint16(got[i-2:]))
+			if orientation := tiffOrientation(got[i+len(exifPrefix) : i-2+length]); orientation != tt.wantOrientation {
+				t.Fatalf("orientation = %d, want %d", orientation, tt.wantOrientation)
+			}
+			if !bytes.Equal(got[i-2+length:], tt.want[2:]) {
+				t.Fatal("preview image data changed")
+			}
+		})
+	}
+}
+
+func TestTIFFPreviewCyclicIFD(t *testing.T) {
+	order := binary.LittleEndian
+	tiff := buildTIFF(order, asciiEntry(tiffTagMake, "NIKON"), longEntry(order, tiffTagSubIFDs, 8))
+	// 下一个 IFD 指向自身
+	order.PutUint32(tiff[8+2+2*12:], 8)
+	if preview, _ := tiffPreview(tiff); preview != nil {
+		t.Fatalf("tiffPreview() = %d bytes, want nil", len(preview))
+	}
+	if hasRawData(tiff) {
+		t.Fatal("hasRawData() = true for a TIFF without raw data")
+	}
+}
+
+func TestIsPreviewJPEG(t *testing.T) {
+	progressive := testJPEG(10, 10)
+	progressive[3] = 0xc2
+	tests := []struct {
+		name string
+		data []byte
+		want bool
+	}{
+		{"baseline", testJPEG(10, 10), true},
+		{"progressive", progressive, true},
+		{"after app segments", append(append([]byte{0xff, 0xd8}, jpegSegment(0xe0, []byte("JFIF\x00"))...), testJPEG(10, 10)[2:]...), true},
+		{"lossless", losslessJPEG(), false},
+		{"scan before frame", append([]byte{0xff, 0xd8}, jpegSegment(0xda, []byte{0})...), false},
+		{"not jpeg", testPNG(10, 10), false},
+		{"garbage between segments", append([]byte{0xff, 0xd8, 0x00}, testJPEG(10, 10)[2:]...), false},
+		{"truncated", []byte{0xff, 0xd8, 0xff}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isPreviewJPEG(tt.data); got != tt.want {
+				t.Fatalf("isPreviewJPEG() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
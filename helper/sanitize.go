@@ -0,0 +1,262 @@
+package helper
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"os"
+	"slices"
+	"webp_server_go/config"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// JPEG APP1 中 XMP 的前缀（包括扩展 XMP）
+var xmpPrefixes = [][]byte{[]byte("http://ns.adobe.com/xap/1.0/\x00"), []byte("http://ns.adobe.com/xmp/extension/\x00")}
+
+// copyright 策略下 PNG 文本块中保留的关键字
+var pngKeepKeywords = []string{"Copyright", "Author"}
+
+// 复制原图并按元数据策略处理其中的元数据，不重新编码像素
+// 只支持 JPEG、PNG 和 WebP，其他格式或无法解析时返回错误，由调用方重新编码，不会原样复制
+func CopyOriginal(src, dst, policy string) error {
+	if policy == config.MetadataKeep {
+		return CopyFile(src, dst)
+	}
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	sanitized, err := SanitizeMetadata(data, policy)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(dst, sanitized, 0600)
+}
+
+// 非 keep 策略下无法直接处理该格式的元数据
+var ErrMetadataUnsupported = errors.New("不支持处理该格式的元数据")
+
+// 按元数据策略处理图像文件中的元数据
+func SanitizeMetadata(data []byte, policy string) ([]byte, error) {
+	if policy == config.MetadataKeep {
+		return data, nil
+	}
+	switch {
+	case bytes.HasPrefix(data, []byte{0xff, 0xd8}):
+		return sanitizeJPEG(data, policy)
+	case bytes.HasPrefix(data, []byte(pngSignature)):
+		return sanitizePNG(data, policy)
+	case len(data) >= 12 && string(data[:4]) == "RIFF" && string(data[8:12]) == "WEBP":
+		return sanitizeWebP(data, policy)
+	}
+	return nil, ErrMetadataUnsupported
+}
+
+// 处理 JPEG 的 APP1(EXIF/XMP)、APP13(IPTC) 和 COM 段，SOS 或 EOI 之后的数据原样保留
+func sanitizeJPEG(data []byte, policy string) ([]byte, error) {
+	out := make([]byte, 2, len(data))
+	copy(out, data[:2])
+	pos := 2
+	for pos+2 <= len(data) {
+		// 段之间的多余字节（部分相机会写入），跳到下一个标记
+		if data[pos] != 0xff {
+			pos++
+			continue
+		}
+		marker := data[pos+1]
+		// 填充字节
+		if marker == 0xff {
+			pos++
+			continue
+		}
+		// 扫描数据开始或图像结束后不再有元数据段
+		if marker == 0xda || marker == 0xd9 {
+			break
+		}
+		// 没有长度的独立标记
+		if marker == 0x01 || (marker >= 0xd0 && marker <= 0xd7) {
+			out = append(out, data[pos:pos+2]...)
+			pos += 2
+			continue
+		}
+		if pos+4 > len(data) {
+			return nil, errors.New("无效的 JPEG 段")
+		}
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		if length < 2 || pos+2+length > len(data) {
+			return nil, errors.New("无效的 JPEG 段长度")
+		}
+		segment := data[pos : pos+2+length]
+		payload := segment[4:]
+		pos += 2 + length
+
+		switch {
+		case marker == 0xe1 && bytes.HasPrefix(payload, []byte(exifPrefix)):
+			exif, err := FilterExif(payload, policy)
+			if err != nil {
+				log.Warnf("处理 EXIF 失败，删除整个 EXIF: %v", err)
+				continue
+			}
+			if exif == nil {
+				continue
+			}
+			out = append(out, 0xff, 0xe1)
+			out = binary.BigEndian.AppendUint16(out, uint16(len(exif)+2))
+			out = append(out, exif...)
+			continue
+		case marker == 0xe1 && hasAnyPrefix(payload, xmpPrefixes):
+			// XMP 中可能包含位置信息，所有非 keep 策略都删除
+			continue
+		case marker == 0xed || marker == 0xfe:
+			// IPTC 和注释不含 GPS 坐标，nogps 时保留
+			if policy != config.MetadataNoGPS {
+				continue
+			}
+		}
+		out = append(out, segment...)
+	}
+	if pos >= len(data) {
+		return nil, errors.New("JPEG 缺少图像数据")
+	}
+	return append(out, data[pos:]...), nil
+}
+
+// 处理 PNG 的 eXIf 和文本块，重新计算 CRC，IEND 之后的数据原样保留
+func sanitizePNG(data []byte, policy string) ([]byte, error) {
+	out := make([]byte, 8, len(data))
+	copy(out, data[:8])
+	pos := 8
+	for pos < len(data) {
+		if pos+12 > len(data) {
+			return nil, errors.New("无效的 PNG 块")
+		}
+		length := int(binary.BigEndian.Uint32(data[pos:]))
+		if length < 0 || pos+12+length > len(data) {
+			return nil, errors.New("无效的 PNG 块长度")
+		}
+		chunkType := string(data[pos+4 : pos+8])
+		chunk := data[pos : pos+12+length]
+		body := chunk[8 : 8+length]
+		pos += 12 + length
+
+		switch chunkType {
+		case "eXIf":
+			exif, err := FilterExif(body, policy)
+			if err != nil {
+				log.Warnf("处理 EXIF 失败，删除整个 EXIF: %v", err)
+				continue
+			}
+			if exif == nil {
+				continue
+			}
+			out = appendPNGChunk(out, chunkType, exif)
+			continue
+		case "tEXt", "zTXt", "iTXt":
+			keyword, _, _ := bytes.Cut(body, []byte{0})
+			if !keepPNGText(string(keyword), policy) {
+				continue
+			}
+		case "tIME":
+			if policy != config.MetadataNoGPS {
+				continue
+			}
+		case "IEND":
+			out = append(out, chunk...)
+			return append(out, data[pos:]...), nil
+		}
+		out = append(out, chunk...)
+	}
+	return nil, errors.New("PNG 缺少 IEND")
+}
+
+// PNG 文本块是否保留：copyright 只保留版权和作者，nogps 删除 XMP 和 ImageMagick 写入的原始 EXIF/XMP
+func keepPNGText(keyword, policy string) bool {
+	switch policy {
+	case config.MetadataCopyright:
+		return slices.Contains(pngKeepKeywords, keyword)
+	case config.MetadataNoGPS:
+		return keyword != "XML:com.adobe.xmp" && keyword != "Raw profile type exif" &&
+			keyword != "Raw profile type APP1" && keyword != "Raw profile type xmp"
+	}
+	return false
+}
+
+func appendPNGChunk(out []byte, chunkType string, body []byte) []byte {
+	out = binary.BigEndian.AppendUint32(out, uint32(len(body)))
+	start := len(out)
+	out = append(out, chunkType...)
+	out = append(out, body...)
+	return binary.BigEndian.AppendUint32(out, crc32.ChecksumIEEE(out[start:]))
+}
+
+// 处理 WebP 的 EXIF 和 XMP 块，同步更新 VP8X 标志和 RIFF 长度
+func sanitizeWebP(data []byte, policy string) ([]byte, error) {
+	out := make([]byte, 12, len(data))
+	copy(out, data[:12])
+	vp8x := -1
+	hasExif := false
+	pos := 12
+	// RIFF 长度之后追加的数据不属于 WebP
+	end := min(8+int(binary.LittleEndian.Uint32(data[4:])), len(data))
+	for pos < end {
+		if pos+8 > end {
+			return nil, errors.New("无效的 WebP 块")
+		}
+		fourCC := string(data[pos : pos+4])
+		length := int(binary.LittleEndian.Uint32(data[pos+4:]))
+		padded := length + length%2
+		if length < 0 || pos+8+length > end {
+			return nil, errors.New("无效的 WebP 块长度")
+		}
+		chunk := data[pos:min(pos+8+padded, end)]
+		body := data[pos+8 : pos+8+length]
+		pos += 8 + padded
+
+		switch fourCC {
+		case "VP8X":
+			vp8x = len(out)
+		case "EXIF":
+			exif, err := FilterExif(body, policy)
+			if err != nil {
+				log.Warnf("处理 EXIF 失败，删除整个 EXIF: %v", err)
+				continue
+			}
+			if exif == nil {
+				continue
+			}
+			hasExif = true
+			out = append(out, "EXIF"...)
+			out = binary.LittleEndian.AppendUint32(out, uint32(len(exif)))
+			out = append(out, exif...)
+			if len(exif)%2 == 1 {
+				out = append(out, 0)
+			}
+			continue
+		case "XMP ":
+			continue
+		}
+		out = append(out, chunk...)
+	}
+
+	// VP8X 标志：0x08 为 EXIF，0x04 为 XMP
+	if vp8x >= 0 && vp8x+9 <= len(out) {
+		flags := out[vp8x+8] &^ 0x0c
+		if hasExif {
+			flags |= 0x08
+		}
+		out[vp8x+8] = flags
+	}
+	binary.LittleEndian.PutUint32(out[4:], uint32(len(out)-8))
+	return out, nil
+}
+
+func hasAnyPrefix(data []byte, prefixes [][]byte) bool {
+	for _, prefix := range prefixes {
+		if bytes.HasPrefix(data, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,305 @@
+package helper
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"webp_server_go/config"
+)
+
+// 只有 Orientation=6 和 Artist 的 EXIF，strip 后只剩 Orientation
+func testExif() []byte {
+	order := binary.LittleEndian
+	return append([]byte(exifPrefix), buildTIFF(order, shortEntry(order, exifTagOrientation, 6), asciiEntry(exifTagArtist, "Someone"))...)
+}
+
+func jpegSegment(marker byte, payload []byte) []byte {
+	out := []byte{0xff, marker}
+	out = binary.BigEndian.AppendUint16(out, uint16(len(payload)+2))
+	return append(out, payload...)
+}
+
+// 扫描数据之后还有 EOI 和追加的数据，都应原样保留
+var jpegScan = []byte{0xff, 0xda, 0x00, 0x08, 1, 2, 3, 4, 5, 6, 0x12, 0xff, 0x00, 0x34, 0xff, 0xd9, 't', 'a', 'i', 'l'}
+
+func TestSanitizeJPEG(t *testing.T) {
+	app0 := jpegSegment(0xe0, []byte("JFIF\x00\x01\x02"))
+	exif := jpegSegment(0xe1, testExif())
+	xmp := jpegSegment(0xe1, append([]byte(xmpPrefixes[0]), "<x:xmpmeta/>"...))
+	iptc := jpegSegment(0xed, []byte("Photoshop 3.0\x00"))
+	comment := jpegSegment(0xfe, []byte("comment"))
+	soi := []byte{0xff, 0xd8}
+	join := func(parts ...[]byte) []byte { return bytes.Join(parts, nil) }
+
+	tests := []struct {
+		name    string
+		data    []byte
+		policy  string
+		want    [][]byte // segments that must be present
+		absent  [][]byte // segments that must be removed
+		wantErr bool
+	}{
+		{
+			name:   "strip",
+			data:   join(soi, app0, exif, xmp, iptc, comment, jpegScan),
+			policy: config.MetadataStrip,
+			want:   [][]byte{app0, jpegScan},
+			absent: [][]byte{exif, xmp, iptc, comment, []byte("Someone")},
+		},
+		{
+			name:   "nogps keeps comments",
+			data:   join(soi, app0, exif, xmp, iptc, comment, jpegScan),
+			policy: config.MetadataNoGPS,
+			want:   [][]byte{app0, exif, iptc, comment, jpegScan},
+			absent: [][]byte{xmp},
+		},
+		{
+			name:   "fill bytes and stray bytes between segments",
+			data:   join(soi, []byte{0xff, 0xff}, app0, []byte{0x00, 0x00}, comment, jpegScan),
+			policy: config.MetadataStrip,
+			want:   [][]byte{app0, jpegScan},
+			absent: [][]byte{comment},
+		},
+		{
+			name:   "standalone markers",
+			data:   join(soi, []byte{0xff, 0x01}, app0, jpegScan),
+			policy: config.MetadataStrip,
+			want:   [][]byte{{0xff, 0x01}, app0, jpegScan},
+		},
+		{
+			name:   "eoi without scan",
+			data:   join(soi, app0, comment, []byte{0xff, 0xd9}),
+			policy: config.MetadataStrip,
+			want:   [][]byte{app0, {0xff, 0xd9}},
+			absent: [][]byte{comment},
+		},
+		{name: "truncated segment", data: join(soi, app0, exif[:20]), policy: config.MetadataStrip, wantErr: true},
+		{name: "truncated length", data: join(soi, app0, []byte{0xff, 0xe1, 0x00}), policy: config.MetadataStrip, wantErr: true},
+		{name: "bad length", data: join(soi, []byte{0xff, 0xe1, 0x00, 0x01}, jpegScan), policy: config.MetadataStrip, wantErr: true},
+		{name: "no image data", data: join(soi, app0, comment), policy: config.MetadataStrip, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := SanitizeMetadata(tt.data, tt.policy)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("SanitizeMetadata() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !bytes.HasPrefix(got, soi) {
+				t.Fatal("missing SOI")
+			}
+			for _, segment := range tt.want {
+				if !bytes.Contains(got, segment) {
+					t.Errorf("missing %x", segment)
+				}
+			}
+			for _, segment := range tt.absent {
+				if bytes.Contains(got, segment) {
+					t.Errorf("not removed: %x", segment)
+				}
+			}
+		})
+	}
+
+	t.Run("strip keeps orientation", func(t *testing.T) {
+		got, err := SanitizeMetadata(bytes.Join([][]byte{soi, exif, jpegScan}, nil), config.MetadataStrip)
+		if err != nil {
+			t.Fatal(err)
+		}
+		i := bytes.Index(got, []byte(exifPrefix))
+		if i < 0 {
+			t.Fatal("orientation EXIF removed")
+		}
+		length := int(binary.BigEndian.Uint16(got[i-2:]))
+		if tags := exifTags(t, got[i:i-2+length]); len(tags) != 1 || tags[exifTagOrientation] == nil {
+			t.Fatalf("tags = %x, want only orientation", sortedTags(tags))
+		}
+	})
+}
+
+func pngChunk(chunkType string, body []byte) []byte {
+	return appendPNGChunk(nil, chunkType, body)
+}
+
+// 检查所有块的 CRC，返回块类型列表和 IEND 之后的数据
+func pngChunks(t *testing.T, data []byte) ([]string, []byte) {
+	t.Helper()
+	var types []string
+	pos := len(pngSignature)
+	for pos+12 <= len(data) {
+		length := int(binary.BigEndian.Uint32(data[pos:]))
+		chunk := data[pos+4 : pos+8+length]
+		if crc32.ChecksumIEEE(chunk) != binary.BigEndian.Uint32(data[pos+8+length:]) {
+			t.Fatalf("bad CRC in %s", chunk[:4])
+		}
+		types = append(types, string(chunk[:4]))
+		pos += 12 + length
+		if types[len(types)-1] == "IEND" {
+			break
+		}
+	}
+	return types, data[pos:]
+}
+
+func TestSanitizePNG(t *testing.T) {
+	ihdr := pngChunk("IHDR", make([]byte, 13))
+	idat := pngChunk("IDAT", []byte{1, 2, 3})
+	iend := pngChunk("IEND", nil)
+	comment := pngChunk("tEXt", []byte("Comment\x00hello"))
+	copyright := pngChunk("tEXt", []byte("Copyright\x00(c) Someone"))
+	xmp := pngChunk("iTXt", []byte("XML:com.adobe.xmp\x00\x00\x00\x00\x00<x:xmpmeta/>"))
+	timestamp := pngChunk("tIME", make([]byte, 7))
+	exif := pngChunk("eXIf", testExif()[len(exifPrefix):])
+	join := func(parts ...[]byte) []byte { return bytes.Join(append([][]byte{[]byte(pngSignature)}, parts...), nil) }
+	full := join(ihdr, exif, comment, copyright, xmp, timestamp, idat, iend)
+
+	tests := []struct {
+		name      string
+		data      []byte
+		policy    string
+		wantTypes []string
+		wantTail  string
+		wantErr   bool
+	}{
+		{"strip", full, config.MetadataStrip, []string{"IHDR", "eXIf", "IDAT", "IEND"}, "", false},
+		{"copyright", full, config.MetadataCopyright, []string{"IHDR", "eXIf", "tEXt", "IDAT", "IEND"}, "", false},
+		{"nogps", full, config.MetadataNoGPS, []string{"IHDR", "eXIf", "tEXt", "tEXt", "tIME", "IDAT", "IEND"}, "", false},
+		{"trailing bytes", join(ihdr, comment, idat, iend, []byte("trailing")), config.MetadataStrip, []string{"IHDR", "IDAT", "IEND"}, "trailing", false},
+		{"chunk-like data after IEND", join(ihdr, idat, iend, comment), config.MetadataStrip, []string{"IHDR", "IDAT", "IEND"}, string(comment), false},
+		{"missing IEND", join(ihdr, comment, idat), config.MetadataStrip, nil, "", true},
+		{"truncated chunk", join(ihdr, idat[:8]), config.MetadataStrip, nil, "", true},
+		{"bad length", join(ihdr, []byte{0xff, 0xff, 0xff, 0xff, 'I', 'D', 'A', 'T'}, iend), config.MetadataStrip, nil, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := SanitizeMetadata(tt.data, tt.policy)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("SanitizeMetadata() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			types, tail := pngChunks(t, got)
+			if !slices.Equal(types, tt.wantTypes) || string(tail) != tt.wantTail {
+				t.Fatalf("chunks = %v, tail %q, want %v, tail %q", types, tail, tt.wantTypes, tt.wantTail)
+			}
+			if tt.policy == config.MetadataCopyright && !bytes.Contains(got, copyright) {
+				t.Fatal("Copyright text removed")
+			}
+		})
+	}
+}
+
+func webpChunk(fourCC string, body []byte) []byte {
+	out := []byte(fourCC)
+	out = binary.LittleEndian.AppendUint32(out, uint32(len(body)))
+	out = append(out, body...)
+	if len(body)%2 == 1 {
+		out = append(out, 0)
+	}
+	return out
+}
+
+func riff(chunks ...[]byte) []byte {
+	body := bytes.Join(append([][]byte{[]byte("WEBP")}, chunks...), nil)
+	out := []byte("RIFF")
+	out = binary.LittleEndian.AppendUint32(out, uint32(len(body)))
+	return append(out, body...)
+}
+
+func TestSanitizeWebP(t *testing.T) {
+	vp8x := webpChunk("VP8X", []byte{0x0c, 0, 0, 0, 0, 0, 0, 0, 0, 0})
+	vp8 := webpChunk("VP8 ", []byte{1, 2, 3})
+	exif := webpChunk("EXIF", testExif())
+	xmp := webpChunk("XMP ", []byte("<x:xmpmeta/>"))
+	full := riff(vp8x, vp8, exif, xmp)
+
+	tests := []struct {
+		name      string
+		data      []byte
+		policy    string
+		wantFlags byte
+		wantExif  bool
+		wantErr   bool
+	}{
+		{"strip", full, config.MetadataStrip, 0x08, true, false},
+		{"nogps", full, config.MetadataNoGPS, 0x08, true, false},
+		{"no exif left", riff(vp8x, vp8, xmp), config.MetadataStrip, 0x00, false, false},
+		{"trailing bytes after RIFF", append(riff(vp8x, vp8, xmp), "trailing"...), config.MetadataStrip, 0x00, false, false},
+		{"truncated chunk", full[:len(full)-len(xmp)+4], config.MetadataStrip, 0, false, true},
+		{"bad chunk length", riff(vp8x, []byte("VP8 \xff\xff\xff\x7f")), config.MetadataStrip, 0, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := SanitizeMetadata(tt.data, tt.policy)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("SanitizeMetadata() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if size := int(binary.LittleEndian.Uint32(got[4:])); size != len(got)-8 {
+				t.Fatalf("RIFF size %d, file size %d", size, len(got))
+			}
+			if flags := got[12+8]; flags&0x0c != tt.wantFlags {
+				t.Fatalf("VP8X flags = %#x, want %#x", flags&0x0c, tt.wantFlags)
+			}
+			if bytes.Contains(got, []byte("XMP ")) || bytes.Contains(got, []byte("trailing")) {
+				t.Fatal("XMP or trailing bytes not removed")
+			}
+			if bytes.Contains(got, []byte("Someone")) != (tt.policy == config.MetadataNoGPS) {
+				t.Fatal("Artist not filtered according to policy")
+			}
+			if bytes.Contains(got, []byte("EXIF")) != tt.wantExif {
+				t.Fatalf("EXIF present = %v, want %v", !tt.wantExif, tt.wantExif)
+			}
+			if !bytes.Contains(got, vp8) {
+				t.Fatal("image data changed")
+			}
+		})
+	}
+}
+
+func TestSanitizeMetadataUnsupported(t *testing.T) {
+	gif := []byte("GIF89a\x01\x00\x01\x00\x00\x00\x00")
+	if got, err := SanitizeMetadata(gif, config.MetadataKeep); err != nil || !bytes.Equal(got, gif) {
+		t.Fatalf("keep should return the input unchanged, got %q, %v", got, err)
+	}
+	for _, policy := range []string{config.MetadataStrip, config.MetadataCopyright, config.MetadataNoGPS} {
+		if _, err := SanitizeMetadata(gif, policy); !errors.Is(err, ErrMetadataUnsupported) {
+			t.Errorf("%s: err = %v, want %v", policy, err, ErrMetadataUnsupported)
+		}
+	}
+}
+
+func TestCopyOriginal(t *testing.T) {
+	dir := t.TempDir()
+	gif := filepath.Join(dir, "a.gif")
+	if err := os.WriteFile(gif, []byte("GIF89a\x01\x00\x01\x00\x00\x00\x00"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := filepath.Join(dir, "keep.gif")
+	if err := CopyOriginal(gif, dst, config.MetadataKeep); err != nil {
+		t.Fatal(err)
+	}
+	if !FileExists(dst) {
+		t.Fatal("keep should copy the file")
+	}
+
+	// 无法处理元数据时不能原样复制
+	dst = filepath.Join(dir, "strip.gif")
+	if err := CopyOriginal(gif, dst, config.MetadataStrip); !errors.Is(err, ErrMetadataUnsupported) {
+		t.Fatalf("err = %v, want %v", err, ErrMetadataUnsupported)
+	}
+	if FileExists(dst) {
+		t.Fatal("unsanitized copy written")
+	}
+}
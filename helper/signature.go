@@ -0,0 +1,79 @@
+package helper
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/url"
+	"strconv"
+	"time"
+	"webp_server_go/config"
+)
+
+// 签名相关的请求参数，签名本身不参与计算
+const (
+	SignatureParam = "s"
+	ExpiresParam   = "expires" // unix timestamp, optional
+)
+
+var (
+	ErrSignatureMissing = errors.New("缺少签名")
+	ErrSignatureInvalid = errors.New("签名无效")
+	ErrSignatureExpired = errors.New("签名已过期")
+)
+
+// 对路径和规范化后的参数（按键排序，不含签名）计算 HMAC-SHA256
+func Sign(reqPath string, query url.Values, key string) string {
+	values := url.Values{}
+	for k, v := range query {
+		if k != SignatureParam {
+			values[k] = v
+		}
+	}
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(reqPath + "?" + values.Encode()))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// 使用 SIGNATURE_KEYS 中的第一个密钥为 URL 签名，ttl 大于 0 时附加过期时间
+func SignURL(rawURL string, ttl time.Duration) (string, error) {
+	if len(config.Config.SignatureKeys) == 0 {
+		return "", errors.New("未配置 SIGNATURE_KEYS")
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	query := u.Query()
+	query.Del(SignatureParam)
+	if ttl > 0 {
+		query.Set(ExpiresParam, strconv.FormatInt(time.Now().Add(ttl).Unix(), 10))
+	}
+	query.Set(SignatureParam, Sign(u.Path, query, config.Config.SignatureKeys[0]))
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// 依次用 SIGNATURE_KEYS 中的每个密钥校验，便于轮换密钥
+func VerifySignature(reqPath string, query url.Values) error {
+	signature := query.Get(SignatureParam)
+	if signature == "" {
+		return ErrSignatureMissing
+	}
+	if expires := query.Get(ExpiresParam); expires != "" {
+		timestamp, err := strconv.ParseInt(expires, 10, 64)
+		if err != nil {
+			return ErrSignatureInvalid
+		}
+		if time.Now().Unix() > timestamp {
+			return ErrSignatureExpired
+		}
+	}
+	for _, key := range config.Config.SignatureKeys {
+		if hmac.Equal([]byte(signature), []byte(Sign(reqPath, query, key))) {
+			return nil
+		}
+	}
+	return ErrSignatureInvalid
+}
@@ -0,0 +1,110 @@
+package helper
+
+import (
+	"errors"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+	"webp_server_go/config"
+)
+
+func withSignatureKeys(t *testing.T, keys ...string) {
+	t.Helper()
+	old := config.Config.SignatureKeys
+	config.Config.SignatureKeys = keys
+	t.Cleanup(func() { config.Config.SignatureKeys = old })
+}
+
+func TestSignIgnoresOrderAndSignature(t *testing.T) {
+	a := url.Values{"width": {"200"}, "height": {"100"}}
+	b := url.Values{"height": {"100"}, "width": {"200"}, SignatureParam: {"whatever"}}
+	if Sign("/img/a.jpg", a, "k") != Sign("/img/a.jpg", b, "k") {
+		t.Fatal("signature should not depend on parameter order or the signature itself")
+	}
+	if Sign("/img/a.jpg", a, "k") == Sign("/img/b.jpg", a, "k") {
+		t.Fatal("signature should cover the path")
+	}
+	if Sign("/img/a.jpg", a, "k") == Sign("/img/a.jpg", a, "other") {
+		t.Fatal("signature should depend on the key")
+	}
+}
+
+func TestVerifySignature(t *testing.T) {
+	withSignatureKeys(t, "new", "old")
+
+	signed := func(key string, query url.Values) url.Values {
+		query.Set(SignatureParam, Sign("/img/a.jpg", query, key))
+		return query
+	}
+	future := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	past := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+
+	tests := []struct {
+		name  string
+		path  string
+		query url.Values
+		want  error
+	}{
+		{"valid", "/img/a.jpg", signed("new", url.Values{"width": {"200"}}), nil},
+		{"rotated key", "/img/a.jpg", signed("old", url.Values{"width": {"200"}}), nil},
+		{"not expired", "/img/a.jpg", signed("new", url.Values{"width": {"200"}, ExpiresParam: {future}}), nil},
+		{"missing", "/img/a.jpg", url.Values{"width": {"200"}}, ErrSignatureMissing},
+		{"unknown key", "/img/a.jpg", signed("unknown", url.Values{"width": {"200"}}), ErrSignatureInvalid},
+		{"other path", "/img/b.jpg", signed("new", url.Values{"width": {"200"}}), ErrSignatureInvalid},
+		{"expired", "/img/a.jpg", signed("new", url.Values{"width": {"200"}, ExpiresParam: {past}}), ErrSignatureExpired},
+		{"bad expires", "/img/a.jpg", signed("new", url.Values{ExpiresParam: {"tomorrow"}}), ErrSignatureInvalid},
+		{"truncated", "/img/a.jpg", func() url.Values {
+			query := signed("new", url.Values{"width": {"200"}})
+			query.Set(SignatureParam, query.Get(SignatureParam)[:10])
+			return query
+		}(), ErrSignatureInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := VerifySignature(tt.path, tt.query); !errors.Is(err, tt.want) {
+				t.Fatalf("VerifySignature() = %v, want %v", err, tt.want)
+			}
+		})
+	}
+
+	t.Run("tampered", func(t *testing.T) {
+		query := signed("new", url.Values{"width": {"200"}})
+		query.Set("width", "2000")
+		if err := VerifySignature("/img/a.jpg", query); !errors.Is(err, ErrSignatureInvalid) {
+			t.Fatalf("VerifySignature() = %v, want %v", err, ErrSignatureInvalid)
+		}
+	})
+	t.Run("extended expiry", func(t *testing.T) {
+		query := signed("new", url.Values{ExpiresParam: {future}})
+		query.Set(ExpiresParam, strconv.FormatInt(time.Now().Add(48*time.Hour).Unix(), 10))
+		if err := VerifySignature("/img/a.jpg", query); !errors.Is(err, ErrSignatureInvalid) {
+			t.Fatalf("VerifySignature() = %v, want %v", err, ErrSignatureInvalid)
+		}
+	})
+}
+
+func TestSignURL(t *testing.T) {
+	withSignatureKeys(t)
+	if _, err := SignURL("/img/a.jpg?width=200", 0); err == nil {
+		t.Fatal("SignURL without keys should fail")
+	}
+
+	withSignatureKeys(t, "new", "old")
+	for _, ttl := range []time.Duration{0, time.Hour} {
+		signed, err := SignURL("/img/a.jpg?width=200&s=stale", ttl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		u, err := url.Parse(signed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := u.Query().Has(ExpiresParam); got != (ttl > 0) {
+			t.Errorf("ttl %v: expires present = %v", ttl, got)
+		}
+		if err := VerifySignature(u.Path, u.Query()); err != nil {
+			t.Errorf("ttl %v: VerifySignature(%s) = %v", ttl, signed, err)
+		}
+	}
+}
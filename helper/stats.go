@@ -0,0 +1,138 @@
+package helper
+
+import (
+	"sync"
+)
+
+// 缓存层级
+const (
+	TierRaw      = "raw"
+	TierExhaust  = "exhaust"
+	TierMetadata = "metadata"
+)
+
+type CacheCounters struct {
+	Hits      int64 `json:"hits"`
+	Misses    int64 `json:"misses"`
+	Stale     int64 `json:"stale"`
+	Evictions int64 `json:"evictions"`
+}
+
+func (c *CacheCounters) Add(other CacheCounters) {
+	c.Hits += other.Hits
+	c.Misses += other.Misses
+	c.Stale += other.Stale
+	c.Evictions += other.Evictions
+}
+
+type ConversionStats struct {
+	Count           int64  `json:"count"`
+	OriginalBytes   int64  `json:"original_bytes"`
+	OptimizedBytes  int64  `json:"optimized_bytes"`
+	BytesSaved      int64  `json:"bytes_saved"`
+	CompressionRate string `json:"compression_rate"`
+}
+
+var cacheStats = struct {
+	sync.Mutex
+	counters    map[string]map[string]*CacheCounters // tier -> IMG_MAP prefix -> counters
+	conversions ConversionStats
+	rejections  map[string]int64 // reason -> count of inputs rejected before decoding
+}{
+	counters:   map[string]map[string]*CacheCounters{},
+	rejections: map[string]int64{},
+}
+
+func recordCache(tier, prefix string, update func(*CacheCounters)) {
+	cacheStats.Lock()
+	defer cacheStats.Unlock()
+
+	byPrefix, ok := cacheStats.counters[tier]
+	if !ok {
+		byPrefix = map[string]*CacheCounters{}
+		cacheStats.counters[tier] = byPrefix
+	}
+	counters, ok := byPrefix[prefix]
+	if !ok {
+		counters = &CacheCounters{}
+		byPrefix[prefix] = counters
+	}
+	update(counters)
+}
+
+func RecordCacheHit(tier, prefix string) {
+	recordCache(tier, prefix, func(c *CacheCounters) { c.Hits++ })
+}
+
+func RecordCacheMiss(tier, prefix string) {
+	recordCache(tier, prefix, func(c *CacheCounters) { c.Misses++ })
+}
+
+func RecordCacheStale(tier, prefix string) {
+	recordCache(tier, prefix, func(c *CacheCounters) { c.Stale++ })
+}
+
+func RecordCacheEviction(tier, prefix string) {
+	recordCache(tier, prefix, func(c *CacheCounters) { c.Evictions++ })
+}
+
+// 返回计数器的副本，tier -> IMG_MAP 前缀 -> 计数器
+func CacheCountersSnapshot() map[string]map[string]CacheCounters {
+	cacheStats.Lock()
+	defer cacheStats.Unlock()
+
+	snapshot := map[string]map[string]CacheCounters{}
+	for tier, byPrefix := range cacheStats.counters {
+		snapshot[tier] = map[string]CacheCounters{}
+		for prefix, counters := range byPrefix {
+			snapshot[tier][prefix] = *counters
+		}
+	}
+	return snapshot
+}
+
+// 记录一次转换前后的文件大小，用于统计节省的字节数
+func RecordConversion(rawImagePath, optimizedImg string) {
+	originalSize, optimizedSize, err := compressionSizes(rawImagePath, optimizedImg)
+	if err != nil {
+		return
+	}
+
+	cacheStats.Lock()
+	defer cacheStats.Unlock()
+	cacheStats.conversions.Count++
+	cacheStats.conversions.OriginalBytes += originalSize
+	cacheStats.conversions.OptimizedBytes += optimizedSize
+	if originalSize > optimizedSize {
+		cacheStats.conversions.BytesSaved += originalSize - optimizedSize
+	}
+}
+
+func GetConversionStats() ConversionStats {
+	cacheStats.Lock()
+	defer cacheStats.Unlock()
+
+	stats := cacheStats.conversions
+	if stats.OriginalBytes > 0 {
+		stats.CompressionRate = formatCompressionRate(stats.OriginalBytes, stats.OptimizedBytes)
+	}
+	return stats
+}
+
+func RecordInputRejected(reason string) {
+	cacheStats.Lock()
+	defer cacheStats.Unlock()
+	cacheStats.rejections[reason]++
+}
+
+// 返回因超出 MAX_INPUT_* 限制被拒绝的输入数量，原因 -> 次数
+func GetInputRejections() map[string]int64 {
+	cacheStats.Lock()
+	defer cacheStats.Unlock()
+
+	rejections := map[string]int64{}
+	for reason, count := range cacheStats.rejections {
+		rejections[reason] = count
+	}
+	return rejections
+}
@@ -0,0 +1,118 @@
+package helper
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"webp_server_go/config"
+)
+
+func writeTestFile(t *testing.T, name string, data []byte) string {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(filename, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func withImageMap(t *testing.T, imageMap map[string]string) {
+	t.Helper()
+	old := config.Config.ImageMap
+	config.Config.ImageMap = imageMap
+	t.Cleanup(func() { config.Config.ImageMap = old })
+}
+
+func TestCacheCounters(t *testing.T) {
+	const prefix = "/test-counters"
+	RecordCacheHit(TierExhaust, prefix)
+	RecordCacheHit(TierExhaust, prefix)
+	RecordCacheMiss(TierExhaust, prefix)
+	RecordCacheStale(TierRaw, prefix)
+	RecordCacheEviction(TierRaw, prefix)
+
+	snapshot := CacheCountersSnapshot()
+	if got, want := snapshot[TierExhaust][prefix], (CacheCounters{Hits: 2, Misses: 1}); got != want {
+		t.Fatalf("exhaust counters = %+v, want %+v", got, want)
+	}
+	if got, want := snapshot[TierRaw][prefix], (CacheCounters{Stale: 1, Evictions: 1}); got != want {
+		t.Fatalf("raw counters = %+v, want %+v", got, want)
+	}
+
+	// 快照是副本，之后的计数不影响已经取得的快照
+	RecordCacheHit(TierExhaust, prefix)
+	if snapshot[TierExhaust][prefix].Hits != 2 {
+		t.Fatal("snapshot changed after recording")
+	}
+
+	var total CacheCounters
+	total.Add(CacheCounters{Hits: 1, Misses: 2})
+	total.Add(CacheCounters{Hits: 3, Stale: 4, Evictions: 5})
+	if want := (CacheCounters{Hits: 4, Misses: 2, Stale: 4, Evictions: 5}); total != want {
+		t.Fatalf("Add() = %+v, want %+v", total, want)
+	}
+}
+
+func TestRecordConversion(t *testing.T) {
+	raw := writeTestFile(t, "raw.jpg", make([]byte, 1000))
+	smaller := writeTestFile(t, "smaller.webp", make([]byte, 400))
+	larger := writeTestFile(t, "larger.webp", make([]byte, 1200))
+
+	before := GetConversionStats()
+	RecordConversion(raw, smaller)
+	RecordConversion(raw, larger)
+	RecordConversion(raw, "missing.webp")
+	after := GetConversionStats()
+
+	if got := after.Count - before.Count; got != 2 {
+		t.Fatalf("Count increased by %d, want 2", got)
+	}
+	if got := after.OriginalBytes - before.OriginalBytes; got != 2000 {
+		t.Fatalf("OriginalBytes increased by %d, want 2000", got)
+	}
+	if got := after.OptimizedBytes - before.OptimizedBytes; got != 1600 {
+		t.Fatalf("OptimizedBytes increased by %d, want 1600", got)
+	}
+	// 转换后更大的文件不计入节省的字节数
+	if got := after.BytesSaved - before.BytesSaved; got != 600 {
+		t.Fatalf("BytesSaved increased by %d, want 600", got)
+	}
+	if after.CompressionRate == "" {
+		t.Fatal("CompressionRate should be set once bytes were recorded")
+	}
+}
+
+func TestPrefixForSource(t *testing.T) {
+	withImageMap(t, map[string]string{
+		"/local":   "./pics",
+		"/abs":     "/srv/images",
+		"/remote":  "https://cdn.example.com/img",
+		"/remote2": "https://cdn.example.com",
+	})
+	tests := []struct {
+		source string
+		want   string
+	}{
+		{"/local/a.jpg", "/local"},
+		{"/abs/sub/a.jpg", "/abs"},
+		{"pics/a.jpg", "/local"},
+		{"/srv/images/a.jpg", "/abs"},
+		{"/srv/images-old/a.jpg", ""},
+		{"https://cdn.example.com/img/a.jpg", "/remote"},
+		{"https://cdn.example.com/other/a.jpg", "/remote2"},
+		{"https://unknown.example.com/a.jpg", ""},
+		{"/unmatched/a.jpg", ""},
+	}
+	for _, tt := range tests {
+		if got := PrefixForSource(tt.source); got != tt.want {
+			t.Errorf("PrefixForSource(%q) = %q, want %q", tt.source, got, tt.want)
+		}
+	}
+
+	if got := PrefixForHost("cdn.example.com"); got != "/remote" {
+		t.Errorf("PrefixForHost() = %q, want the first matching prefix /remote", got)
+	}
+	if got := PrefixForHost("unknown.example.com"); got != "" {
+		t.Errorf("PrefixForHost() = %q, want empty", got)
+	}
+}
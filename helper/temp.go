@@ -0,0 +1,95 @@
+package helper
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"webp_server_go/config"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// 每个进程在 TEMP_PATH 下使用自己的 webp-* 子目录，TEMP_PATH 可以是 /tmp 等共享目录
+const tempDirPrefix = "webp-"
+
+// 超过该时间未修改的其他进程子目录视为上次运行遗留
+const staleTempDirAge = 24 * time.Hour
+
+var (
+	tempDir     string
+	tempDirOnce sync.Once
+)
+
+// 本进程的中间文件目录，首次使用时创建
+func processTempDir() (string, error) {
+	var err error
+	tempDirOnce.Do(func() {
+		if err = os.MkdirAll(config.Config.TempPath, 0755); err != nil {
+			return
+		}
+		tempDir, err = os.MkdirTemp(config.Config.TempPath, tempDirPrefix+"*")
+	})
+	if tempDir == "" {
+		if err == nil {
+			err = os.ErrNotExist
+		}
+		return "", err
+	}
+	// 目录可能被清理过，重新创建
+	return tempDir, os.MkdirAll(tempDir, 0755)
+}
+
+// 在本进程的中间文件目录中写入文件，返回文件路径，使用完后由调用方删除
+func WriteTempFile(pattern string, data []byte) (string, error) {
+	dir, err := processTempDir()
+	if err != nil {
+		return "", err
+	}
+	f, err := os.CreateTemp(dir, pattern)
+	if err != nil {
+		return "", err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// 删除上次运行遗留的 webp-* 子目录，只在启动服务时调用
+// 最近修改过的子目录可能属于同时运行的其他实例，不删除；TEMP_PATH 中的其他文件也不处理
+func CleanStaleTempDirs() {
+	entries, err := os.ReadDir(config.Config.TempPath)
+	if err != nil {
+		return
+	}
+	removed := 0
+	for _, entry := range entries {
+		if !entry.IsDir() || !strings.HasPrefix(entry.Name(), tempDirPrefix) {
+			continue
+		}
+		dir := filepath.Join(config.Config.TempPath, entry.Name())
+		if dir == tempDir {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) < staleTempDirAge {
+			continue
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			log.Warnf("删除遗留的中间文件目录失败: %v", err)
+			continue
+		}
+		removed++
+	}
+	if removed > 0 {
+		log.Infof("已清理 %d 个遗留的中间文件目录", removed)
+	}
+}
@@ -1,10 +1,13 @@
 package schedule
 
 import (
+	"encoding/json"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 	"webp_server_go/config"
+	"webp_server_go/helper"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -28,7 +31,7 @@ func getDirSize(path string) (int64, error) {
 }
 
 // Delete the oldest file in the given path
-func clearDirForOldestFiles(path string) error {
+func clearDirForOldestFiles(path, tier string) error {
 	oldestFile := ""
 	oldestModTime := time.Now()
 
@@ -51,22 +54,48 @@ func clearDirForOldestFiles(path string) error {
 	}
 
 	if oldestFile != "" {
+		prefix := evictionPrefix(tier, oldestFile)
 		err := os.Remove(oldestFile)
 		if err != nil {
 			log.Errorf("删除文件时出错 %s: %s\n", oldestFile, err.Error())
 			return err
 		}
 		log.Infof("删除了最旧的文件: %s\n", oldestFile)
+		helper.RecordCacheEviction(tier, prefix)
 	} else {
 		log.Infoln("目录中没有找到文件.")
 	}
 	return nil
 }
 
+// 被淘汰文件所属的 IMG_MAP 前缀，需要在删除前调用（要读取旁路文件或元数据内容）
+func evictionPrefix(tier, file string) string {
+	switch tier {
+	case helper.TierExhaust:
+		if helper.IsExhaustSidecar(file) {
+			return ""
+		}
+		prefix, _ := helper.FindMatchingPrefix(helper.ExhaustKey(file))
+		return prefix
+	case helper.TierMetadata:
+		var metadata config.MetaFile
+		if buf, err := os.ReadFile(file); err == nil && json.Unmarshal(buf, &metadata) == nil {
+			return helper.PrefixForSource(metadata.Path)
+		}
+	case helper.TierRaw:
+		// RemoteRawPath/<host>/<hash>
+		if rel, err := filepath.Rel(config.Config.RemoteRawPath, file); err == nil {
+			host, _, _ := strings.Cut(filepath.ToSlash(rel), "/")
+			return helper.PrefixForHost(host)
+		}
+	}
+	return ""
+}
+
 // Clear cache, size is in bytes that needs to be cleared out
 // Will delete oldest files first, then second oldest, etc.
 // Until all files size are less than maxCacheSizeBytes
-func clearCacheFiles(path string, maxCacheSizeBytes int64) error {
+func clearCacheFiles(path, tier string, maxCacheSizeBytes int64) error {
 	dirSize, err := getDirSize(path)
 	if err != nil {
 		log.Errorf("获取目录大小时出错: %s\n", err.Error())
@@ -74,7 +103,7 @@ func clearCacheFiles(path string, maxCacheSizeBytes int64) error {
 	}
 
 	for dirSize > maxCacheSizeBytes {
-		err := clearDirForOldestFiles(path)
+		err := clearDirForOldestFiles(path, tier)
 		if err != nil {
 			log.Errorf("清除目录时出错: %s\n", err.Error())
 			return err
@@ -97,15 +126,15 @@ func CleanCache() {
 		// MB to bytes
 		maxCacheSizeBytes := int64(config.Config.MaxCacheSize) * 1024 * 1024
 
-		if err := clearCacheFiles(config.Config.RemoteRawPath, maxCacheSizeBytes); err != nil {
+		if err := clearCacheFiles(config.Config.RemoteRawPath, helper.TierRaw, maxCacheSizeBytes); err != nil {
 			log.Warnf("清除远程原始缓存失败: %v", err)
 		}
 
-		if err := clearCacheFiles(config.Config.ExhaustPath, maxCacheSizeBytes); err != nil && err != os.ErrNotExist {
+		if err := clearCacheFiles(config.Config.ExhaustPath, helper.TierExhaust, maxCacheSizeBytes); err != nil && err != os.ErrNotExist {
 			log.Warnf("清除优化图像缓存失败: %v", err)
 		}
 
-		if err := clearCacheFiles(config.Config.MetadataPath, maxCacheSizeBytes); err != nil && err != os.ErrNotExist {
+		if err := clearCacheFiles(config.Config.MetadataPath, helper.TierMetadata, maxCacheSizeBytes); err != nil && err != os.ErrNotExist {
 			log.Warnf("清除元数据缓存失败: %v", err)
 		}
 
@@ -114,12 +143,13 @@ func CleanCache() {
 
 var cleanupDelay = 5 * time.Minute
 
-func ScheduleCleanup(filePath string) {
+func ScheduleCleanup(filePath, prefix string) {
 	time.AfterFunc(cleanupDelay, func() {
 		if err := os.Remove(filePath); err != nil {
 			log.Warnf("清理原始文件失败: %s, 错误: %v", filePath, err)
 		} else {
 			log.Infof("成功清理原始文件: %s", filePath)
+			helper.RecordCacheEviction(helper.TierRaw, prefix)
 		}
 	})
 }
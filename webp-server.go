@@ -1,15 +1,18 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"net/http"
 	"os"
 	"runtime"
 	"time"
+	"webp_server_go/cachectl"
 	"webp_server_go/config"
 	"webp_server_go/encoder"
 	"webp_server_go/handler"
+	"webp_server_go/helper"
 	schedule "webp_server_go/schedule"
 
 	"github.com/gin-gonic/gin"
@@ -73,6 +76,8 @@ func init() {
 		os.Exit(0)
 	}
 	config.LoadConfig()
+	runCacheCommands()
+	runSignCommand()
 	fmt.Printf("\n %c[1;32m%s%c[0m\n\n", 0x1B, banner, 0x1B)
 
 	// 设置 Gin 为发布模式
@@ -83,6 +88,51 @@ func init() {
 	setupLogger()
 }
 
+// 处理缓存维护相关的命令行参数，执行完成后退出
+func runCacheCommands() {
+	if config.ExportSnapshot != "" {
+		manifest, err := cachectl.ExportSnapshot(config.ExportSnapshot, config.SnapshotRaw)
+		if err != nil {
+			log.Fatalf("导出快照失败: %v", err)
+		}
+		fmt.Printf("Exported %d files to %s\n", len(manifest.Entries), config.ExportSnapshot)
+		os.Exit(0)
+	}
+	if config.ImportSnapshot != "" {
+		result, err := cachectl.ImportSnapshot(config.ImportSnapshot)
+		if err != nil {
+			log.Fatalf("导入快照失败: %v", err)
+		}
+		fmt.Printf("Imported %d, unchanged %d, source changed %d, corrupted %d\n",
+			result.Imported, result.Unchanged, result.SourceChanged, result.Corrupted)
+		os.Exit(0)
+	}
+	if config.MigrateExhaust {
+		result := cachectl.MigrateExhaust()
+		fmt.Printf("Migrated %d, skipped %d, failed %d\n", result.Migrated, result.Skipped, result.Failed)
+		os.Exit(0)
+	}
+	if config.Fsck || config.FsckRepair {
+		report := cachectl.Fsck(config.FsckRepair)
+		buf, _ := json.MarshalIndent(report, "", "  ")
+		fmt.Println(string(buf))
+		os.Exit(0)
+	}
+}
+
+// 为后端和测试生成签名 URL，例如 -sign-url "/img/a.jpg?width=200" -sign-ttl 24h
+func runSignCommand() {
+	if config.SignURL == "" {
+		return
+	}
+	signed, err := helper.SignURL(config.SignURL, config.SignTTL)
+	if err != nil {
+		log.Fatalf("签名失败: %v", err)
+	}
+	fmt.Println(signed)
+	os.Exit(0)
+}
+
 func monitorMemoryUsage() {
 	ticker := time.NewTicker(1 * time.Minute)
 	for range ticker.C {
@@ -98,6 +148,7 @@ func bToMb(b uint64) uint64 {
 }
 
 func main() {
+	helper.CleanStaleTempDirs()
 	if config.Config.MaxCacheSize != 0 {
 		go schedule.CleanCache()
 	}
@@ -111,6 +162,11 @@ func main() {
 	router.GET("/healthz", handler.Healthz) // 具体路由放在前面
 	router.NoRoute(handler.Convert)         // 使用 NoRoute 替代 /*path
 
+	// 管理接口，需要配置 ADMIN_TOKEN
+	admin := router.Group("/admin", handler.AdminAuth)
+	admin.POST("/purge", handler.PurgeCache)
+	admin.GET("/stats", handler.CacheStats)
+
 	// 设置服务器参数
 	server := &http.Server{
 		Addr:              listenAddress,